@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,14 +9,15 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
-	lob "github.com/rc-postcard/rc-postcard/lob"
 	"github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/webhook"
 )
 
-// pacCache is a personal access token cache used by the /tile API
-var pacCache = map[string]*User{}
+// pacCache is a personal access token cache used by authMiddleware. It is
+// reconfigured from the environment in main.
+var pacCache = newPatCache(defaultPatCacheTTL, defaultPatCacheNegativeTTL, defaultPatCacheMaxEntries)
 
 type Contact struct {
 	RecurseId           int    `json:"recurseId"`
@@ -34,6 +36,9 @@ func serveContacts(w http.ResponseWriter, r *http.Request) {
 	if !verifyRoute(w, r, http.MethodGet, "/contacts") {
 		return
 	}
+	if !requireScope(w, r, ScopePostcardsRead) {
+		return
+	}
 
 	var user *User = r.Context().Value(userContextKey).(*User)
 
@@ -75,19 +80,64 @@ func serveAddress(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleCheckoutSessionCompleted(checkoutSession stripe.CheckoutSession) {
+// handleCheckoutSessionCompleted grants the numCredits a checkout session
+// bought. They are counted from its line items by the caller, so that Stripe
+// isn't called while the event is locked.
+func handleCheckoutSessionCompleted(tx *sql.Tx, eventId string, checkoutSession stripe.CheckoutSession, numCredits int) error {
 	recurseId, err := strconv.Atoi(checkoutSession.ClientReferenceID)
 	if err != nil {
+		// retrying won't fix a bad reference, so record the event and move on
 		log.Println(err)
-		return
+		return nil
+	}
+
+	if err = setStripeEventRecurseId(tx, eventId, recurseId); err != nil {
+		return err
 	}
 
 	if checkoutSession.Livemode {
-		log.Printf("Incrementing credits for %d\n", recurseId)
-		postgresClient.incrementCredits(recurseId)
+		log.Printf("Incrementing credits for %d by %d\n", recurseId, numCredits)
+		var paymentIntentId string
+		if checkoutSession.PaymentIntent != nil {
+			paymentIntentId = checkoutSession.PaymentIntent.ID
+		}
+		return addCreditsTx(tx, creditTransaction{
+			RecurseId:               recurseId,
+			Amount:                  numCredits,
+			Kind:                    CreditPurchase,
+			StripeEventId:           eventId,
+			StripeCheckoutSessionId: checkoutSession.ID,
+			StripePaymentIntentId:   paymentIntentId,
+		})
 	} else {
-		log.Printf("Not a live transaction -- not incrementing credits for %d\n", recurseId)
+		log.Printf("Not a live transaction -- not incrementing credits for %d by %d\n", recurseId, numCredits)
+	}
+	return nil
+}
+
+// handleChargeRefunded revokes the share of a purchase's credits that has
+// been refunded so far.
+func handleChargeRefunded(tx *sql.Tx, eventId string, charge stripe.Charge) error {
+	if charge.PaymentIntent == "" || charge.Amount == 0 {
+		log.Printf("Charge %s has no payment intent, nothing to revoke\n", charge.ID)
+		return nil
 	}
+	return revokePurchaseCreditsTx(tx, eventId, charge.PaymentIntent, charge.AmountRefunded, charge.Amount)
+}
+
+// handleChargeDisputeCreated revokes all credits bought with a disputed charge.
+func handleChargeDisputeCreated(tx *sql.Tx, eventId string, dispute stripe.Dispute) error {
+	var paymentIntentId string
+	if dispute.PaymentIntent != nil {
+		paymentIntentId = dispute.PaymentIntent.ID
+	} else if dispute.Charge != nil {
+		paymentIntentId = dispute.Charge.PaymentIntent
+	}
+	if paymentIntentId == "" {
+		log.Printf("Dispute %s has no payment intent, nothing to revoke\n", dispute.ID)
+		return nil
+	}
+	return revokePurchaseCreditsTx(tx, eventId, paymentIntentId, 1, 1)
 }
 
 func serveTestStripeWebhook(w http.ResponseWriter, req *http.Request) {
@@ -122,6 +172,7 @@ func serveStripeWebhook(w http.ResponseWriter, req *http.Request, endpointSecret
 	}
 
 	// Unmarshal the event data into an appropriate struct depending on its Type
+	var handle func(tx *sql.Tx) error
 	switch event.Type {
 	case "checkout.session.completed":
 		log.Printf("Event %v\n", event)
@@ -133,12 +184,52 @@ func serveStripeWebhook(w http.ResponseWriter, req *http.Request, endpointSecret
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		// Then define and call a func to handle the successful payment intent.
-		handleCheckoutSessionCompleted(checkoutSession)
+		numCredits, err := creditsForCheckoutSession(checkoutSession)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting line items of checkout session %s: %v\n", checkoutSession.ID, err)
+			w.WriteHeader(http.StatusInternalServerError) // Stripe will retry
+			return
+		}
+		// Then define a func to handle the successful payment intent.
+		handle = func(tx *sql.Tx) error {
+			return handleCheckoutSessionCompleted(tx, event.ID, checkoutSession, numCredits)
+		}
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing webhook JSON: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		handle = func(tx *sql.Tx) error {
+			return handleChargeRefunded(tx, event.ID, charge)
+		}
+	case "charge.dispute.created":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing webhook JSON: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		handle = func(tx *sql.Tx) error {
+			return handleChargeDisputeCreated(tx, event.ID, dispute)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Unhandled event type: %s\n", event.Type)
 	}
 
+	// Stripe retries deliveries, so the event log makes sure each event is
+	// only handled once.
+	alreadyHandled, err := postgresClient.processStripeEvent(event.ID, event.Type, event.Livemode, payload, handle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error handling event %s: %v\n", event.ID, err)
+		w.WriteHeader(http.StatusInternalServerError) // Stripe will retry
+		return
+	}
+	if alreadyHandled {
+		log.Printf("Event %s already handled\n", event.ID)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -164,33 +255,41 @@ func createOrUpdateAddress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if acceptsPhysicalMail {
-		verifyAddressResponse, err := lobClient.VerifyAddressBySendingTestPostcard(address1, address2, city, state, zip)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "Error verifying address", http.StatusBadRequest)
-			return
-		}
+	label, makeDefault, effectiveFrom, err := parseSaveAddressForm(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		if verifyAddressResponse.Deliverability == lob.Undeliverable {
-			log.Println("Address undeliverable")
-			http.Error(w, "Address undeliverable", http.StatusBadRequest)
-			return
-		}
+	country, err := validateFormAddress(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if acceptsPhysicalMail && !verifyDeliverableFormAddress(w, r, country) {
+		return
 	}
 
-	createAddressResponse, err := lobClient.CreateAddress(name, address1, address2, city, state, zip, user.Id, true)
+	createAddressResponse, err := lobClient.CreateAddress(name, address1, address2, city, state, zip, country, user.Id, true)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Error creating address", http.StatusInternalServerError)
 		return
 	}
 
-	if err = postgresClient.updateAddress(user.Id, createAddressResponse.AddressId, acceptsPhysicalMail); err != nil {
+	supersededLobAddressId, err := postgresClient.saveAddress(user.Id, label, createAddressResponse.AddressId, acceptsPhysicalMail, makeDefault, effectiveFrom)
+	if err != nil {
 		log.Println(err)
 		http.Error(w, "Error setting address in database", http.StatusInternalServerError)
 		return
 	}
+	// postcards already at Lob keep their own copy of the address
+	if supersededLobAddressId != "" {
+		if err = lobClient.DeleteAddress(supersededLobAddressId, true); err != nil {
+			log.Printf("Error deleting Lob address %s: %v\n", supersededLobAddressId, err)
+		}
+	}
 
 	resp, err := JSONMarshal(new(struct{}))
 	if err != nil {
@@ -214,9 +313,9 @@ type GetAddressResponse struct {
 	AddressZip          string `json:"address_zip"`
 	AddressCountry      string `json:"address_country"`
 	AcceptsPhysicalMail bool   `json:"acceptsPhysicalMail"`
+	AddressVerified     bool   `json:"addressVerified"`
 	RecurseId           int    `json:"recurse_id"`
 	Email               string `json:"email"`
-	StripePaymentLinkId string `json:"stripePaymentLinkId"`
 }
 
 func getAddress(w http.ResponseWriter, r *http.Request) {
@@ -233,7 +332,13 @@ func getAddress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	paymentLinkId := os.Getenv("STRIPE_PAYMENT_LINK_ID")
+	addressVerified, err := postgresClient.getAddressVerified(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	var getAddressResponse GetAddressResponse
 	if lobAddressId != "" {
 		lobAddressResponse, err := lobClient.GetAddress(lobAddressId, true)
@@ -251,23 +356,23 @@ func getAddress(w http.ResponseWriter, r *http.Request) {
 			AddressZip:          lobAddressResponse.AddressZip,
 			AddressCountry:      lobAddressResponse.AddressCountry,
 			AcceptsPhysicalMail: acceptsPhysicalMail,
+			AddressVerified:     addressVerified,
 			RecurseId:           user.Id,
 			Email:               user.Email,
-			StripePaymentLinkId: paymentLinkId,
 		}
 	} else {
 		getAddressResponse = GetAddressResponse{
 			Name:                user.Name,
-			AddressLine1:        lob.RecurseAddressLine1,
-			AddressLine2:        lob.RecurseAddressLine2,
-			AddressCity:         lob.RecurseAddressCity,
-			AddressState:        lob.RecurseAddressState,
-			AddressZip:          lob.RecurseAddressZip,
-			AddressCountry:      lob.RecurseAddressCountry,
+			AddressLine1:        org.Address.AddressLine1,
+			AddressLine2:        org.Address.AddressLine2,
+			AddressCity:         org.Address.AddressCity,
+			AddressState:        org.Address.AddressState,
+			AddressZip:          org.Address.AddressZip,
+			AddressCountry:      org.Address.AddressCountry,
 			AcceptsPhysicalMail: false,
+			AddressVerified:     true,
 			RecurseId:           user.Id,
 			Email:               user.Email,
-			StripePaymentLinkId: paymentLinkId,
 		}
 	}
 
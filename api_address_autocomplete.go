@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// minAutocompletePrefix is the shortest prefix worth asking Lob about.
+const minAutocompletePrefix = 3
+
+type AutocompleteSuggestion struct {
+	AddressLine1 string `json:"address_line1"`
+	AddressCity  string `json:"address_city"`
+	AddressState string `json:"address_state"`
+	AddressZip   string `json:"address_zip"`
+}
+
+type AutocompleteResponse struct {
+	Suggestions []AutocompleteSuggestion `json:"suggestions"`
+}
+
+// autocompleteAddress serves 'GET /addresses/autocomplete?prefix=...', with
+// optional city, state and zip to narrow the suggestions. Prefixes too short
+// to be useful get no suggestions rather than an error, so forms can call it
+// on every keystroke. Lookups that miss the cache are rate limited per user.
+func autocompleteAddress(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/addresses/autocomplete") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	query := r.URL.Query()
+	autocompleteRequest := lob.LobAutocompleteRequest{
+		AddressPrefix: strings.TrimSpace(query.Get("prefix")),
+		City:          query.Get("city"),
+		State:         query.Get("state"),
+		ZipCode:       query.Get("zip"),
+	}
+
+	response := AutocompleteResponse{Suggestions: []AutocompleteSuggestion{}}
+	if len(autocompleteRequest.AddressPrefix) < minAutocompletePrefix {
+		writeJSONResponse(w, response)
+		return
+	}
+
+	suggestions, ok := autocompleteResults.get(autocompleteRequest)
+	if !ok {
+		if allowed, retryAfter := autocompleteLimiter.allow(user.Id); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		autocompleteResponse, err := lobClient.Autocomplete(autocompleteRequest)
+		if lobError, ok := err.(*lob.LobError); ok && lobError.StatusCode/100 == 4 {
+			http.Error(w, lobError.Message, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println(err)
+			http.Error(w, "Error autocompleting address", http.StatusInternalServerError)
+			return
+		}
+		suggestions = autocompleteResponse.Suggestions
+		autocompleteResults.set(autocompleteRequest, suggestions)
+	}
+
+	for _, suggestion := range suggestions {
+		response.Suggestions = append(response.Suggestions, AutocompleteSuggestion{
+			AddressLine1: suggestion.PrimaryLine,
+			AddressCity:  suggestion.City,
+			AddressState: suggestion.State,
+			AddressZip:   suggestion.ZipCode,
+		})
+	}
+
+	writeJSONResponse(w, response)
+}
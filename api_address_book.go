@@ -0,0 +1,252 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// maxAddressBookContacts is how many contacts a user may save.
+const maxAddressBookContacts = 100
+
+// AddressBookContact is someone outside RC a user can mail physical
+// postcards to. Postcards are addressed with the Lob address, of which the
+// address fields are a copy.
+type AddressBookContact struct {
+	Id             int64     `json:"id"`
+	Name           string    `json:"name"`
+	AddressLine1   string    `json:"address_line1"`
+	AddressLine2   string    `json:"address_line2"`
+	AddressCity    string    `json:"address_city"`
+	AddressState   string    `json:"address_state"`
+	AddressZip     string    `json:"address_zip"`
+	AddressCountry string    `json:"address_country"`
+	CreatedAt      time.Time `json:"createdAt"`
+
+	lobAddressId string
+	// hasAddress is false for contacts saved before addresses were copied.
+	hasAddress bool
+}
+
+// newAddressBookContact returns a contact for an address created at Lob.
+func newAddressBookContact(createAddressResponse *lob.LobCreateAddressResponse) *AddressBookContact {
+	return &AddressBookContact{
+		Name:           createAddressResponse.Name,
+		AddressLine1:   createAddressResponse.AddressLine1,
+		AddressLine2:   createAddressResponse.AddressLine2,
+		AddressCity:    createAddressResponse.AddressCity,
+		AddressState:   createAddressResponse.AddressState,
+		AddressZip:     createAddressResponse.AddressZip,
+		AddressCountry: createAddressResponse.AddressCountry,
+		lobAddressId:   createAddressResponse.AddressId,
+		hasAddress:     true,
+	}
+}
+
+// fillAddress copies a contact's address from Lob.
+func (c *AddressBookContact) fillAddress() error {
+	lobAddressResponse, err := lobClient.GetAddress(c.lobAddressId, true)
+	if err != nil {
+		return err
+	}
+	c.AddressLine1 = lobAddressResponse.AddressLine1
+	c.AddressLine2 = lobAddressResponse.AddressLine2
+	c.AddressCity = lobAddressResponse.AddressCity
+	c.AddressState = lobAddressResponse.AddressState
+	c.AddressZip = lobAddressResponse.AddressZip
+	c.AddressCountry = lobAddressResponse.AddressCountry
+	return nil
+}
+
+type GetAddressBookResponse struct {
+	Contacts []*AddressBookContact `json:"contacts"`
+}
+
+// serveAddressBook serves the '/addressbook' route.
+func serveAddressBook(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		createAddressBookContact(w, r)
+	} else if r.Method == http.MethodGet {
+		getAddressBook(w, r)
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+}
+
+// serveAddressBookContact serves the '/addressbook/{id}' routes.
+func serveAddressBookContact(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/addressbook/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		updateAddressBookContact(w, r, id)
+	} else if r.Method == http.MethodDelete {
+		deleteAddressBookContact(w, r, id)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+func getAddressBook(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/addressbook") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	contacts, err := postgresClient.getAddressBookContacts(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, contact := range contacts {
+		if contact.hasAddress {
+			continue
+		}
+		// list the contact without its address if Lob can't be reached
+		if err = contact.fillAddress(); err != nil {
+			log.Printf("Error getting address of contact %d: %v\n", contact.Id, err)
+			continue
+		}
+		if err = postgresClient.storeAddressBookContactAddress(contact); err != nil {
+			log.Printf("Error storing address of contact %d: %v\n", contact.Id, err)
+		}
+	}
+
+	writeJSONResponse(w, GetAddressBookResponse{Contacts: contacts})
+}
+
+// createContactAddress verifies the address in the request form and creates
+// it at Lob. On failure it responds and returns nil.
+func createContactAddress(w http.ResponseWriter, r *http.Request, user *User) *lob.LobCreateAddressResponse {
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return nil
+	}
+
+	name, address1, address2 := r.FormValue("name"), r.FormValue("address1"), r.FormValue("address2")
+	city, state, zip := r.FormValue("city"), r.FormValue("state"), r.FormValue("zip")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return nil
+	}
+
+	country, err := validateFormAddress(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if !verifyDeliverableFormAddress(w, r, country) {
+		return nil
+	}
+
+	createAddressResponse, err := lobClient.CreateContactAddress(name, address1, address2, city, state, zip, country, user.Id, true)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error creating address", http.StatusInternalServerError)
+		return nil
+	}
+	return createAddressResponse
+}
+
+func createAddressBookContact(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/addressbook") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	contacts, err := postgresClient.getAddressBookContacts(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(contacts) >= maxAddressBookContacts {
+		http.Error(w, "Address book is full", http.StatusConflict)
+		return
+	}
+
+	createAddressResponse := createContactAddress(w, r, user)
+	if createAddressResponse == nil {
+		return
+	}
+
+	contact := newAddressBookContact(createAddressResponse)
+	if err = postgresClient.insertAddressBookContact(user.Id, contact); err != nil {
+		log.Println(err)
+		http.Error(w, "Error saving contact in database", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, contact)
+}
+
+// updateAddressBookContact replaces a contact's address. Lob addresses can't
+// be edited, so a new one is created and the old one deleted.
+func updateAddressBookContact(w http.ResponseWriter, r *http.Request, id int64) {
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	if _, err := postgresClient.getAddressBookContact(user.Id, id); err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	createAddressResponse := createContactAddress(w, r, user)
+	if createAddressResponse == nil {
+		return
+	}
+
+	contact := newAddressBookContact(createAddressResponse)
+	contact.Id = id
+	oldLobAddressId, err := postgresClient.updateAddressBookContact(user.Id, contact)
+	if err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error saving contact in database", http.StatusInternalServerError)
+		return
+	}
+	// postcards already at Lob keep their own copy of the address
+	if err = lobClient.DeleteAddress(oldLobAddressId, true); err != nil {
+		log.Printf("Error deleting Lob address %s: %v\n", oldLobAddressId, err)
+	}
+
+	writeJSONResponse(w, contact)
+}
+
+func deleteAddressBookContact(w http.ResponseWriter, r *http.Request, id int64) {
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	lobAddressId, err := postgresClient.deleteAddressBookContact(user.Id, id)
+	if err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err = lobClient.DeleteAddress(lobAddressId, true); err != nil {
+		log.Printf("Error deleting Lob address %s: %v\n", lobAddressId, err)
+	}
+
+	writeJSONResponse(w, new(struct{}))
+}
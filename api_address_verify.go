@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// defaultCountry is the country of addresses given without one.
+const defaultCountry = "US"
+
+var validCountry = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// postalCodeFormats are the postal code formats of the countries alumni most
+// often live in. Other countries' postal codes are only checked for length.
+var postalCodeFormats = map[string]*regexp.Regexp{
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"IE": regexp.MustCompile(`^[A-Z\d]{3} ?[A-Z\d]{4}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"ES": regexp.MustCompile(`^\d{5}$`),
+	"IT": regexp.MustCompile(`^\d{5}$`),
+	"SE": regexp.MustCompile(`^\d{3} ?\d{2}$`),
+	"CH": regexp.MustCompile(`^\d{4}$`),
+	"AT": regexp.MustCompile(`^\d{4}$`),
+	"BE": regexp.MustCompile(`^\d{4}$`),
+	"DK": regexp.MustCompile(`^\d{4}$`),
+	"NO": regexp.MustCompile(`^\d{4}$`),
+	"AU": regexp.MustCompile(`^\d{4}$`),
+	"NZ": regexp.MustCompile(`^\d{4}$`),
+	"JP": regexp.MustCompile(`^\d{3}-?\d{4}$`),
+	"IN": regexp.MustCompile(`^\d{6}$`),
+	"BR": regexp.MustCompile(`^\d{5}-?\d{3}$`),
+}
+
+// maxPostalCodeLength is the longest postal code accepted for countries
+// without a known format.
+const maxPostalCodeLength = 12
+
+// regionCodes are the states, provinces and territories of countries whose
+// addresses need one.
+var regionCodes = map[string][]string{
+	"US": {"AL", "AK", "AZ", "AR", "CA", "CO", "CT", "DE", "DC", "FL", "GA", "HI", "ID", "IL", "IN", "IA", "KS", "KY", "LA", "ME", "MD", "MA", "MI", "MN", "MS", "MO", "MT", "NE", "NV", "NH", "NJ", "NM", "NY", "NC", "ND", "OH", "OK", "OR", "PA", "RI", "SC", "SD", "TN", "TX", "UT", "VT", "VA", "WA", "WV", "WI", "WY", "AS", "GU", "MP", "PR", "VI", "AA", "AE", "AP"},
+	"CA": {"AB", "BC", "MB", "NB", "NL", "NS", "NT", "NU", "ON", "PE", "QC", "SK", "YT"},
+	"AU": {"ACT", "NSW", "NT", "QLD", "SA", "TAS", "VIC", "WA"},
+}
+
+// validateFormAddress checks the country, state and zip form values against
+// the formats of the address's country, and returns the country as an ISO
+// 3166 alpha-2 code.
+func validateFormAddress(r *http.Request) (country string, err error) {
+	country = strings.ToUpper(strings.TrimSpace(r.FormValue("country")))
+	if !lob.IsInternational(country) {
+		// also accepts the "UNITED STATES" Lob answers with
+		country = defaultCountry
+	}
+	if !validCountry.MatchString(country) {
+		return "", errors.New("country must be a 2 letter ISO 3166 country code")
+	}
+
+	state := strings.ToUpper(strings.TrimSpace(r.FormValue("state")))
+	if codes, ok := regionCodes[country]; ok {
+		if state == "" && country != defaultCountry {
+			return "", fmt.Errorf("state is required for addresses in %s", country)
+		}
+		if state != "" && !contains(codes, state) {
+			return "", fmt.Errorf("state must be one of %s for addresses in %s", strings.Join(codes, ", "), country)
+		}
+	}
+
+	zip := strings.ToUpper(strings.TrimSpace(r.FormValue("zip")))
+	if format, ok := postalCodeFormats[country]; ok {
+		if zip != "" && !format.MatchString(zip) {
+			return "", fmt.Errorf("zip is not a valid postal code for %s", country)
+		}
+	} else if len(zip) > maxPostalCodeLength {
+		return "", fmt.Errorf("zip must be at most %d characters", maxPostalCodeLength)
+	}
+
+	if country == defaultCountry {
+		if zip == "" && (r.FormValue("city") == "" || state == "") {
+			return "", errors.New("zip is required, or both city and state")
+		}
+	} else if r.FormValue("city") == "" {
+		return "", errors.New("city is required for international addresses")
+	}
+	return country, nil
+}
+
+type DpvFootnote struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// VerifyAddressResponse shows the user the address as the postal service
+// knows it, so they can accept the corrected address before saving it.
+// Components, DeliverabilityAnalysis and DpvFootnotes are only known for US
+// addresses, and Coverage and Status only for international ones.
+type VerifyAddressResponse struct {
+	Deliverability string `json:"deliverability"`
+	Deliverable    bool   `json:"deliverable"`
+	// Changed is set if the suggested address differs from what was entered.
+	Changed                bool                           `json:"changed"`
+	SuggestedAddress       lob.LobAddress                 `json:"suggestedAddress"`
+	Components             *lob.LobAddressComponents      `json:"components,omitempty"`
+	DeliverabilityAnalysis *lob.LobDeliverabilityAnalysis `json:"deliverabilityAnalysis,omitempty"`
+	DpvFootnotes           []DpvFootnote                  `json:"dpvFootnotes"`
+	Coverage               string                         `json:"coverage,omitempty"`
+	Status                 string                         `json:"status,omitempty"`
+}
+
+// verifyFormAddress verifies the address1, address2, city, state and zip
+// form values, US addresses against USPS data and others with Lob's
+// international verifications. On failure it responds and returns nil.
+func verifyFormAddress(w http.ResponseWriter, r *http.Request, country string) *VerifyAddressResponse {
+	var response VerifyAddressResponse
+	var err error
+	if lob.IsInternational(country) {
+		var verifyAddressResponse *lob.LobIntlVerifyAddressResponse
+		verifyAddressResponse, err = lobClient.VerifyIntlAddress(r.FormValue("address1"), r.FormValue("address2"), r.FormValue("city"), r.FormValue("state"), r.FormValue("zip"), country)
+		if err == nil {
+			response = VerifyAddressResponse{
+				Deliverability:   verifyAddressResponse.Deliverability,
+				Deliverable:      verifyAddressResponse.Deliverability == lob.IntlDeliverable || verifyAddressResponse.Deliverability == lob.IntlDeliverableMissingInfo,
+				SuggestedAddress: verifyAddressResponse.SuggestedAddress(),
+				DpvFootnotes:     []DpvFootnote{},
+				Coverage:         verifyAddressResponse.Coverage,
+				Status:           verifyAddressResponse.Status,
+			}
+		}
+	} else {
+		var verifyAddressResponse *lob.LobVerifyAddressResponse
+		verifyAddressResponse, err = lobClient.VerifyAddress(r.FormValue("address1"), r.FormValue("address2"), r.FormValue("city"), r.FormValue("state"), r.FormValue("zip"))
+		if err == nil {
+			response = VerifyAddressResponse{
+				Deliverability:         verifyAddressResponse.Deliverability,
+				Deliverable:            verifyAddressResponse.Deliverability != lob.Undeliverable,
+				SuggestedAddress:       verifyAddressResponse.SuggestedAddress(),
+				Components:             &verifyAddressResponse.Components,
+				DeliverabilityAnalysis: &verifyAddressResponse.DeliverabilityAnalysis,
+				DpvFootnotes:           []DpvFootnote{},
+			}
+			response.SuggestedAddress.AddressCountry = country
+			for _, code := range verifyAddressResponse.DeliverabilityAnalysis.DpvFootnotes {
+				response.DpvFootnotes = append(response.DpvFootnotes, DpvFootnote{Code: code, Description: lob.DpvFootnoteDescriptions[code]})
+			}
+		}
+	}
+	if lobError, ok := err.(*lob.LobError); ok && lobError.StatusCode/100 == 4 {
+		http.Error(w, lobError.Message, http.StatusBadRequest)
+		return nil
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error verifying address", http.StatusInternalServerError)
+		return nil
+	}
+
+	suggested := response.SuggestedAddress
+	response.Changed = suggested.AddressLine1 != r.FormValue("address1") ||
+		suggested.AddressLine2 != r.FormValue("address2") ||
+		suggested.AddressCity != r.FormValue("city") ||
+		suggested.AddressState != r.FormValue("state") ||
+		suggested.AddressZip != r.FormValue("zip") ||
+		suggested.AddressCountry != country
+	return &response
+}
+
+// verifyDeliverableFormAddress is verifyFormAddress for addresses that are
+// about to be saved, which must be deliverable.
+func verifyDeliverableFormAddress(w http.ResponseWriter, r *http.Request, country string) bool {
+	verifyAddressResponse := verifyFormAddress(w, r, country)
+	if verifyAddressResponse == nil {
+		return false
+	}
+	if !verifyAddressResponse.Deliverable {
+		http.Error(w, "Address undeliverable", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// verifyAddress serves 'POST /addresses/verify'.
+func verifyAddress(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/addresses/verify") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return
+	}
+
+	country, err := validateFormAddress(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	verifyAddressResponse := verifyFormAddress(w, r, country)
+	if verifyAddressResponse == nil {
+		return
+	}
+
+	writeJSONResponse(w, verifyAddressResponse)
+}
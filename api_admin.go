@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminRecurseIds are the users allowed to use /admin routes. It is loaded
+// from ADMIN_RECURSE_IDS at startup.
+var adminRecurseIds = map[int]bool{}
+
+// parseRecurseIds parses a comma separated list of recurse ids.
+func parseRecurseIds(s string) (map[int]bool, error) {
+	ids := map[int]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recurse id %q", field)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// adminMiddleware only lets admins through. It must run after authMiddleware.
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *User = r.Context().Value(userContextKey).(*User)
+		if !adminRecurseIds[user.Id] {
+			log.Printf("User %d is not an admin\n", user.Id)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type PurgeTokenCacheResponse struct {
+	Purged int `json:"purged"`
+}
+
+// serveAdminTokenCache purges a user's cached personal access tokens, e.g.
+// after they report a leaked token.
+func serveAdminTokenCache(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodDelete, "/admin/tokenCache") {
+		return
+	}
+
+	recurseId, err := strconv.Atoi(r.URL.Query().Get("recurseId"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Missing or malformed recurseId", http.StatusBadRequest)
+		return
+	}
+
+	purged := pacCache.purgeUser(recurseId)
+	log.Printf("Purged %d cached tokens for %d\n", purged, recurseId)
+
+	resp, err := JSONMarshal(PurgeTokenCacheResponse{Purged: purged})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
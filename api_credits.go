@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/stripe/stripe-go"
+)
+
+// maxPacksPerCheckout bounds the quantity of a single checkout session.
+const maxPacksPerCheckout = 10
+
+type CreditsResponse struct {
+	Credits int   `json:"credits"`
+	Packs   []int `json:"packs"`
+	// PostcardCredits is what a physical postcard of each size costs.
+	PostcardCredits map[string]int `json:"postcardCredits"`
+	// LetterCredits is what a physical letter costs.
+	LetterCredits int `json:"letterCredits"`
+	// International costs apply to recipients outside the US.
+	InternationalPostcardCredits map[string]int `json:"internationalPostcardCredits"`
+	InternationalLetterCredits   int            `json:"internationalLetterCredits"`
+}
+
+func serveCredits(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/credits") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	credits, err := postgresClient.getCredits(user.Id)
+	if err != nil {
+		log.Println(err)
+		credits = 0
+	}
+
+	resp, err := JSONMarshal(CreditsResponse{
+		Credits:                      credits,
+		Packs:                        creditPacks(),
+		PostcardCredits:              postcardCredits,
+		LetterCredits:                letterCredits,
+		InternationalPostcardCredits: internationalPostcardCredits,
+		InternationalLetterCredits:   internationalLetterCredits,
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+type CreateCheckoutSessionResponse struct {
+	Url string `json:"url"`
+}
+
+// createCheckoutSessionResponse is the part of Stripe's checkout session
+// object we need. stripe-go v70's CheckoutSession has no url field.
+type createCheckoutSessionResponse struct {
+	Id  string `json:"id"`
+	Url string `json:"url"`
+}
+
+// serveCreditsCheckout creates a Stripe Checkout Session for the
+// authenticated user and returns its URL. The client_reference_id credited by
+// the webhook is set here rather than by the browser, so it can't be
+// tampered with.
+func serveCreditsCheckout(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/credits/checkout") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return
+	}
+
+	pack, err := strconv.Atoi(r.FormValue("pack"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Missing or malformed pack", http.StatusBadRequest)
+		return
+	}
+	priceId, ok := priceIdForPack(pack)
+	if !ok {
+		log.Printf("No price for a pack of %d credits\n", pack)
+		http.Error(w, "Unknown pack", http.StatusBadRequest)
+		return
+	}
+
+	quantity := 1
+	if r.FormValue("quantity") != "" {
+		quantity, err = strconv.Atoi(r.FormValue("quantity"))
+		if err != nil || quantity < 1 || quantity > maxPacksPerCheckout {
+			log.Printf("Bad quantity %q\n", r.FormValue("quantity"))
+			http.Error(w, "Malformed quantity", http.StatusBadRequest)
+			return
+		}
+	}
+
+	baseUrl := appBaseUrl()
+	params := &stripe.CheckoutSessionParams{
+		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		ClientReferenceID:  stripe.String(strconv.Itoa(user.Id)),
+		SuccessURL:         stripe.String(baseUrl + "/?checkout=success"),
+		CancelURL:          stripe.String(baseUrl + "/?checkout=cancel"),
+	}
+	if user.Email != "" {
+		params.CustomerEmail = stripe.String(user.Email)
+	}
+	params.AddExtra("line_items[0][price]", priceId)
+	params.AddExtra("line_items[0][quantity]", strconv.Itoa(quantity))
+	params.AddMetadata("rc_id", strconv.Itoa(user.Id))
+
+	var checkoutSession createCheckoutSessionResponse
+	if err := stripeBackend.Call(http.MethodPost, "/v1/checkout/sessions", stripeKey(stripeLivemode), params, &checkoutSession); err != nil {
+		log.Println(err)
+		http.Error(w, "Error creating checkout session", http.StatusBadGateway)
+		return
+	}
+	log.Printf("Created checkout session %s for %d\n", checkoutSession.Id, user.Id)
+
+	resp, err := JSONMarshal(CreateCheckoutSessionResponse{Url: checkoutSession.Url})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeCreditsCheckout(t *testing.T) {
+	priceCredits = map[string]int{"price_single": 1, "price_five": 5}
+	t.Cleanup(func() { priceCredits = map[string]int{} })
+	t.Setenv("STRIPE_TEST_KEY", "sk_test_123")
+	stripeLivemode = false
+	t.Cleanup(func() { stripeLivemode = true })
+	previousRedirectURL := oauthConf.RedirectURL
+	oauthConf.RedirectURL = "https://postcards.example.com/auth"
+	t.Cleanup(func() { oauthConf.RedirectURL = previousRedirectURL })
+
+	var form url.Values
+	useStripeStandIn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/checkout/sessions" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer sk_test_123" {
+			t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "cs_test_1", "object": "checkout.session", "url": "https://checkout.stripe.com/pay/cs_test_1"}`))
+	}))
+
+	user := &User{Id: 7, Email: "ada@example.com"}
+	// a client supplied client_reference_id must be ignored
+	body := strings.NewReader("pack=5&quantity=2&client_reference_id=99")
+	r := httptest.NewRequest(http.MethodPost, "/credits/checkout", body)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	serveCreditsCheckout(w, withUser(r, user))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp CreateCheckoutSessionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Url != "https://checkout.stripe.com/pay/cs_test_1" {
+		t.Errorf("got url %q", resp.Url)
+	}
+
+	for field, want := range map[string]string{
+		"client_reference_id":     "7",
+		"customer_email":          "ada@example.com",
+		"line_items[0][price]":    "price_five",
+		"line_items[0][quantity]": "2",
+		"mode":                    "payment",
+		"success_url":             "https://postcards.example.com/?checkout=success",
+		"cancel_url":              "https://postcards.example.com/?checkout=cancel",
+	} {
+		if got := form.Get(field); got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestServeCreditsCheckoutUnknownPack(t *testing.T) {
+	priceCredits = map[string]int{"price_single": 1}
+	t.Cleanup(func() { priceCredits = map[string]int{} })
+
+	r := httptest.NewRequest(http.MethodPost, "/credits/checkout", strings.NewReader("pack=3"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	serveCreditsCheckout(w, withUser(r, &User{Id: 7}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// letterCredits is what a physical letter costs.
+const letterCredits = 2
+
+// internationalLetterCredits is what a physical letter costs to a recipient
+// outside the US.
+const internationalLetterCredits = 4
+
+// maxLetterLength is the longest message rendered into the letter template.
+const maxLetterLength = 20000
+
+// Letter is our own record of a letter sent through Lob.
+type Letter struct {
+	Id                   int64      `json:"id"`
+	FromRecurseId        int        `json:"fromRecurseId"`
+	ToRecurseId          int        `json:"toRecurseId"`
+	Mode                 string     `json:"mode"`
+	LobId                string     `json:"lobId"`
+	Message              string     `json:"message"`
+	FileRef              string     `json:"fileRef"`
+	Color                bool       `json:"color"`
+	DoubleSided          bool       `json:"doubleSided"`
+	ReturnEnvelope       bool       `json:"returnEnvelope"`
+	CreditTransactionId  int64      `json:"-"`
+	CreatedAt            time.Time  `json:"createdAt"`
+	ExpectedDeliveryDate *time.Time `json:"expectedDeliveryDate"`
+	Status               string     `json:"status"`
+	// Url is a freshly signed link to a digital letter's PDF, filled in when
+	// getting a single letter.
+	Url string `json:"url,omitempty"`
+}
+
+// lobIdempotencyKey identifies the request creating l at Lob, like
+// Postcard.lobIdempotencyKey.
+func (l *Letter) lobIdempotencyKey() string {
+	return fmt.Sprintf("letter-%d-%d", l.Id, l.CreatedAt.UnixMicro())
+}
+
+func serveLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		sendLetter(w, r)
+	} else if r.Method == http.MethodGet {
+		getLetters(w, r)
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+}
+
+type GetLettersResponse struct {
+	Data       []*Letter `json:"data"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+// getLetters lists the letters sent to the user, newest first.
+func getLetters(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/letters") {
+		return
+	}
+	if !requireScope(w, r, ScopeLettersRead) {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	limit, beforeId, err := parsePageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// fetch one extra to know whether there is another page
+	letters, err := postgresClient.getReceivedLetters(user.Id, beforeId, limit+1)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	getLettersResponse := &GetLettersResponse{Data: letters}
+	if len(letters) > limit {
+		getLettersResponse.Data = letters[:limit]
+		getLettersResponse.NextCursor = strconv.FormatInt(letters[limit-1].Id, 10)
+	}
+
+	resp, err := JSONMarshal(getLettersResponse)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// getLetter serves the '/letters/{id}' route: a letter the user sent or
+// received, with a link to its PDF if it is digital.
+func getLetter(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/letters/")
+	if !verifyRoute(w, r, http.MethodGet, "/letters/"+ref) {
+		return
+	}
+	if !requireScope(w, r, ScopeLettersRead) {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Letter not found", http.StatusNotFound)
+		return
+	}
+
+	// recipients only see letters that were sent
+	letter, err := postgresClient.getLetter(id)
+	if err == errNotFound || (err == nil && letter.FromRecurseId != user.Id &&
+		(letter.ToRecurseId != user.Id || letter.Status == PostcardPending || letter.Status == PostcardFailed)) {
+		http.Error(w, "Letter not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// the proof of a physical letter shows the sender's return address, and
+	// Lob's urls expire, so a fresh one is fetched each time
+	if letter.Mode != PhysicalSend && letter.LobId != "" {
+		lobLetter, err := lobClient.GetLetter(letter.LobId, false)
+		if err != nil {
+			log.Printf("Error getting Lob letter %s: %v\n", letter.LobId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		letter.Url = lobLetter.Url
+	}
+
+	writeJSONResponse(w, letter)
+}
+
+type CreateLetterResponse struct {
+	Url      string `json:"url"`
+	Credits  int    `json:"credits"`
+	LetterId int64  `json:"letterId,omitempty"`
+}
+
+// readLetterFile reads the body of a letter from the request: an uploaded
+// PDF in "letter-file", or else the "message" field rendered into the letter
+// template.
+func readLetterFile(r *http.Request) (lob.LetterFile, string, string, error) {
+	if file, _, err := r.FormFile("letter-file"); err == nil {
+		defer file.Close()
+		pdf, err := ioutil.ReadAll(file)
+		if err != nil {
+			return lob.LetterFile{}, "", "", err
+		}
+		if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+			return lob.LetterFile{}, "", "", badLetterError("letter-file must be a PDF")
+		}
+		return lob.LetterFile{PDF: pdf}, "", frontImageRef(pdf), nil
+	}
+
+	message := r.FormValue("message")
+	if message == "" {
+		return lob.LetterFile{}, "", "", badLetterError("a message or letter-file is required")
+	}
+	if len(message) > maxLetterLength {
+		return lob.LetterFile{}, "", "", badLetterError("message is too long")
+	}
+	var html bytes.Buffer
+	if err := letterBody.Execute(&html, struct{ Message string }{Message: message}); err != nil {
+		return lob.LetterFile{}, "", "", err
+	}
+	return lob.LetterFile{HTML: html.String()}, message, "", nil
+}
+
+// badLetterError is a problem with a letter the sender can fix.
+type badLetterError string
+
+func (e badLetterError) Error() string {
+	return string(e)
+}
+
+func sendLetter(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/letters") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	toRecurseId, errToRecurseId := strconv.Atoi(query.Get("toRecurseId"))
+	if (!contains(validSendPostcardModes, mode)) || errToRecurseId != nil {
+		log.Printf("Missing or malformed query parameter %s %v\n", mode, errToRecurseId)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	scope := ScopeLettersSendDigital
+	if mode == PhysicalSend {
+		scope = ScopeLettersSendPhysical
+	}
+	if !requireScope(w, r, scope) {
+		return
+	}
+
+	// Parse our multipart form, 10 << 20 specifies a maximum upload of 10 MB files.
+	r.ParseMultipartForm(10 << 20)
+	file, message, fileRef, err := readLetterFile(r)
+	if _, ok := err.(badLetterError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	options := lob.LetterOptions{
+		Color:       r.FormValue("color") == "true",
+		DoubleSided: r.FormValue("doubleSided") == "true",
+	}
+	if r.FormValue("returnEnvelope") == "true" {
+		options.ReturnEnvelope = true
+		options.PerforatedPage, err = strconv.Atoi(r.FormValue("perforatedPage"))
+		if err != nil || options.PerforatedPage < 1 {
+			http.Error(w, "A return envelope needs the perforatedPage to tear off", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// digital letters show the organization's address as the return address
+	fromAddress := org.address(user.Name)
+
+	// by default we're sending to the organization
+	toAddress := org.address(org.Name)
+
+	var useProductionKey bool = false
+	if mode == PhysicalSend {
+		if toRecurseId != 0 {
+			recipientAddressId, recipientAcceptsPhysicalMail, err := postgresClient.getMailingAddress(toRecurseId)
+			if err != nil {
+				log.Printf("Error getting recurse address: %v\n", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !recipientAcceptsPhysicalMail {
+				http.Error(w, "Recipient does not accept physical mail", http.StatusBadRequest)
+				return
+			}
+			toAddress = lob.LobAddress{AddressId: recipientAddressId}
+		}
+
+		fromAddress, err = senderReturnAddress(user.Id, user.Name)
+		if err != nil {
+			log.Printf("Error getting return address: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		useProductionKey = true
+	} else if mode == DigitalSend {
+		_, _, _, userName, err := postgresClient.getUserInfo(toRecurseId)
+		if err != nil {
+			log.Printf("Error getting user: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// override the organization's name with userName
+		toAddress.Name = userName
+	}
+
+	// reserve the credits up front so concurrent sends can't overdraw them
+	var creditTransactionId int64
+	if mode == PhysicalSend {
+		cost := letterCredits
+		if international, err := isInternationalAddress(toAddress); err != nil {
+			log.Printf("Error getting recipient address: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		} else if international {
+			cost = internationalLetterCredits
+		}
+		creditTransactionId, err = postgresClient.reserveCredits(user.Id, cost)
+		if err == errInsufficientCredits {
+			log.Printf("Not enough credits for %d\n", user.Id)
+			http.Error(w, "Credits error", http.StatusPaymentRequired)
+			return
+		} else if err != nil {
+			log.Printf("Error reserving user credits: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// record the letter before Lob mails it, so it can't go untracked
+	var letter *Letter
+	idempotencyKey := ""
+	if mode == DigitalSend || mode == PhysicalSend {
+		letter = &Letter{
+			FromRecurseId:       user.Id,
+			ToRecurseId:         toRecurseId,
+			Mode:                mode,
+			Message:             message,
+			FileRef:             fileRef,
+			Color:               options.Color,
+			DoubleSided:         options.DoubleSided,
+			ReturnEnvelope:      options.ReturnEnvelope,
+			CreditTransactionId: creditTransactionId,
+			Status:              PostcardPending,
+		}
+		if err = postgresClient.insertLetter(letter); err != nil {
+			log.Printf("Error recording letter: %v\n", err)
+			if creditTransactionId != 0 {
+				if err := postgresClient.refundCredits(creditTransactionId); err != nil {
+					log.Printf("Error refunding credit transaction %d: %v\n", creditTransactionId, err)
+				}
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		idempotencyKey = letter.lobIdempotencyKey()
+	}
+
+	lobCreateLetterResponse, lobError := lobClient.CreateLetter(fromAddress, toAddress, file, options, useProductionKey, user.Id, toRecurseId, mode, idempotencyKey)
+	// the idempotency key makes it safe to ask again when Lob didn't answer
+	for attempt := 1; lobError != nil && lobError.Transient() && idempotencyKey != "" && attempt < lobCreateAttempts; attempt++ {
+		log.Printf("Retrying letter %d: %v\n", letter.Id, lobError)
+		time.Sleep(lobRetryDelay)
+		lobCreateLetterResponse, lobError = lobClient.CreateLetter(fromAddress, toAddress, file, options, useProductionKey, user.Id, toRecurseId, mode, idempotencyKey)
+	}
+	if lobError != nil && !lobError.Transient() && letter != nil {
+		if err := postgresClient.failLetter(letter.Id, creditTransactionId); err != nil {
+			log.Printf("Error failing letter %d: %v\n", letter.Id, err)
+		}
+	}
+	if lobError != nil && lobError.Transient() {
+		// Lob may have the letter anyway, so it stays pending with its
+		// credits reserved until reconcilePendingLetters finds out
+		log.Println(lobError)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	} else if lobError != nil {
+		resp, err := JSONMarshal(lobError)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(lobError.StatusCode)
+		w.Write(resp)
+		return
+	}
+
+	createLetterResponse := &CreateLetterResponse{}
+
+	if mode == DigitalPreview {
+		createLetterResponse.Url = lobCreateLetterResponse.Url
+	} else {
+		letter.LobId = lobCreateLetterResponse.Id
+		letter.Status = PostcardCreated
+		if mode == DigitalSend {
+			letter.Status = PostcardDelivered
+		}
+		if expectedDeliveryDate, err := time.Parse("2006-01-02", lobCreateLetterResponse.ExpectedDeliveryDate); err == nil {
+			letter.ExpectedDeliveryDate = &expectedDeliveryDate
+		}
+		// Lob has accepted the letter, so carry on even if this fails;
+		// the letter stays pending with its credits reserved.
+		if err := postgresClient.completeLetter(letter); err != nil {
+			log.Printf("Error recording letter %d as Lob letter %s: %v\n", letter.Id, lobCreateLetterResponse.Id, err)
+		}
+		createLetterResponse.LetterId = letter.Id
+	}
+
+	if mode == PhysicalSend {
+		numCredits, err := postgresClient.getCredits(user.Id)
+		if err != nil {
+			log.Printf("Error getting user credits: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		createLetterResponse.Credits = numCredits
+	}
+
+	resp, err := JSONMarshal(createLetterResponse)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
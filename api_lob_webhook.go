@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// lobWebhookSecret verifies deliveries to /lobWebhook. It is set from
+// LOB_WEBHOOK_SECRET in main; while it is empty the webhook is disabled.
+var lobWebhookSecret string
+
+// serveLobWebhook receives Lob's postcard tracking events and records them
+// against our postcards.
+func serveLobWebhook(w http.ResponseWriter, req *http.Request) {
+	if !verifyRoute(w, req, http.MethodPost, "/lobWebhook") {
+		return
+	}
+
+	if lobWebhookSecret == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	const MaxBodyBytes = int64(65536)
+	req.Body = http.MaxBytesReader(w, req.Body, MaxBodyBytes)
+	payload, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading request body: %v\n", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	event, err := lob.ConstructWebhookEvent(payload,
+		req.Header.Get(lob.SignatureHeader),
+		req.Header.Get(lob.SignatureTimestampHeader),
+		lobWebhookSecret,
+		time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying Lob webhook: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !contains(lob.PostcardTrackingEvents, event.EventType.Id) {
+		log.Printf("Unhandled Lob event type: %s\n", event.EventType.Id)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	lobPostcardId := event.ReferenceId
+	if lobPostcardId == "" {
+		var postcard lob.LobPostcard
+		if err := json.Unmarshal(event.Body, &postcard); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing Lob webhook JSON: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lobPostcardId = postcard.Id
+	}
+	occurredAt := event.DateCreated
+	if occurredAt.IsZero() {
+		occurredAt = time.Now()
+	}
+	status := strings.TrimPrefix(event.EventType.Id, "postcard.")
+
+	var handle func(tx *sql.Tx) error
+	if event.EventType.Id == lob.EventPostcardReturnedToSender {
+		handle = func(tx *sql.Tx) error {
+			return handlePostcardReturnedTx(tx, lobPostcardId)
+		}
+	}
+
+	// Lob retries deliveries until they succeed, so events are recorded once
+	// by id.
+	alreadyHandled, err := postgresClient.processPostcardEvent(event.Id, lobPostcardId, event.EventType.Id, status, occurredAt, payload, handle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error handling Lob event %s: %v\n", event.Id, err)
+		w.WriteHeader(http.StatusInternalServerError) // Lob will retry
+		return
+	}
+	if alreadyHandled {
+		log.Printf("Lob event %s already handled\n", event.Id)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+func TestLobWebhookRejectsBadSignatures(t *testing.T) {
+	lobWebhookSecret = ""
+	w := httptest.NewRecorder()
+	serveLobWebhook(w, httptest.NewRequest(http.MethodPost, "/lobWebhook", strings.NewReader("{}")))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unconfigured webhook: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	lobWebhookSecret = "secret"
+	t.Cleanup(func() { lobWebhookSecret = "" })
+
+	body := `{"id":"evt_1","reference_id":"psc_1","event_type":{"id":"postcard.in_transit"}}`
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	for name, signature := range map[string]string{
+		"unsigned":     "",
+		"wrong secret": lob.SignWebhook("other secret", timestamp, []byte(body)),
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/lobWebhook", strings.NewReader(body))
+		r.Header.Set(lob.SignatureHeader, signature)
+		r.Header.Set(lob.SignatureTimestampHeader, timestamp)
+		w := httptest.NewRecorder()
+		serveLobWebhook(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// verified events we don't track are acknowledged without touching the database
+	body = `{"id":"evt_2","reference_id":"psc_1","event_type":{"id":"postcard.rendered_pdf"}}`
+	r := httptest.NewRequest(http.MethodPost, "/lobWebhook", strings.NewReader(body))
+	r.Header.Set(lob.SignatureHeader, lob.SignWebhook("secret", timestamp, []byte(body)))
+	r.Header.Set(lob.SignatureTimestampHeader, timestamp)
+	w = httptest.NewRecorder()
+	serveLobWebhook(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("untracked event: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestParsePostcardRef(t *testing.T) {
+	if id, lobId, ok := parsePostcardRef("42"); !ok || id != 42 || lobId != "" {
+		t.Errorf("numeric id parsed as %d %q %v", id, lobId, ok)
+	}
+	if id, lobId, ok := parsePostcardRef("psc_0123"); !ok || id != 0 || lobId != "psc_0123" {
+		t.Errorf("Lob id parsed as %d %q %v", id, lobId, ok)
+	}
+	for _, ref := range []string{"", "0", "-1", "abc", "adr_0123"} {
+		if _, _, ok := parsePostcardRef(ref); ok {
+			t.Errorf("expected %q to be rejected", ref)
+		}
+	}
+}
+
+// postLobEvent delivers a signed Lob tracking event for lobPostcardId.
+func postLobEvent(t *testing.T, eventId, lobPostcardId, eventType string) {
+	t.Helper()
+	body := `{"id":"` + eventId + `","reference_id":"` + lobPostcardId + `","event_type":{"id":"` + eventType + `"}}`
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	r := httptest.NewRequest(http.MethodPost, "/lobWebhook", strings.NewReader(body))
+	r.Header.Set(lob.SignatureHeader, lob.SignWebhook(lobWebhookSecret, timestamp, []byte(body)))
+	r.Header.Set(lob.SignatureTimestampHeader, timestamp)
+	w := httptest.NewRecorder()
+	serveLobWebhook(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got status %d: %s", eventId, w.Code, w.Body.String())
+	}
+}
+
+func TestReturnedPostcardsFlagTheRecipient(t *testing.T) {
+	useTestDatabase(t)
+	lobWebhookSecret = "secret"
+	t.Cleanup(func() { lobWebhookSecret = "" })
+
+	insertTestUser(t, 7, 5)
+	insertTestUser(t, 8, 0)
+	if _, err := db.Exec("UPDATE user_info SET lob_address_id = 'adr_8', accepts_physical_mail = TRUE WHERE recurse_id = 8"); err != nil {
+		t.Fatal(err)
+	}
+
+	// one postcard to user 8 and one to the organization
+	for i, toRecurseId := range []int{8, 0} {
+		lobId := "psc_" + strconv.Itoa(i)
+		creditTransactionId, err := postgresClient.reserveCredits(7, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = postgresClient.commitCredits(creditTransactionId, lobId); err != nil {
+			t.Fatal(err)
+		}
+		if err = postgresClient.insertPostcard(&Postcard{FromRecurseId: 7, ToRecurseId: toRecurseId, Mode: PhysicalSend, Size: lob.Size4x6, LobId: lobId, CreditTransactionId: creditTransactionId, Status: PostcardCreated}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCredits(t, 7, 3)
+
+	postLobEvent(t, "evt_1", "psc_0", lob.EventPostcardReturnedToSender)
+	postLobEvent(t, "evt_2", "psc_1", lob.EventPostcardReturnedToSender)
+	// redelivered
+	postLobEvent(t, "evt_1", "psc_0", lob.EventPostcardReturnedToSender)
+
+	if _, accepts, err := postgresClient.getMailingAddress(8); err != nil || accepts {
+		t.Errorf("recipient of a returned postcard still gets physical mail: %v, %v", accepts, err)
+	}
+	var acceptsPhysicalMail bool
+	if err := db.QueryRow("SELECT accepts_physical_mail FROM user_info WHERE recurse_id = 8").Scan(&acceptsPhysicalMail); err != nil || !acceptsPhysicalMail {
+		t.Errorf("a returned postcard changed the recipient's preference: %v, %v", acceptsPhysicalMail, err)
+	}
+	if _, accepts, err := postgresClient.getMailingAddress(0); err != nil || !accepts {
+		t.Errorf("a postcard returned from the organization stopped its mail: %v, %v", accepts, err)
+	}
+	assertCredits(t, 7, 5)
+
+	for _, test := range []struct {
+		recurseId int
+		kind      string
+		want      int
+	}{
+		{7, NotificationPostcardReturned, 2},
+		{8, NotificationAddressUnverified, 1},
+		{0, NotificationAddressUnverified, 0},
+	} {
+		var got int
+		if err := db.QueryRow("SELECT count(*) FROM notifications WHERE recurse_id = $1 AND kind = $2", test.recurseId, test.kind).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("user %d got %d %s notifications, want %d", test.recurseId, got, test.kind, test.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Kinds of notifications.
+const (
+	NotificationPostcardReturned  = "postcard_returned"
+	NotificationAddressUnverified = "address_unverified"
+	NotificationPostcardFailed    = "postcard_failed"
+	NotificationLetterFailed      = "letter_failed"
+)
+
+const maxNotifications = 50
+
+type Notification struct {
+	Id         int64      `json:"id"`
+	Kind       string     `json:"kind"`
+	Message    string     `json:"message"`
+	PostcardId int64      `json:"postcardId,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ReadAt     *time.Time `json:"readAt"`
+}
+
+func serveNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getNotifications(w, r)
+	} else if r.Method == http.MethodPost {
+		readNotifications(w, r)
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+}
+
+type GetNotificationsResponse struct {
+	Notifications []*Notification `json:"notifications"`
+}
+
+// getNotifications lists the caller's recent notifications, or only unread
+// ones with ?unread=true.
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/notifications") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	unreadOnly, _ := strconv.ParseBool(r.URL.Query().Get("unread"))
+
+	notifications, err := postgresClient.getNotifications(user.Id, unreadOnly, maxNotifications)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error getting notifications", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := JSONMarshal(GetNotificationsResponse{Notifications: notifications})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+// readNotifications marks the notification with the given id as read, or
+// every notification if no id is given.
+func readNotifications(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/notifications") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return
+	}
+
+	var id int64
+	if r.FormValue("id") != "" {
+		var err error
+		if id, err = strconv.ParseInt(r.FormValue("id"), 10, 64); err != nil || id <= 0 {
+			http.Error(w, "Malformed id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := postgresClient.markNotificationsRead(user.Id, id); err == errNotFound {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error updating notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
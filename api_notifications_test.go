@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadNotificationsRejectsMalformedId(t *testing.T) {
+	user := &User{Id: 7, Name: "Ada"}
+	for _, id := range []string{"abc", "0", "-3"} {
+		r := httptest.NewRequest(http.MethodPost, "/notifications", strings.NewReader("id="+id))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveNotifications(w, withUser(r, user))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("id %q: got status %d, want %d", id, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -2,11 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	lob "github.com/rc-postcard/rc-postcard/lob"
 )
@@ -19,6 +30,116 @@ const (
 
 var validSendPostcardModes = []string{DigitalPreview, DigitalSend, PhysicalSend}
 
+// postcardCredits is what a physical postcard of each size costs.
+var postcardCredits = map[string]int{
+	lob.Size4x6:  1,
+	lob.Size6x9:  2,
+	lob.Size6x11: 3,
+}
+
+// internationalPostcardCredits is what a physical postcard of each size costs
+// to a recipient outside the US, which takes international postage.
+var internationalPostcardCredits = map[string]int{
+	lob.Size4x6:  2,
+	lob.Size6x9:  3,
+	lob.Size6x11: 4,
+}
+
+// isInternationalAddress reports whether a recipient is outside the US,
+// looking addresses given by id up at Lob.
+func isInternationalAddress(address lob.LobAddress) (bool, error) {
+	if address.AddressId == "" {
+		return lob.IsInternational(address.AddressCountry), nil
+	}
+	lobAddressResponse, err := lobClient.GetAddress(address.AddressId, true)
+	if err != nil {
+		return false, err
+	}
+	return lob.IsInternational(lobAddressResponse.AddressCountry), nil
+}
+
+// aspectTolerance is how far a front image's aspect ratio may be from the
+// size's before it would be visibly stretched.
+const aspectTolerance = 0.02
+
+// validateFrontImage checks that a front image is a JPEG, PNG or GIF with the
+// shape of the postcard size and, if it is to be printed, enough pixels to
+// print sharply.
+func validateFrontImage(frontImage []byte, size, mode string) error {
+	spec := lob.PostcardSpecs[size]
+	config, _, err := image.DecodeConfig(bytes.NewReader(frontImage))
+	if err != nil {
+		return errors.New("front image must be a JPEG, PNG or GIF")
+	}
+	if mode == PhysicalSend && (config.Width < spec.WidthPx || config.Height < spec.HeightPx) {
+		return fmt.Errorf("front image of a %s postcard must be at least %dx%d pixels, got %dx%d", size, spec.WidthPx, spec.HeightPx, config.Width, config.Height)
+	}
+	got := float64(config.Width) / float64(config.Height)
+	want := float64(spec.WidthPx) / float64(spec.HeightPx)
+	if math.Abs(got-want)/want > aspectTolerance {
+		return fmt.Errorf("front image of a %s postcard must have the aspect ratio of %dx%d pixels, got %dx%d", size, spec.WidthPx, spec.HeightPx, config.Width, config.Height)
+	}
+	return nil
+}
+
+// Statuses of postcards in the postcards table. Postcards are pending while
+// being sent to Lob. Physical postcards are then created, or scheduled if they
+// have a send date, and are moved along by Lob tracking events.
+const (
+	PostcardPending              string = "pending"
+	PostcardScheduled            string = "scheduled"
+	PostcardCancelling           string = "cancelling"
+	PostcardCancelled            string = "cancelled"
+	PostcardFailed               string = "failed"
+	PostcardCreated              string = "created"
+	PostcardInTransit            string = "in_transit"
+	PostcardInLocalArea          string = "in_local_area"
+	PostcardProcessedForDelivery string = "processed_for_delivery"
+	PostcardReRouted             string = "re-routed"
+	PostcardReturnedToSender     string = "returned_to_sender"
+	PostcardDelivered            string = "delivered"
+)
+
+// PostcardEvent is a tracking event Lob reported for a physical postcard.
+type PostcardEvent struct {
+	Id         int64     `json:"id"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurredAt"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Postcard is our own record of a postcard sent through Lob.
+type Postcard struct {
+	Id                   int64      `json:"id"`
+	FromRecurseId        int        `json:"fromRecurseId"`
+	ToRecurseId          int        `json:"toRecurseId"`
+	ToContactId          int64      `json:"toContactId,omitempty"`
+	Mode                 string     `json:"mode"`
+	Size                 string     `json:"size"`
+	LobId                string     `json:"lobId"`
+	BackMessage          string     `json:"backMessage"`
+	FrontImageRef        string     `json:"frontImageRef"`
+	CreditTransactionId  int64      `json:"-"`
+	CreatedAt            time.Time  `json:"createdAt"`
+	ExpectedDeliveryDate *time.Time `json:"expectedDeliveryDate"`
+	SendAt               *time.Time `json:"sendAt,omitempty"`
+	Status               string     `json:"status"`
+}
+
+// lobIdempotencyKey identifies the request creating p at Lob, so that sending
+// it again can't mail it twice. Its creation time keeps the keys of databases
+// sharing a Lob account apart.
+func (p *Postcard) lobIdempotencyKey() string {
+	return fmt.Sprintf("postcard-%d-%d", p.Id, p.CreatedAt.UnixMicro())
+}
+
+// frontImageRef identifies an uploaded front image by its digest, so
+// duplicate uploads can be spotted without keeping the image itself.
+func frontImageRef(frontImage []byte) string {
+	sum := sha256.Sum256(frontImage)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 func servePostcards(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		sendPostcards(w, r)
@@ -30,11 +151,209 @@ func servePostcards(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// servePostcardRoutes serves the routes under '/postcards/'.
+func servePostcardRoutes(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/postcards/sent":
+		getSentPostcards(w, r)
+	case r.URL.Path == "/postcards/scheduled":
+		getScheduledPostcards(w, r)
+	case strings.HasSuffix(r.URL.Path, "/events"):
+		getPostcardEvents(w, r)
+	case r.Method == http.MethodDelete:
+		cancelPostcard(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// parsePostcardRef reads a postcard reference from a path segment: either
+// our numeric id or a Lob "psc_" id.
+func parsePostcardRef(ref string) (id int64, lobId string, ok bool) {
+	if strings.HasPrefix(ref, "psc_") {
+		return 0, ref, true
+	}
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, "", false
+	}
+	return id, "", true
+}
+
+type GetPostcardEventsResponse struct {
+	PostcardId int64            `json:"postcardId"`
+	LobId      string           `json:"lobId"`
+	Status     string           `json:"status"`
+	Events     []*PostcardEvent `json:"events"`
+}
+
+// getPostcardEvents serves GET /postcards/{id}/events, the tracking timeline
+// of a postcard the caller sent or received.
+func getPostcardEvents(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/postcards/"), "/events")
+	if !verifyRoute(w, r, http.MethodGet, "/postcards/"+ref+"/events") {
+		return
+	}
+
+	if !requireScope(w, r, ScopePostcardsRead) {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	id, lobId, ok := parsePostcardRef(ref)
+	if !ok {
+		http.Error(w, "Postcard not found", http.StatusNotFound)
+		return
+	}
+
+	postcard, err := postgresClient.getPostcard(id, lobId)
+	if err == errNotFound || (err == nil && postcard.FromRecurseId != user.Id && postcard.ToRecurseId != user.Id) {
+		// don't reveal other people's postcards exist
+		http.Error(w, "Postcard not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error getting postcard", http.StatusInternalServerError)
+		return
+	}
+
+	events := []*PostcardEvent{}
+	if postcard.LobId != "" {
+		if events, err = postgresClient.getPostcardEvents(postcard.LobId); err != nil {
+			log.Println(err)
+			http.Error(w, "Error getting postcard events", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp, err := JSONMarshal(GetPostcardEventsResponse{
+		PostcardId: postcard.Id,
+		LobId:      postcard.LobId,
+		Status:     postcard.Status,
+		Events:     events,
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// parsePageParams reads the limit and cursor query parameters shared by
+// paginated endpoints. Cursors of local listings are postcard ids.
+func parsePageParams(r *http.Request) (limit int, beforeId int64, err error) {
+	query := r.URL.Query()
+	limit = defaultPageSize
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	if query.Get("cursor") != "" {
+		beforeId, err = strconv.ParseInt(query.Get("cursor"), 10, 64)
+		if err != nil {
+			return 0, 0, errors.New("malformed cursor")
+		}
+	}
+	return limit, beforeId, nil
+}
+
+type SentPostcard struct {
+	Postcard
+	RecipientName string `json:"recipientName"`
+}
+
+type GetSentPostcardsResponse struct {
+	Postcards  []*SentPostcard `json:"postcards"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+// getSentPostcards lists the caller's outgoing postcards, newest first.
+func getSentPostcards(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/postcards/sent") {
+		return
+	}
+	if !requireScope(w, r, ScopePostcardsRead) {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	limit, beforeId, err := parsePageParams(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// fetch one extra to know whether there is another page
+	postcards, err := postgresClient.getSentPostcards(user.Id, beforeId, limit+1)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	getSentPostcardsResponse := GetSentPostcardsResponse{Postcards: postcards}
+	if len(postcards) > limit {
+		getSentPostcardsResponse.Postcards = postcards[:limit]
+		getSentPostcardsResponse.NextCursor = strconv.FormatInt(postcards[limit-1].Id, 10)
+	}
+
+	resp, err := JSONMarshal(getSentPostcardsResponse)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+// parseListDate reads a since or until query parameter, either a full
+// RFC 3339 timestamp or a YYYY-MM-DD date.
+func parseListDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+type GetPostcardsResponse struct {
+	Data []lob.LobPostcard `json:"data"`
+	// NextCursor fetches the next (older) page when passed back as cursor.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// getPostcards lists postcards sent to the caller, newest first, straight
+// from Lob.
 func getPostcards(w http.ResponseWriter, r *http.Request) {
 	if !verifyRoute(w, r, http.MethodGet, "/postcards") {
 		return
 	}
 
+	if !requireScope(w, r, ScopePostcardsRead) {
+		return
+	}
+
 	query := r.URL.Query()
 	mode := query.Get("mode")
 
@@ -42,9 +361,37 @@ func getPostcards(w http.ResponseWriter, r *http.Request) {
 
 	var user *User = r.Context().Value(userContextKey).(*User)
 
-	postcards, err := lobClient.GetPostcards(user.Id, isLive)
+	limit := defaultPageSize
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > lob.MaxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", lob.MaxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
 
-	if err != nil {
+	since, errSince := parseListDate(query.Get("since"))
+	until, errUntil := parseListDate(query.Get("until"))
+	if errSince != nil || errUntil != nil {
+		log.Printf("Malformed since or until %v %v\n", errSince, errUntil)
+		http.Error(w, "since and until must be RFC 3339 timestamps or YYYY-MM-DD dates", http.StatusBadRequest)
+		return
+	}
+
+	postcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{
+		Limit:             limit,
+		After:             query.Get("cursor"),
+		DateCreatedAfter:  since,
+		DateCreatedBefore: until,
+		Metadata:          map[string]string{"to_rc_id": strconv.Itoa(user.Id)},
+	}, isLive)
+
+	if lobError, ok := err.(*lob.LobError); ok && lobError.StatusCode == http.StatusUnprocessableEntity {
+		log.Println(err)
+		http.Error(w, lobError.Message, http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -57,10 +404,11 @@ func getPostcards(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	resp, err := JSONMarshal(postcards)
+	resp, err := JSONMarshal(GetPostcardsResponse{Data: postcards.Data, NextCursor: postcards.NextCursor()})
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -69,9 +417,49 @@ func getPostcards(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// defaultPostcardCancelWindow is how long after sending a physical postcard
+// it can still be cancelled, unless POSTCARD_CANCEL_WINDOW says otherwise.
+const defaultPostcardCancelWindow = 10 * time.Minute
+
+var postcardCancelWindow = defaultPostcardCancelWindow
+
+// lobCreateAttempts is how many times sending a postcard or letter is tried
+// while Lob doesn't answer, lobRetryDelay apart.
+const lobCreateAttempts = 3
+
+var lobRetryDelay = time.Second
+
+// Limits on how far ahead a physical postcard can be scheduled. Postcards
+// due within lobScheduleHorizon are held by Lob, later ones by us until then.
+const (
+	maxScheduleHorizon = 365 * 24 * time.Hour
+	lobScheduleHorizon = lob.MaxSendDateHorizon - 24*time.Hour
+)
+
+// parseSendAt reads the optional sendAt form value of a physical send. The
+// zero time means send now.
+func parseSendAt(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	sendAt, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("sendAt must be an RFC 3339 timestamp")
+	}
+	if !sendAt.After(now) {
+		return time.Time{}, errors.New("sendAt must be in the future")
+	}
+	if sendAt.Sub(now) > maxScheduleHorizon {
+		return time.Time{}, errors.New("sendAt must be within a year")
+	}
+	return sendAt, nil
+}
+
 type CreatePostcardResponse struct {
-	Url     string `json:"url"`
-	Credits int    `json:"credits"`
+	Url        string     `json:"url"`
+	Credits    int        `json:"credits"`
+	PostcardId int64      `json:"postcardId,omitempty"`
+	SendAt     *time.Time `json:"sendAt,omitempty"`
 }
 
 func sendPostcards(w http.ResponseWriter, r *http.Request) {
@@ -84,11 +472,38 @@ func sendPostcards(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	mode := query.Get("mode")
 	toRecurseId, errToRecurseId := strconv.Atoi(query.Get("toRecurseId"))
+
+	// an address book contact can be given instead of a Recurser
+	var toContactId int64
+	if query.Get("toContactId") != "" && query.Get("toRecurseId") == "" {
+		toContactId, errToRecurseId = strconv.ParseInt(query.Get("toContactId"), 10, 64)
+	}
 	if (!contains(validSendPostcardModes, mode)) || errToRecurseId != nil {
 		log.Printf("Missing or malformed query parameter %s %v\n", mode, errToRecurseId)
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	if toContactId != 0 && mode == DigitalSend {
+		http.Error(w, "Only physical postcards can be sent to address book contacts", http.StatusBadRequest)
+		return
+	}
+
+	size := lob.Size4x6
+	if query.Get("size") != "" {
+		size = query.Get("size")
+	}
+	if _, ok := postcardCredits[size]; !ok {
+		http.Error(w, "size must be one of 4x6, 6x9 or 6x11", http.StatusBadRequest)
+		return
+	}
+
+	scope := ScopePostcardsSendDigital
+	if mode == PhysicalSend {
+		scope = ScopePostcardsSendPhysical
+	}
+	if !requireScope(w, r, scope) {
+		return
+	}
 
 	// Parse our multipart form, 10 << 20 specifies a maximum upload of 10 MB files.
 	r.ParseMultipartForm(10 << 20)
@@ -109,55 +524,54 @@ func sendPostcards(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	back := r.FormValue("back")
-
-	var backTpl bytes.Buffer
-	if err = backOfPostcard.Execute(&backTpl, struct{ Message string }{Message: back}); err != nil {
+	if err = validateFrontImage(fileBytes, size, mode); err != nil {
 		log.Println(err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if mode == PhysicalSend {
-		// verify credits
-		numCredits, err := postgresClient.getCredits(user.Id)
-		if err != nil {
-			log.Printf("Error getting user credits: %v\n", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
+	back := r.FormValue("back")
 
-		if numCredits <= 0 {
-			log.Printf("Credits less than or equal 0 or there was an error: %v\n", err)
-			http.Error(w, "Credits error", http.StatusPaymentRequired)
-			return
-		}
+	sendAt, err := parseSendAt(r.FormValue("sendAt"), time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	fromAddress := lob.LobAddress{
-		Name:         user.Name,
-		AddressLine1: lob.RecurseAddressLine1,
-		AddressLine2: lob.RecurseAddressLine2,
-		AddressCity:  lob.RecurseAddressCity,
-		AddressState: lob.RecurseAddressState,
-		AddressZip:   lob.RecurseAddressZip,
+	if !sendAt.IsZero() && mode != PhysicalSend {
+		http.Error(w, "Only physical postcards can be scheduled", http.StatusBadRequest)
+		return
 	}
 
-	// by default we're sending to recurse center
-	toAddress := lob.LobAddress{
-		Name:         lob.RecurseCenterName,
-		AddressLine1: lob.RecurseAddressLine1,
-		AddressLine2: lob.RecurseAddressLine2,
-		AddressCity:  lob.RecurseAddressCity,
-		AddressState: lob.RecurseAddressState,
-		AddressZip:   lob.RecurseAddressZip,
+	var backTpl bytes.Buffer
+	if err = backOfPostcard[size].Execute(&backTpl, backOfPostcardData{Message: back, Branding: org.Branding}); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
+	// digital postcards show the organization's address as the return address
+	fromAddress := org.address(user.Name)
+
+	// by default we're sending to the organization
+	toAddress := org.address(org.Name)
+
 	var useProductionKey bool = false
 	if mode == PhysicalSend {
-		if toRecurseId != 0 {
+		if toContactId != 0 {
+			contact, err := postgresClient.getAddressBookContact(user.Id, toContactId)
+			if err == errNotFound {
+				http.Error(w, "No such contact in your address book", http.StatusBadRequest)
+				return
+			} else if err != nil {
+				log.Printf("Error getting contact: %v\n", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			toAddress = lob.LobAddress{AddressId: contact.lobAddressId}
+		} else if toRecurseId != 0 {
 			// get sendee info
-			receipientAddressId, recipientAcceptsPhysicalMail, _, _, err := postgresClient.getUserInfo(toRecurseId)
+			receipientAddressId, recipientAcceptsPhysicalMail, err := postgresClient.getMailingAddress(toRecurseId)
 			if err != nil {
 				log.Printf("Error getting recurse address: %v\n", err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -172,6 +586,13 @@ func sendPostcards(w http.ResponseWriter, r *http.Request) {
 			toAddress = lob.LobAddress{AddressId: receipientAddressId}
 		}
 
+		fromAddress, err = senderReturnAddress(user.Id, user.Name)
+		if err != nil {
+			log.Printf("Error getting return address: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		useProductionKey = true
 	} else if mode == DigitalSend {
 		// get sendee info
@@ -182,13 +603,90 @@ func sendPostcards(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// override recurse center name with userName
+		// override the organization's name with userName
 		toAddress.Name = userName
 	}
 
-	lobCreatePostcardResponse, lobError := lobClient.CreatePostCard(fromAddress, toAddress, fileBytes, backTpl.String(), useProductionKey, user.Id, toRecurseId, mode)
-	if lobError != nil && (lobError.Err != nil || lobError.StatusCode/100 >= 5) {
-		log.Println(err)
+	// reserve the credit up front so concurrent sends can't overdraw it
+	var creditTransactionId int64
+	if mode == PhysicalSend {
+		cost := postcardCredits[size]
+		if international, err := isInternationalAddress(toAddress); err != nil {
+			log.Printf("Error getting recipient address: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		} else if international {
+			cost = internationalPostcardCredits[size]
+		}
+		creditTransactionId, err = postgresClient.reserveCredits(user.Id, cost)
+		if err == errInsufficientCredits {
+			log.Printf("Not enough credits for %d\n", user.Id)
+			http.Error(w, "Credits error", http.StatusPaymentRequired)
+			return
+		} else if err != nil {
+			log.Printf("Error reserving user credits: %v\n", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !sendAt.IsZero() && sendAt.Sub(time.Now()) > lobScheduleHorizon {
+		// too far out for Lob to hold, so the scheduler sends it when it's due
+		schedulePostcard(w, user, toRecurseId, toContactId, size, fileBytes, back, backTpl.String(), sendAt, creditTransactionId)
+		return
+	}
+
+	lobSendDate := sendAt
+	if mode == PhysicalSend && sendAt.IsZero() && postcardCancelWindow > 0 {
+		// Lob holds postcards until their send date, so this is how long
+		// the sender has to change their mind
+		lobSendDate = time.Now().Add(postcardCancelWindow)
+	}
+
+	// record the postcard before Lob mails it, so it can't go untracked
+	var postcard *Postcard
+	idempotencyKey := ""
+	if mode == DigitalSend || mode == PhysicalSend {
+		postcard = &Postcard{
+			FromRecurseId:       user.Id,
+			ToRecurseId:         toRecurseId,
+			ToContactId:         toContactId,
+			Mode:                mode,
+			Size:                size,
+			BackMessage:         back,
+			FrontImageRef:       frontImageRef(fileBytes),
+			CreditTransactionId: creditTransactionId,
+			Status:              PostcardPending,
+		}
+		if err = postgresClient.insertPostcard(postcard); err != nil {
+			log.Printf("Error recording postcard: %v\n", err)
+			if creditTransactionId != 0 {
+				if err := postgresClient.refundCredits(creditTransactionId); err != nil {
+					log.Printf("Error refunding credit transaction %d: %v\n", creditTransactionId, err)
+				}
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		idempotencyKey = postcard.lobIdempotencyKey()
+	}
+
+	lobCreatePostcardResponse, lobError := lobClient.CreatePostCard(fromAddress, toAddress, fileBytes, backTpl.String(), useProductionKey, user.Id, toRecurseId, mode, size, lobSendDate, idempotencyKey)
+	// the idempotency key makes it safe to ask again when Lob didn't answer
+	for attempt := 1; lobError != nil && lobError.Transient() && idempotencyKey != "" && attempt < lobCreateAttempts; attempt++ {
+		log.Printf("Retrying postcard %d: %v\n", postcard.Id, lobError)
+		time.Sleep(lobRetryDelay)
+		lobCreatePostcardResponse, lobError = lobClient.CreatePostCard(fromAddress, toAddress, fileBytes, backTpl.String(), useProductionKey, user.Id, toRecurseId, mode, size, lobSendDate, idempotencyKey)
+	}
+	if lobError != nil && !lobError.Transient() && postcard != nil {
+		if err := postgresClient.failPostcard(postcard.Id, creditTransactionId); err != nil {
+			log.Printf("Error failing postcard %d: %v\n", postcard.Id, err)
+		}
+	}
+	if lobError != nil && lobError.Transient() {
+		// Lob may have the postcard anyway, so it stays pending with its
+		// credit reserved until reconcilePendingPostcards finds out
+		log.Println(lobError)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	} else if lobError != nil && (lobError.StatusCode/100 == 3 || lobError.StatusCode/100 == 4) {
@@ -206,18 +704,35 @@ func sendPostcards(w http.ResponseWriter, r *http.Request) {
 
 	createPostcardResponse := &CreatePostcardResponse{Credits: 0}
 
+	if postcard != nil {
+		postcard.LobId = lobCreatePostcardResponse.Id
+		postcard.Status = PostcardCreated
+		if mode == DigitalSend {
+			// digital postcards show up in the recipient's inbox right away
+			postcard.Status = PostcardDelivered
+		} else if !sendAt.IsZero() {
+			postcard.Status = PostcardScheduled
+		}
+		if mode == PhysicalSend && !lobSendDate.IsZero() {
+			postcard.SendAt = &lobCreatePostcardResponse.SendDate
+		}
+		if expectedDeliveryDate, err := time.Parse("2006-01-02", lobCreatePostcardResponse.ExpectedDeliveryDate); err == nil {
+			postcard.ExpectedDeliveryDate = &expectedDeliveryDate
+		}
+		// Lob has accepted the postcard, so carry on even if this fails;
+		// the postcard stays pending with its credit reserved.
+		if err := postgresClient.completePostcard(postcard); err != nil {
+			log.Printf("Error recording postcard %d as Lob postcard %s: %v\n", postcard.Id, lobCreatePostcardResponse.Id, err)
+		}
+		createPostcardResponse.PostcardId = postcard.Id
+		createPostcardResponse.SendAt = postcard.SendAt
+	}
+
 	if mode == DigitalPreview {
 		createPostcardResponse.Url = lobCreatePostcardResponse.Url
 	}
 
 	if mode == PhysicalSend {
-		err = postgresClient.decrementCredits(user.Id)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-
 		numCredits, err := postgresClient.getCredits(user.Id)
 		if err != nil {
 			log.Printf("Error getting user credits: %v\n", err)
@@ -250,6 +765,20 @@ func JSONMarshal(t interface{}) ([]byte, error) {
 	return buffer.Bytes(), err
 }
 
+// writeJSONResponse responds 200 OK with v as JSON.
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	resp, err := JSONMarshal(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
 func contains(arr []string, s string) bool {
 	for _, elem := range arr {
 		if elem == s {
@@ -259,3 +788,187 @@ func contains(arr []string, s string) bool {
 
 	return false
 }
+
+// schedulePostcard holds a physical postcard, whose credit is already
+// reserved, for the scheduler to send at sendAt.
+func schedulePostcard(w http.ResponseWriter, user *User, toRecurseId int, toContactId int64, size string, frontImage []byte, back, backHtml string, sendAt time.Time, creditTransactionId int64) {
+	postcard := &Postcard{
+		FromRecurseId:       user.Id,
+		ToRecurseId:         toRecurseId,
+		ToContactId:         toContactId,
+		Mode:                PhysicalSend,
+		Size:                size,
+		BackMessage:         back,
+		FrontImageRef:       frontImageRef(frontImage),
+		CreditTransactionId: creditTransactionId,
+		SendAt:              &sendAt,
+		Status:              PostcardScheduled,
+	}
+	if err := postgresClient.insertScheduledPostcard(postcard, frontImage, backHtml); err != nil {
+		log.Printf("Error scheduling postcard: %v\n", err)
+		if err := postgresClient.refundCredits(creditTransactionId); err != nil {
+			log.Printf("Error refunding credit transaction %d: %v\n", creditTransactionId, err)
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	numCredits, err := postgresClient.getCredits(user.Id)
+	if err != nil {
+		log.Printf("Error getting user credits: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := JSONMarshal(CreatePostcardResponse{Credits: numCredits, PostcardId: postcard.Id, SendAt: postcard.SendAt})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+type GetScheduledPostcardsResponse struct {
+	Postcards []*SentPostcard `json:"postcards"`
+}
+
+// getScheduledPostcards lists the caller's postcards that are waiting for
+// their send date, soonest first.
+func getScheduledPostcards(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/postcards/scheduled") {
+		return
+	}
+
+	if !requireScope(w, r, ScopePostcardsRead) {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	postcards, err := postgresClient.getScheduledPostcards(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error getting scheduled postcards", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := JSONMarshal(GetScheduledPostcardsResponse{Postcards: postcards})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+type CancelPostcardResponse struct {
+	Credits int `json:"credits"`
+}
+
+// cancelAtLob asks Lob to cancel a postcard marked as being cancelled, and
+// records the outcome. A postcard Lob won't cancel goes back to the status it
+// had, and errNotCancellable is returned. If Lob doesn't answer it stays
+// cancelling, for reconcileCancellingPostcards to try again.
+func cancelAtLob(postcard *Postcard) error {
+	err := lobClient.CancelPostcard(postcard.LobId, true)
+	lobError, ok := err.(*lob.LobError)
+	if err == nil || (ok && lobError.StatusCode == http.StatusNotFound) {
+		// Lob doesn't find postcards it has already cancelled
+		return postgresClient.cancelLobPostcard(postcard.Id, postcard.CreditTransactionId)
+	} else if ok && lobError.StatusCode/100 == 4 {
+		log.Printf("Lob refused to cancel postcard %s: %v\n", postcard.LobId, lobError)
+		if err = postgresClient.stopCancellingPostcard(postcard.Id); err != nil {
+			return err
+		}
+		return errNotCancellable
+	}
+	return err
+}
+
+// cancelPostcard serves DELETE /postcards/{id}, which cancels a physical
+// postcard the caller sent and refunds its credit. Postcards we are holding
+// for a later send date can always be cancelled; ones already with Lob only
+// until their send date, which is at least the grace window after sending.
+func cancelPostcard(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/postcards/")
+	if !verifyRoute(w, r, http.MethodDelete, "/postcards/"+ref) {
+		return
+	}
+
+	if !requireScope(w, r, ScopePostcardsSendPhysical) {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	id, lobId, ok := parsePostcardRef(ref)
+	if !ok {
+		http.Error(w, "Postcard not found", http.StatusNotFound)
+		return
+	}
+
+	postcard, err := postgresClient.getPostcard(id, lobId)
+	if err == errNotFound || (err == nil && postcard.FromRecurseId != user.Id) {
+		http.Error(w, "Postcard not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error getting postcard", http.StatusInternalServerError)
+		return
+	}
+
+	if postcard.Mode != PhysicalSend || postcard.Status == PostcardCancelled || postcard.Status == PostcardFailed {
+		http.Error(w, "Postcard can't be cancelled", http.StatusConflict)
+		return
+	}
+
+	if postcard.LobId == "" {
+		err = postgresClient.cancelScheduledPostcard(user.Id, postcard.Id)
+	} else if postcard.SendAt == nil || !time.Now().Before(*postcard.SendAt) {
+		err = errNotCancellable
+	} else if err = postgresClient.startCancellingPostcard(postcard.Id, postcard.Status); err == nil {
+		err = cancelAtLob(postcard)
+	}
+	if err == errCancellationSettled {
+		// the reconciler or a Lob event got to it first
+		if postcard, err = postgresClient.getPostcard(postcard.Id, ""); err == nil && postcard.Status != PostcardCancelled {
+			err = errNotCancellable
+		}
+	}
+
+	if err == errNotCancellable {
+		http.Error(w, "Postcard has already been mailed and can't be cancelled", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error cancelling postcard", http.StatusInternalServerError)
+		return
+	}
+
+	numCredits, err := postgresClient.getCredits(user.Id)
+	if err != nil {
+		log.Printf("Error getting user credits: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := JSONMarshal(CancelPostcardResponse{Credits: numCredits})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
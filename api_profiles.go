@@ -24,7 +24,23 @@ func deleteProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	savedAddresses, err := postgresClient.getSavedAddresses(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	lobAddressIds := []string{}
 	if lobAddressId != "" {
+		lobAddressIds = append(lobAddressIds, lobAddressId)
+	}
+	for _, savedAddress := range savedAddresses {
+		if !contains(lobAddressIds, savedAddress.lobAddressId) {
+			lobAddressIds = append(lobAddressIds, savedAddress.lobAddressId)
+		}
+	}
+
+	for _, lobAddressId := range lobAddressIds {
 		if err := lobClient.DeleteAddress(lobAddressId, true); err != nil {
 			log.Println(err)
 			http.Error(w, "Error deleting address", http.StatusInternalServerError)
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// Return address preferences. Physical mail is returned to the
+// organization's address unless the sender prefers their default address or
+// another of their saved addresses.
+const (
+	ReturnAddressOrganization = "rc"
+	ReturnAddressSaved        = "saved"
+	ReturnAddressAlternate    = "alternate"
+)
+
+var validReturnAddresses = []string{ReturnAddressOrganization, ReturnAddressSaved, ReturnAddressAlternate}
+
+// senderReturnAddress is the from address of physical mail sent by recurseId:
+// their preferred Lob address, or the organization's address if they prefer
+// it, the address is gone, or it is outside the US, which Lob doesn't mail
+// from. Only Lob sees the address; it is never shown to recipients.
+func senderReturnAddress(recurseId int, name string) (lob.LobAddress, error) {
+	_, _, lobAddressId, err := postgresClient.getReturnAddress(recurseId)
+	if err != nil && err != errNotFound {
+		return lob.LobAddress{}, err
+	}
+	if lobAddressId == "" {
+		return org.address(name), nil
+	}
+
+	lobAddressResponse, err := lobClient.GetAddress(lobAddressId, true)
+	if err != nil {
+		return lob.LobAddress{}, err
+	}
+	if lob.IsInternational(lobAddressResponse.AddressCountry) {
+		return org.address(name), nil
+	}
+	return lob.LobAddress{AddressId: lobAddressId}, nil
+}
+
+type ReturnAddressResponse struct {
+	ReturnAddress string `json:"returnAddress"`
+	Label         string `json:"label,omitempty"`
+}
+
+// serveReturnAddress serves the '/addresses/return' route.
+func serveReturnAddress(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		getReturnAddress(w, r)
+	} else if r.Method == http.MethodPost {
+		setReturnAddress(w, r)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+func getReturnAddress(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/addresses/return") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	returnAddress, label, _, err := postgresClient.getReturnAddress(user.Id)
+	if err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, ReturnAddressResponse{ReturnAddress: returnAddress, Label: label})
+}
+
+// setReturnAddress takes the returnAddress form value, one of
+// validReturnAddresses, and the label of the saved address for
+// ReturnAddressAlternate.
+func setReturnAddress(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/addresses/return") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return
+	}
+
+	returnAddress := r.FormValue("returnAddress")
+	if !contains(validReturnAddresses, returnAddress) {
+		http.Error(w, "returnAddress must be one of rc, saved or alternate", http.StatusBadRequest)
+		return
+	}
+	label := strings.ToLower(strings.TrimSpace(r.FormValue("label")))
+	if returnAddress == ReturnAddressAlternate && label == "" {
+		http.Error(w, "label is required for an alternate return address", http.StatusBadRequest)
+		return
+	}
+
+	err := postgresClient.setReturnAddress(user.Id, returnAddress, label)
+	if err == errNotFound {
+		http.Error(w, "No saved address with that label", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if returnAddress != ReturnAddressAlternate {
+		label = ""
+	}
+	writeJSONResponse(w, ReturnAddressResponse{ReturnAddress: returnAddress, Label: label})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAddressLabel is the label of an address saved without one.
+const defaultAddressLabel = "home"
+
+// validAddressLabel matches labels like "home", "office" or "summer-2023".
+var validAddressLabel = regexp.MustCompile(`^[a-z0-9][a-z0-9 _-]{0,39}$`)
+
+// SavedAddress is one of a user's labeled addresses. The address itself is
+// kept at Lob.
+type SavedAddress struct {
+	Label          string     `json:"label"`
+	IsDefault      bool       `json:"isDefault"`
+	EffectiveFrom  *time.Time `json:"effectiveFrom,omitempty"`
+	Name           string     `json:"name"`
+	AddressLine1   string     `json:"address_line1"`
+	AddressLine2   string     `json:"address_line2"`
+	AddressCity    string     `json:"address_city"`
+	AddressState   string     `json:"address_state"`
+	AddressZip     string     `json:"address_zip"`
+	AddressCountry string     `json:"address_country"`
+
+	lobAddressId string
+}
+
+// parseSaveAddressForm reads the optional label, default and effectiveFrom
+// form values of a saved address. effectiveFrom schedules the address to
+// become the default then, e.g. for a move after batch.
+func parseSaveAddressForm(r *http.Request, now time.Time) (label string, makeDefault bool, effectiveFrom time.Time, err error) {
+	label = strings.ToLower(strings.TrimSpace(r.FormValue("label")))
+	if label == "" {
+		label = defaultAddressLabel
+	}
+	if !validAddressLabel.MatchString(label) {
+		return "", false, time.Time{}, errors.New("label must be up to 40 letters, digits, spaces, dashes or underscores")
+	}
+
+	if r.FormValue("default") != "" {
+		if makeDefault, err = strconv.ParseBool(r.FormValue("default")); err != nil {
+			return "", false, time.Time{}, errors.New("default must be true or false")
+		}
+	}
+
+	if r.FormValue("effectiveFrom") != "" {
+		if effectiveFrom, err = time.Parse(time.RFC3339, r.FormValue("effectiveFrom")); err != nil {
+			return "", false, time.Time{}, errors.New("effectiveFrom must be an RFC 3339 timestamp")
+		}
+		if !effectiveFrom.After(now) || effectiveFrom.Sub(now) > maxScheduleHorizon {
+			return "", false, time.Time{}, errors.New("effectiveFrom must be in the future and within a year")
+		}
+		if makeDefault {
+			return "", false, time.Time{}, errors.New("an address can't be made the default both now and at effectiveFrom")
+		}
+	}
+	return label, makeDefault, effectiveFrom, nil
+}
+
+// serveAddressRoutes serves the routes under '/addresses/'.
+func serveAddressRoutes(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/addresses/saved":
+		getSavedAddresses(w, r)
+	case r.URL.Path == "/addresses/autocomplete":
+		autocompleteAddress(w, r)
+	case r.URL.Path == "/addresses/verify":
+		verifyAddress(w, r)
+	case r.URL.Path == "/addresses/default":
+		setDefaultAddress(w, r)
+	case r.URL.Path == "/addresses/return":
+		serveReturnAddress(w, r)
+	case strings.HasPrefix(r.URL.Path, "/addresses/saved/") && r.Method == http.MethodDelete:
+		deleteSavedAddress(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+type GetSavedAddressesResponse struct {
+	Addresses []*SavedAddress `json:"addresses"`
+}
+
+func getSavedAddresses(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/addresses/saved") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	addresses, err := postgresClient.getSavedAddresses(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, address := range addresses {
+		lobAddressResponse, err := lobClient.GetAddress(address.lobAddressId, true)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		address.Name = lobAddressResponse.Name
+		address.AddressLine1 = lobAddressResponse.AddressLine1
+		address.AddressLine2 = lobAddressResponse.AddressLine2
+		address.AddressCity = lobAddressResponse.AddressCity
+		address.AddressState = lobAddressResponse.AddressState
+		address.AddressZip = lobAddressResponse.AddressZip
+		address.AddressCountry = lobAddressResponse.AddressCountry
+	}
+
+	writeJSONResponse(w, GetSavedAddressesResponse{Addresses: addresses})
+}
+
+// setDefaultAddress serves 'POST /addresses/default', which switches mail to
+// the labeled address now or at effectiveFrom.
+func setDefaultAddress(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/addresses/default") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("label") == "" {
+		http.Error(w, "label is required", http.StatusBadRequest)
+		return
+	}
+	label, _, effectiveFrom, err := parseSaveAddressForm(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = postgresClient.setDefaultAddress(user.Id, label, effectiveFrom)
+	if err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, new(struct{}))
+}
+
+func deleteSavedAddress(w http.ResponseWriter, r *http.Request) {
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	label := strings.TrimPrefix(r.URL.Path, "/addresses/saved/")
+	lobAddressId, err := postgresClient.deleteSavedAddress(user.Id, label)
+	if err == errNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err == errDefaultAddress {
+		http.Error(w, "Choose another default address before deleting this one", http.StatusConflict)
+		return
+	} else if err == errReturnAddress {
+		http.Error(w, "Choose another return address before deleting this one", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err = lobClient.DeleteAddress(lobAddressId, true); err != nil {
+		log.Printf("Error deleting Lob address %s: %v\n", lobAddressId, err)
+	}
+
+	writeJSONResponse(w, new(struct{}))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes an app-issued API token can be granted.
+const (
+	ScopePostcardsRead         = "postcards:read"
+	ScopePostcardsSendDigital  = "postcards:send_digital"
+	ScopePostcardsSendPhysical = "postcards:send_physical"
+	ScopeLettersRead           = "letters:read"
+	ScopeLettersSendDigital    = "letters:send_digital"
+	ScopeLettersSendPhysical   = "letters:send_physical"
+)
+
+var validScopes = []string{ScopePostcardsRead, ScopePostcardsSendDigital, ScopePostcardsSendPhysical, ScopeLettersRead, ScopeLettersSendDigital, ScopeLettersSendPhysical}
+
+// apiTokenPaths are the routes app-issued API tokens may be used on. Their
+// handlers check the token's scopes with requireScope; everything else, like
+// addresses and minting more tokens, needs a session or personal access token.
+var apiTokenPaths = []string{"/postcards", "/letters", "/contacts"}
+
+const (
+	apiTokenPrefix = "rcp_"
+
+	defaultApiTokenLifetime = 90 * 24 * time.Hour
+	maxApiTokenLifetime     = 365 * 24 * time.Hour
+)
+
+type ApiToken struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// isApiToken reports whether the request carries an app-issued API token
+// rather than a recurse.com personal access token.
+func isApiToken(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "+apiTokenPrefix)
+}
+
+func apiTokenAllowed(path string) bool {
+	for _, p := range apiTokenPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func generateApiToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(b), nil
+}
+
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes splits a space or comma separated scope list and rejects
+// unknown scopes.
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if !contains(validScopes, scope) {
+			return nil, errors.New("unknown scope " + scope)
+		}
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// authApiToken authenticates a "Bearer rcp_..." Authorization header against
+// the api_tokens table.
+func authApiToken(r *http.Request) (*User, []string, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	user, scopes, err := postgresClient.getApiTokenUser(hashApiToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, scopes, nil
+}
+
+func serveTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		createToken(w, r)
+	} else if r.Method == http.MethodGet {
+		getTokens(w, r)
+	} else if r.Method == http.MethodDelete {
+		revokeToken(w, r)
+	} else {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+}
+
+type CreateTokenResponse struct {
+	ApiToken
+	// Token is only ever shown once, when it is created.
+	Token string `json:"token"`
+}
+
+func createToken(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/tokens") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	if r.Context().Value(authMethodContextKey) != AuthSession {
+		log.Printf("User %d tried to mint a token without a browser session\n", user.Id)
+		http.Error(w, "Tokens can only be created from a logged in session", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		log.Println(err)
+		http.Error(w, "Form error", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := parseScopes(r.FormValue("scopes"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lifetime := defaultApiTokenLifetime
+	if r.FormValue("expiresInDays") != "" {
+		days, err := strconv.Atoi(r.FormValue("expiresInDays"))
+		if err != nil || days < 1 || time.Duration(days)*24*time.Hour > maxApiTokenLifetime {
+			http.Error(w, "Malformed expiresInDays", http.StatusBadRequest)
+			return
+		}
+		lifetime = time.Duration(days) * 24 * time.Hour
+	}
+
+	token, err := generateApiToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	apiToken, err := postgresClient.insertApiToken(user.Id, name, hashApiToken(token), scopes, time.Now().Add(lifetime))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error saving token", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := JSONMarshal(CreateTokenResponse{ApiToken: *apiToken, Token: token})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+type GetTokensResponse struct {
+	Tokens []*ApiToken `json:"tokens"`
+}
+
+func getTokens(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodGet, "/tokens") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	tokens, err := postgresClient.getApiTokens(user.Id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error getting tokens", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := JSONMarshal(GetTokensResponse{Tokens: tokens})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+	return
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodDelete, "/tokens") {
+		return
+	}
+
+	var user *User = r.Context().Value(userContextKey).(*User)
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Missing or malformed id", http.StatusBadRequest)
+		return
+	}
+
+	if err = postgresClient.revokeApiToken(user.Id, id); err == errNotFound {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes("postcards:read, postcards:send_digital postcards:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 || scopes[0] != ScopePostcardsRead || scopes[1] != ScopePostcardsSendDigital {
+		t.Errorf("unexpected scopes %v", scopes)
+	}
+
+	for _, malformed := range []string{"", "postcards:write", "postcards:read admin"} {
+		if _, err := parseScopes(malformed); err == nil {
+			t.Errorf("expected an error parsing %q", malformed)
+		}
+	}
+}
+
+func TestGenerateApiToken(t *testing.T) {
+	a, err := generateApiToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := generateApiToken()
+	if a == b || !strings.HasPrefix(a, apiTokenPrefix) {
+		t.Errorf("unexpected tokens %q %q", a, b)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/postcards", nil)
+	r.Header.Set("Authorization", "Bearer "+a)
+	if !isApiToken(r) {
+		t.Error("expected an rcp_ bearer token to be recognized")
+	}
+	r.Header.Set("Authorization", "Bearer some-recurse-pat")
+	if isApiToken(r) {
+		t.Error("expected a recurse.com PAT not to be treated as an API token")
+	}
+}
+
+func TestApiTokensRejectedOutsideAllowedPaths(t *testing.T) {
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be reached")
+	}))
+
+	for _, path := range []string{"/addresses", "/tokens", "/admin/tokenCache", "/postcardsfoo"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer rcp_0123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/postcards", nil)
+	if !requireScope(httptest.NewRecorder(), r, ScopePostcardsSendPhysical) {
+		t.Error("sessions and personal access tokens should have every scope")
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), scopesContextKey, []string{ScopePostcardsRead}))
+	if !requireScope(httptest.NewRecorder(), r, ScopePostcardsRead) {
+		t.Error("expected granted scope to be allowed")
+	}
+	w := httptest.NewRecorder()
+	if requireScope(w, r, ScopePostcardsSendPhysical) || w.Code != http.StatusForbidden {
+		t.Errorf("expected missing scope to be forbidden, got status %d", w.Code)
+	}
+}
+
+func TestCreateTokenRequiresSession(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader("name=bot&scopes=postcards:read"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = withUser(r, &User{Id: 7})
+	r = r.WithContext(context.WithValue(r.Context(), authMethodContextKey, AuthPat))
+
+	w := httptest.NewRecorder()
+	serveTokens(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
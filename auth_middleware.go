@@ -4,16 +4,46 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 )
 
-const userContextKey = "user"
+const (
+	userContextKey = "user"
+	// authMethodContextKey holds how the request was authenticated, one of
+	// AuthSession, AuthPat or AuthApiToken.
+	authMethodContextKey = "authMethod"
+	// scopesContextKey holds the scopes of an app-issued API token. It is
+	// unset for sessions and personal access tokens, which may do anything.
+	scopesContextKey = "scopes"
+)
+
+const (
+	AuthSession  = "session"
+	AuthPat      = "pat"
+	AuthApiToken = "api_token"
+)
 
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hasValidAuth := false
-		user, err := authPersonalAccessToken(r)
+		authMethod := AuthPat
+		var scopes []string
+		var user *User
+		var err error
+
+		if isApiToken(r) {
+			if !apiTokenAllowed(r.URL.Path) {
+				log.Printf("API tokens are not accepted on %s\n", r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			authMethod = AuthApiToken
+			user, scopes, err = authApiToken(r)
+		} else {
+			user, err = authPersonalAccessToken(r)
+		}
 
 		if err == nil {
 			hasValidAuth = true
@@ -21,12 +51,17 @@ func authMiddleware(next http.Handler) http.Handler {
 			currentSession, err := getSession(r)
 			if err == nil && currentSession.isAuthenticated() {
 				user = &currentSession.User
+				authMethod = AuthSession
 				hasValidAuth = true
 			}
 		}
 
 		if hasValidAuth {
-			ctx := context.WithValue(r.Context(), "user", user)
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			ctx = context.WithValue(ctx, authMethodContextKey, authMethod)
+			if authMethod == AuthApiToken {
+				ctx = context.WithValue(ctx, scopesContextKey, scopes)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		} else {
 			log.Println(err)
@@ -36,9 +71,21 @@ func authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// requireScope reports whether the request may act with scope, and responds
+// with 403 Forbidden if not. Only app-issued API tokens are restricted.
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	scopes, ok := r.Context().Value(scopesContextKey).([]string)
+	if !ok || contains(scopes, scope) {
+		return true
+	}
+	log.Printf("API token is missing scope %s\n", scope)
+	http.Error(w, fmt.Sprintf("API token is missing scope %s", scope), http.StatusForbidden)
+	return false
+}
+
 // authPersonalAccessToken will authenticate an Authorization header by
-// forwarding a request to recurse.com API and cache a successful result
-// in pacCache.
+// forwarding a request to recurse.com API and cache the result in pacCache.
+// Tokens recurse.com rejects are cached too, for a shorter time.
 func authPersonalAccessToken(r *http.Request) (*User, error) {
 	// get token
 	pacToken := r.Header.Get("Authorization")
@@ -46,33 +93,38 @@ func authPersonalAccessToken(r *http.Request) (*User, error) {
 		return nil, errors.New("PAT_NOT_FOUND")
 	}
 	// check cache
-	if u, ok := pacCache[pacToken]; ok {
+	if u, ok := pacCache.get(pacToken); ok {
+		if u == nil {
+			return nil, errors.New("unauthorized")
+		}
 		return u, nil
 	}
-	// send request to recurse.com
-	req, err := http.NewRequest(http.MethodGet, "https://recurse.com/api/v1/profiles/me", nil)
+	// send request to the organization's profile API
+	req, err := http.NewRequest(http.MethodGet, org.ProfileMeUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", pacToken)
 
-	client := http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		pacCache.set(pacToken, nil)
 		return nil, errors.New("unauthorized")
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %d", org.ProfileMeUrl, resp.StatusCode)
 	}
 
 	// read body
-	defer resp.Body.Close()
 	var user User
 	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
 		return nil, err
 	}
 
 	// update cache
-	pacCache[pacToken] = &user
-	return pacCache[pacToken], nil
+	pacCache.set(pacToken, &user)
+	return &user, nil
 }
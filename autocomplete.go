@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+const (
+	autocompleteCacheTTL        = 5 * time.Minute
+	autocompleteCacheMaxEntries = 1000
+
+	// autocompleteRate and autocompleteBurst allow a debounced address form
+	// to autocomplete as the user types, but not much more.
+	autocompleteRate  = 2 // per second
+	autocompleteBurst = 10
+)
+
+var (
+	autocompleteResults = newAutocompleteCache(autocompleteCacheTTL, autocompleteCacheMaxEntries)
+	autocompleteLimiter = newRateLimiter(autocompleteRate, autocompleteBurst)
+)
+
+type autocompleteCacheEntry struct {
+	suggestions []lob.LobAutocompleteSuggestion
+	expiresAt   time.Time
+}
+
+// autocompleteCache briefly caches Lob's suggestions for an address prefix,
+// since users typing the same street ask for the same suggestions. The cache
+// is bounded.
+type autocompleteCache struct {
+	mu         sync.Mutex
+	entries    map[string]*autocompleteCacheEntry
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+}
+
+func newAutocompleteCache(ttl time.Duration, maxEntries int) *autocompleteCache {
+	return &autocompleteCache{
+		entries:    map[string]*autocompleteCacheEntry{},
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}
+}
+
+// autocompleteCacheKey normalizes a request so differently typed versions
+// of the same prefix share an entry.
+func autocompleteCacheKey(autocompleteRequest lob.LobAutocompleteRequest) string {
+	return strings.ToUpper(strings.Join([]string{
+		strings.Join(strings.Fields(autocompleteRequest.AddressPrefix), " "),
+		strings.TrimSpace(autocompleteRequest.City),
+		strings.TrimSpace(autocompleteRequest.State),
+		strings.TrimSpace(autocompleteRequest.ZipCode),
+	}, "|"))
+}
+
+func (c *autocompleteCache) get(autocompleteRequest lob.LobAutocompleteRequest) ([]lob.LobAutocompleteSuggestion, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := autocompleteCacheKey(autocompleteRequest)
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.suggestions, true
+}
+
+func (c *autocompleteCache) set(autocompleteRequest lob.LobAutocompleteRequest, suggestions []lob.LobAutocompleteSuggestion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := autocompleteCacheKey(autocompleteRequest)
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = &autocompleteCacheEntry{suggestions: suggestions, expiresAt: c.now().Add(c.ttl)}
+}
+
+// evict makes room for one entry, dropping expired entries or else the one
+// closest to expiry. c.mu must be held.
+func (c *autocompleteCache) evict() {
+	now := c.now()
+	var oldestKey string
+	var oldest *autocompleteCacheEntry
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.expiresAt.Before(oldest.expiresAt) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+type rateLimiterBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// rateLimiter is a token bucket per user: each user may make burst requests
+// at once, refilled at rate per second.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[int]*rateLimiterBucket
+	rate    float64
+	burst   float64
+	now     func() time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		buckets: map[int]*rateLimiterBucket{},
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+	}
+}
+
+// allow reports whether recurseId may make a request now, and if not how
+// long until they may.
+func (l *rateLimiter) allow(recurseId int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[recurseId]
+	if !ok {
+		bucket = &rateLimiterBucket{tokens: l.burst, updatedAt: now}
+		l.buckets[recurseId] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*l.rate)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+func TestAutocompleteCache(t *testing.T) {
+	cache := newAutocompleteCache(time.Minute, 2)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	suggestions := []lob.LobAutocompleteSuggestion{{PrimaryLine: "1 MAIN ST"}}
+	cache.set(lob.LobAutocompleteRequest{AddressPrefix: "1 main"}, suggestions)
+	if got, ok := cache.get(lob.LobAutocompleteRequest{AddressPrefix: " 1  MAIN "}); !ok || len(got) != 1 {
+		t.Errorf("expected a normalized prefix to hit the cache, got %v, %v", got, ok)
+	}
+	if _, ok := cache.get(lob.LobAutocompleteRequest{AddressPrefix: "1 main", State: "NY"}); ok {
+		t.Error("expected a different state to miss the cache")
+	}
+
+	cache.set(lob.LobAutocompleteRequest{AddressPrefix: "2 main"}, suggestions)
+	cache.set(lob.LobAutocompleteRequest{AddressPrefix: "3 main"}, suggestions)
+	if len(cache.entries) != 2 {
+		t.Errorf("cache has %d entries, want at most 2", len(cache.entries))
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.get(lob.LobAutocompleteRequest{AddressPrefix: "3 main"}); ok {
+		t.Error("entry should have expired")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow(7); !allowed {
+			t.Fatalf("request %d within the burst was limited", i)
+		}
+	}
+	allowed, retryAfter := limiter.allow(7)
+	if allowed || retryAfter != 500*time.Millisecond {
+		t.Errorf("got %v, %v past the burst, want false, 500ms", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.allow(8); !allowed {
+		t.Error("users should be limited separately")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if allowed, _ := limiter.allow(7); !allowed {
+		t.Error("expected the bucket to have refilled")
+	}
+}
+
+func TestAutocompleteAddress(t *testing.T) {
+	server := useLobtest(t)
+	results, limiter := autocompleteResults, autocompleteLimiter
+	t.Cleanup(func() { autocompleteResults, autocompleteLimiter = results, limiter })
+	autocompleteResults = newAutocompleteCache(autocompleteCacheTTL, autocompleteCacheMaxEntries)
+	autocompleteLimiter = newRateLimiter(autocompleteRate, 1)
+	user := &User{Id: 7, Name: "Ada"}
+
+	autocomplete := func(target string) (*httptest.ResponseRecorder, AutocompleteResponse) {
+		w := httptest.NewRecorder()
+		serveAddressRoutes(w, withUser(httptest.NewRequest(http.MethodGet, target, nil), user))
+		var resp AutocompleteResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	w, resp := autocomplete("/addresses/autocomplete?prefix=1+main&state=IL")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	if len(resp.Suggestions) != 1 || resp.Suggestions[0].AddressCity != "SPRINGFIELD" {
+		t.Errorf("unexpected suggestions %+v", resp.Suggestions)
+	}
+
+	// cached, so not rate limited
+	if w, _ = autocomplete("/addresses/autocomplete?prefix=1+MAIN&state=il"); w.Code != http.StatusOK {
+		t.Errorf("cached lookup: got status %d", w.Code)
+	}
+	if server.Autocompletions() != 1 {
+		t.Errorf("made %d Lob requests, want 1", server.Autocompletions())
+	}
+
+	if w, resp = autocomplete("/addresses/autocomplete?prefix=1"); w.Code != http.StatusOK || len(resp.Suggestions) != 0 {
+		t.Errorf("short prefix: got status %d and %d suggestions", w.Code, len(resp.Suggestions))
+	}
+
+	w, _ = autocomplete("/addresses/autocomplete?prefix=397+bridge")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected to be rate limited, got status %d", w.Code)
+	}
+}
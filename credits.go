@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go"
+)
+
+// priceCredits maps Stripe price ids to the number of credits one unit of
+// that price buys. It is loaded from STRIPE_PRICE_CREDITS at startup.
+var priceCredits = map[string]int{}
+
+// stripeBackend is used for Stripe API calls. Tests point it at a local
+// stand-in.
+var stripeBackend stripe.Backend = stripe.GetBackend(stripe.APIBackend)
+
+// parsePriceCredits parses a comma separated list of price_id:credits pairs,
+// e.g. "price_1abc:1,price_2def:5,price_3ghi:20".
+func parsePriceCredits(s string) (map[string]int, error) {
+	prices := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		priceId, credits, ok := strings.Cut(pair, ":")
+		if !ok || priceId == "" {
+			return nil, fmt.Errorf("malformed price %q, expected price_id:credits", pair)
+		}
+		numCredits, err := strconv.Atoi(credits)
+		if err != nil || numCredits <= 0 {
+			return nil, fmt.Errorf("malformed credits for price %s: %q", priceId, credits)
+		}
+		prices[priceId] = numCredits
+	}
+	return prices, nil
+}
+
+// stripeLivemode selects which Stripe key new checkout sessions are created
+// with. It is loaded from STRIPE_LIVEMODE at startup, and is live unless that
+// says otherwise so that a deployment can't quietly sell test credits.
+var stripeLivemode = true
+
+// creditPacks returns the pack sizes on sale, smallest first.
+func creditPacks() []int {
+	var packs []int
+	seen := map[int]bool{}
+	for _, numCredits := range priceCredits {
+		if !seen[numCredits] {
+			seen[numCredits] = true
+			packs = append(packs, numCredits)
+		}
+	}
+	sort.Ints(packs)
+	return packs
+}
+
+// priceIdForPack returns the Stripe price that sells a pack of numCredits.
+func priceIdForPack(numCredits int) (string, bool) {
+	var priceIds []string
+	for priceId, credits := range priceCredits {
+		if credits == numCredits {
+			priceIds = append(priceIds, priceId)
+		}
+	}
+	if len(priceIds) == 0 {
+		return "", false
+	}
+	// be deterministic if several prices sell the same pack
+	sort.Strings(priceIds)
+	return priceIds[0], true
+}
+
+// stripeKey returns the secret key for live or test mode.
+func stripeKey(livemode bool) string {
+	if livemode {
+		return os.Getenv("STRIPE_PROD_KEY")
+	}
+	return os.Getenv("STRIPE_TEST_KEY")
+}
+
+type checkoutSessionLineItem struct {
+	Id       string `json:"id"`
+	Quantity int64  `json:"quantity"`
+	Price    struct {
+		Id string `json:"id"`
+	} `json:"price"`
+}
+
+type checkoutSessionLineItemList struct {
+	stripe.ListMeta
+	Data []*checkoutSessionLineItem `json:"data"`
+}
+
+// getCheckoutSessionLineItems lists everything bought in a checkout session.
+// stripe-go v70 predates the line_items endpoint, so it is called directly.
+func getCheckoutSessionLineItems(checkoutSessionId string, livemode bool) ([]*checkoutSessionLineItem, error) {
+	var lineItems []*checkoutSessionLineItem
+	startingAfter := ""
+	for {
+		params := &stripe.Params{}
+		params.AddExtra("limit", "100")
+		if startingAfter != "" {
+			params.AddExtra("starting_after", startingAfter)
+		}
+
+		var list checkoutSessionLineItemList
+		path := stripe.FormatURLPath("/v1/checkout/sessions/%s/line_items", checkoutSessionId)
+		if err := stripeBackend.Call(http.MethodGet, path, stripeKey(livemode), params, &list); err != nil {
+			return nil, err
+		}
+
+		lineItems = append(lineItems, list.Data...)
+		if !list.HasMore || len(list.Data) == 0 {
+			return lineItems, nil
+		}
+		startingAfter = list.Data[len(list.Data)-1].Id
+	}
+}
+
+// creditsForCheckoutSession returns how many credits a completed checkout
+// session bought. It fails on prices missing from priceCredits so that the
+// webhook is retried once the configuration is fixed.
+func creditsForCheckoutSession(checkoutSession stripe.CheckoutSession) (int, error) {
+	lineItems, err := getCheckoutSessionLineItems(checkoutSession.ID, checkoutSession.Livemode)
+	if err != nil {
+		return 0, err
+	}
+
+	numCredits := 0
+	for _, lineItem := range lineItems {
+		credits, ok := priceCredits[lineItem.Price.Id]
+		if !ok {
+			return 0, fmt.Errorf("checkout session %s: no credits configured for price %s", checkoutSession.ID, lineItem.Price.Id)
+		}
+		numCredits += credits * int(lineItem.Quantity)
+	}
+	return numCredits, nil
+}
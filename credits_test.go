@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stripe/stripe-go"
+)
+
+// useStripeStandIn points stripeBackend at handler for the duration of the
+// test.
+func useStripeStandIn(t *testing.T, handler http.Handler) {
+	server := httptest.NewServer(handler)
+	previous := stripeBackend
+	stripeBackend = stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:           server.URL,
+		HTTPClient:    server.Client(),
+		LeveledLogger: &stripe.LeveledLogger{Level: stripe.LevelError},
+	})
+	t.Cleanup(func() {
+		stripeBackend = previous
+		server.Close()
+	})
+}
+
+func TestParsePriceCredits(t *testing.T) {
+	prices, err := parsePriceCredits("price_a:1, price_b:5,price_c:20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 3 || prices["price_a"] != 1 || prices["price_b"] != 5 || prices["price_c"] != 20 {
+		t.Errorf("unexpected prices %v", prices)
+	}
+
+	for _, malformed := range []string{"price_a", "price_a:x", ":5", "price_a:0"} {
+		if _, err := parsePriceCredits(malformed); err == nil {
+			t.Errorf("expected an error parsing %q", malformed)
+		}
+	}
+}
+
+func TestCreditsForCheckoutSession(t *testing.T) {
+	priceCredits = map[string]int{"price_single": 1, "price_five": 5}
+	t.Cleanup(func() { priceCredits = map[string]int{} })
+
+	useStripeStandIn(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/checkout/sessions/cs_test_1/line_items" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("starting_after") == "" {
+			w.Write([]byte(`{"object": "list", "has_more": true, "data": [{"id": "li_1", "quantity": 2, "price": {"id": "price_five"}}]}`))
+		} else {
+			w.Write([]byte(`{"object": "list", "has_more": false, "data": [{"id": "li_2", "quantity": 3, "price": {"id": "price_single"}}]}`))
+		}
+	}))
+
+	numCredits, err := creditsForCheckoutSession(stripe.CheckoutSession{ID: "cs_test_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numCredits != 13 {
+		t.Errorf("got %d credits, want 13", numCredits)
+	}
+
+	delete(priceCredits, "price_single")
+	if _, err := creditsForCheckoutSession(stripe.CheckoutSession{ID: "cs_test_1"}); err == nil {
+		t.Error("expected an error for an unconfigured price")
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
-	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"text/template"
 
 	"github.com/google/uuid"
+	lob "github.com/rc-postcard/rc-postcard/lob"
 	"golang.org/x/oauth2"
 )
 
@@ -38,24 +39,43 @@ func (u *User) GetShortName() string {
 var staticFiles embed.FS
 var favicon = template.Must(template.ParseFS(staticFiles, "static/favicon.ico"))
 var home = template.Must(template.ParseFS(staticFiles, "static/home.html"))
-var backOfPostcard = template.Must(template.ParseFS(staticFiles, "static/back-of-4x6-postcard-1.html"))
 
-var (
-	// sessions stores user session information for browser login
-	sessions = map[string]*Session{}
+// backOfPostcard is the template for the back of each postcard size.
+var backOfPostcard = map[string]*template.Template{
+	lob.Size4x6:  template.Must(template.ParseFS(staticFiles, "static/back-of-4x6-postcard-1.html")),
+	lob.Size6x9:  template.Must(template.ParseFS(staticFiles, "static/back-of-6x9-postcard-1.html")),
+	lob.Size6x11: template.Must(template.ParseFS(staticFiles, "static/back-of-6x11-postcard-1.html")),
+}
+
+var letterBody = template.Must(template.ParseFS(staticFiles, "static/letter-1.html"))
+
+// backOfPostcardData fills in the backOfPostcard templates.
+type backOfPostcardData struct {
+	Message string
+	Branding
+}
 
+var (
 	oauthConf = &oauth2.Config{
 		RedirectURL:  os.Getenv("OAUTH_REDIRECT"),
 		ClientID:     os.Getenv("OAUTH_CLIENT_ID"),
 		ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
 		Scopes:       []string{},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://www.recurse.com/oauth/authorize",
-			TokenURL: "https://www.recurse.com/oauth/token",
-		},
+		Endpoint:     org.oauthEndpoint(),
 	}
 )
 
+// appBaseUrl returns the scheme and host the app is served from, derived
+// from the OAuth redirect URL.
+func appBaseUrl() string {
+	redirectUrl, err := url.Parse(oauthConf.RedirectURL)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return (&url.URL{Scheme: redirectUrl.Scheme, Host: redirectUrl.Host}).String()
+}
+
 // Each session contains the user information and the oauth state
 // to protect users from CSRF attacks.
 // See https://pkg.go.dev/golang.org/x/oauth2#Config.AuthCodeURL
@@ -102,14 +122,14 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 			session.User.Name,
 			session.User.Email,
 			session.User.GetShortName(),
-			2); err != nil {
+			org.FreeCredits); err != nil {
 			log.Println(err)
 			http.Error(w, "Error setting address in database", http.StatusInternalServerError)
 			return
 		}
 	}
 
-	home.Execute(w, nil)
+	home.Execute(w, org)
 	return
 }
 
@@ -125,21 +145,21 @@ func serveLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a new random session token
-	sessionToken := uuid.NewString()
-
-	// Set the token in the session map, along with the session information
-	sessions[sessionToken] = &Session{
+	// Store a new session with a random token, along with the session information
+	session := &Session{
 		State: uuid.NewString(),
 	}
+	sessionToken, err := sessionStore.Create(session)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	// Set the client cookie for "session_token" as the session token
-	http.SetCookie(w, &http.Cookie{
-		Name:  "session_token",
-		Value: sessionToken,
-	})
+	setSessionCookie(w, sessionToken)
 
-	url := oauthConf.AuthCodeURL(sessions[sessionToken].State, oauth2.AccessTypeOnline)
+	url := oauthConf.AuthCodeURL(session.State, oauth2.AccessTypeOnline)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
@@ -149,7 +169,7 @@ func serveAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// if no session exists, redirect to /login
-	session, err := getSession(r)
+	sessionToken, session, err := getSessionWithToken(r)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 		return
@@ -183,9 +203,9 @@ func serveAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// create a client to send authorized requests to recurse.com
+	// create a client to send authorized requests to the profile API
 	client := oauthConf.Client(context.TODO(), tok)
-	resp, err := client.Get("https://recurse.com/api/v1/profiles/me")
+	resp, err := client.Get(org.ProfileMeUrl)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -204,25 +224,55 @@ func serveAuth(w http.ResponseWriter, r *http.Request) {
 
 	// save user in session
 	session.User = user
+	if err := sessionStore.Save(sessionToken, session); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// serveLogout serves the '/logout' route, which destroys the current session.
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	if !verifyRoute(w, r, http.MethodPost, "/logout") {
+		return
+	}
+
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if err := sessionStore.Delete(c.Value); err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	setSessionCookie(w, "")
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // getSession is a helper function to get the session struct from the request
 // cookie. This function will return an error if the session is not found.
 func getSession(r *http.Request) (*Session, error) {
+	_, session, err := getSessionWithToken(r)
+	return session, err
+}
+
+// getSessionWithToken is like getSession but also returns the session token,
+// which is needed to save changes to the session.
+func getSessionWithToken(r *http.Request) (string, *Session, error) {
 	// We can obtain the session token from the requests cookies, which come with every request
-	c, err := r.Cookie("session_token")
+	c, err := r.Cookie(sessionCookieName)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	sessionToken := c.Value
 
-	// We then get the session from our session map
-	userSession, exists := sessions[sessionToken]
-	if !exists {
-		return nil, errors.New("Session not found")
+	// We then get the session from our session store
+	userSession, err := sessionStore.Get(sessionToken)
+	if err != nil {
+		return "", nil, err
 	}
 
-	return userSession, nil
+	return sessionToken, userSession, nil
 }
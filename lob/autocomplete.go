@@ -0,0 +1,69 @@
+package lob
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const autocompletionsRoute = "us_autocompletions"
+
+// LobAutocompleteRequest narrows autocompletion of AddressPrefix to
+// addresses in City, State or ZipCode when they are given.
+type LobAutocompleteRequest struct {
+	AddressPrefix string `json:"address_prefix"`
+	City          string `json:"city,omitempty"`
+	State         string `json:"state,omitempty"`
+	ZipCode       string `json:"zip_code,omitempty"`
+}
+
+type LobAutocompleteSuggestion struct {
+	PrimaryLine string `json:"primary_line"`
+	City        string `json:"city"`
+	State       string `json:"state"`
+	ZipCode     string `json:"zip_code"`
+}
+
+type LobAutocompleteResponse struct {
+	Id          string                      `json:"id"`
+	Suggestions []LobAutocompleteSuggestion `json:"suggestions"`
+}
+
+// Autocomplete suggests US addresses starting with a partial address, with
+// Lob's us_autocompletions endpoint.
+func (l *Lob) Autocomplete(autocompleteRequest LobAutocompleteRequest) (*LobAutocompleteResponse, error) {
+	marshalledAutocompleteRequest, err := json.Marshal(autocompleteRequest)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	autocompleteUrl := fmt.Sprintf("%s/%s/%s", l.baseUrl, lobVersion, autocompletionsRoute)
+	req, err := http.NewRequest("POST", autocompleteUrl, bytes.NewBuffer(marshalledAutocompleteRequest))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAuthHeaders(req, true)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
+	var autocompleteResponse LobAutocompleteResponse
+	if err := json.NewDecoder(resp.Body).Decode(&autocompleteResponse); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &autocompleteResponse, nil
+}
@@ -0,0 +1,124 @@
+package lob
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const intlVerificationsRoute = "intl_verifications"
+
+// Lob's deliverability values for international verifications.
+const (
+	IntlDeliverable            = "deliverable"
+	IntlDeliverableMissingInfo = "deliverable_missing_info"
+	IntlUndeliverable          = "undeliverable"
+	IntlNoMatch                = "no_match"
+)
+
+// IsInternational reports whether an address_country is outside the US. Lob
+// takes ISO 3166 codes but answers with country names, so both are accepted.
+func IsInternational(country string) bool {
+	switch strings.ToUpper(strings.TrimSpace(country)) {
+	case "", "US", "USA", "UNITED STATES":
+		return false
+	}
+	return true
+}
+
+type LobIntlVerifyAddressRequest struct {
+	PrimaryLine   string `json:"primary_line"`
+	SecondaryLine string `json:"secondary_line,omitempty"`
+	City          string `json:"city,omitempty"`
+	State         string `json:"state,omitempty"`
+	PostalCode    string `json:"postal_code,omitempty"`
+	Country       string `json:"country"`
+}
+
+// LobIntlAddressComponents are the normalized parts of an international
+// address.
+type LobIntlAddressComponents struct {
+	PrimaryNumber string `json:"primary_number"`
+	StreetName    string `json:"street_name"`
+	City          string `json:"city"`
+	State         string `json:"state"`
+	PostalCode    string `json:"postal_code"`
+}
+
+// LobIntlVerifyAddressResponse is an international verification. Coverage
+// says how complete Lob's data for the country is, and Status how closely
+// the address matched it.
+type LobIntlVerifyAddressResponse struct {
+	Id             string                   `json:"id"`
+	PrimaryLine    string                   `json:"primary_line"`
+	SecondaryLine  string                   `json:"secondary_line"`
+	LastLine       string                   `json:"last_line"`
+	Country        string                   `json:"country"`
+	Coverage       string                   `json:"coverage"`
+	Deliverability string                   `json:"deliverability"`
+	Status         string                   `json:"status"`
+	Components     LobIntlAddressComponents `json:"components"`
+}
+
+// SuggestedAddress is the verified address in the form it is saved in.
+func (v *LobIntlVerifyAddressResponse) SuggestedAddress() LobAddress {
+	return LobAddress{
+		AddressLine1:   v.PrimaryLine,
+		AddressLine2:   v.SecondaryLine,
+		AddressCity:    v.Components.City,
+		AddressState:   v.Components.State,
+		AddressZip:     v.Components.PostalCode,
+		AddressCountry: v.Country,
+	}
+}
+
+// VerifyIntlAddress checks an address outside the US with Lob's
+// intl_verifications endpoint. country is an ISO 3166 alpha-2 code.
+func (l *Lob) VerifyIntlAddress(addressLine1, addressLine2, city, state, postalCode, country string) (*LobIntlVerifyAddressResponse, error) {
+	verifyAddressRequest := &LobIntlVerifyAddressRequest{
+		PrimaryLine:   addressLine1,
+		SecondaryLine: addressLine2,
+		City:          city,
+		State:         state,
+		PostalCode:    postalCode,
+		Country:       country,
+	}
+
+	marshalledVerifyAddressRequest, err := json.Marshal(verifyAddressRequest)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	verifyAddressUrl := fmt.Sprintf("%s/%s/%s", l.baseUrl, lobVersion, intlVerificationsRoute)
+	req, err := http.NewRequest("POST", verifyAddressUrl, bytes.NewBuffer(marshalledVerifyAddressRequest))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	setAuthHeaders(req, true)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
+	var verifyAddressResponse LobIntlVerifyAddressResponse
+	if err := json.NewDecoder(resp.Body).Decode(&verifyAddressResponse); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	return &verifyAddressResponse, nil
+}
@@ -0,0 +1,215 @@
+package lob
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Where Lob prints the recipient address of a letter.
+const (
+	AddressPlacementTopFirstPage    = "top_first_page"
+	AddressPlacementInsertBlankPage = "insert_blank_page"
+)
+
+// LetterFile is the content of a letter, either HTML or a PDF.
+type LetterFile struct {
+	HTML string
+	PDF  []byte
+}
+
+// LetterOptions are the printing options of a letter.
+type LetterOptions struct {
+	Color       bool
+	DoubleSided bool
+	// AddressPlacement defaults to AddressPlacementTopFirstPage, which needs
+	// the top of the first page left blank.
+	AddressPlacement string
+	// ReturnEnvelope includes a return envelope, and needs PerforatedPage,
+	// the page with a tear-off remittance slip.
+	ReturnEnvelope bool
+	PerforatedPage int
+}
+
+type LobCreateLetterResponse struct {
+	Id                   string    `json:"id"`
+	Url                  string    `json:"url"`
+	SendDate             time.Time `json:"send_date"`
+	ExpectedDeliveryDate string    `json:"expected_delivery_date"`
+}
+
+type LobLetter struct {
+	Id       string `json:"id"`
+	Url      string `json:"url"`
+	Metadata struct {
+		ToRcId   string `json:"to_rc_id"`
+		FromRcId string `json:"from_rc_id"`
+		Mode     string `json:"mode"`
+		// IdempotencyKey is set on letters created with one.
+		IdempotencyKey string `json:"idempotency_key"`
+	} `json:"metadata"`
+	Color                bool      `json:"color"`
+	DoubleSided          bool      `json:"double_sided"`
+	ReturnEnvelope       bool      `json:"return_envelope"`
+	DateCreated          time.Time `json:"date_created"`
+	SendDate             time.Time `json:"send_date"`
+	ExpectedDeliveryDate string    `json:"expected_delivery_date"`
+}
+
+type LobGetLettersResponse struct {
+	Data        []LobLetter `json:"data"`
+	NextUrl     string      `json:"next_url"`
+	PreviousUrl string      `json:"previous_url"`
+	Count       int         `json:"count"`
+}
+
+// GetLettersParams filters a letter listing. Zero values are left out of the
+// request, so Lob's defaults apply.
+type GetLettersParams struct {
+	// Limit is the page size, at most MaxListLimit. Lob defaults to 10.
+	Limit int
+
+	// Metadata only matches letters with all of these metadata values.
+	Metadata map[string]string
+}
+
+func (p GetLettersParams) encode() string {
+	values := url.Values{}
+	if p.Limit > 0 {
+		values.Set("limit", strconv.Itoa(p.Limit))
+	}
+	for k, v := range p.Metadata {
+		values.Set("metadata["+k+"]", v)
+	}
+	return values.Encode()
+}
+
+// CreateLetter creates a letter from an HTML or PDF file. A non-empty
+// idempotencyKey works as it does for CreatePostCard.
+func (l *Lob) CreateLetter(fromLobAddress LobAddress, toLobAddress LobAddress, file LetterFile, options LetterOptions, isLive bool, fromRcId, toRcId int, mode, idempotencyKey string) (*LobCreateLetterResponse, *LobError) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	if file.PDF != nil {
+		filePart, _ := writer.CreateFormFile("file", "user-upload.pdf")
+		io.Copy(filePart, bytes.NewReader(file.PDF))
+	} else {
+		_ = writer.WriteField("file", file.HTML)
+	}
+
+	writeAddressFields(writer, "from", fromLobAddress)
+	writeAddressFields(writer, "to", toLobAddress)
+
+	_ = writer.WriteField("color", strconv.FormatBool(options.Color))
+	_ = writer.WriteField("double_sided", strconv.FormatBool(options.DoubleSided))
+	if options.AddressPlacement != "" {
+		_ = writer.WriteField("address_placement", options.AddressPlacement)
+	}
+	if options.ReturnEnvelope {
+		_ = writer.WriteField("return_envelope", "true")
+		_ = writer.WriteField("perforated_page", strconv.Itoa(options.PerforatedPage))
+	}
+
+	_ = writer.WriteField("metadata[to_rc_id]", strconv.Itoa(toRcId))
+	_ = writer.WriteField("metadata[from_rc_id]", strconv.Itoa(fromRcId))
+	_ = writer.WriteField("metadata[mode]", mode)
+	if idempotencyKey != "" {
+		_ = writer.WriteField("metadata[idempotency_key]", idempotencyKey)
+	}
+
+	writer.Close()
+
+	postLetterUrl := fmt.Sprintf("%s/%s/%s", l.baseUrl, lobVersion, lettersRoute)
+	req, err := http.NewRequest("POST", postLetterUrl, body)
+	if err != nil {
+		return nil, &LobError{Err: err}
+	}
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	setAuthHeaders(req, isLive)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return nil, &LobError{Err: err}
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		lobError := decodeLobError(resp)
+		log.Println(lobError)
+		return nil, lobError
+	}
+
+	var createLetterResponse LobCreateLetterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&createLetterResponse); err != nil {
+		return nil, &LobError{Err: err}
+	}
+	return &createLetterResponse, nil
+}
+
+// GetLetter fetches a letter, including a freshly signed url of its PDF.
+func (l *Lob) GetLetter(lobLetterId string, isLive bool) (*LobLetter, error) {
+	getLetterUrl := fmt.Sprintf("%s/%s/%s/%s", l.baseUrl, lobVersion, lettersRoute, lobLetterId)
+	req, err := http.NewRequest("GET", getLetterUrl, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	setAuthHeaders(req, isLive)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
+	var letter LobLetter
+	if err := json.NewDecoder(resp.Body).Decode(&letter); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// GetLetters lists one page of letters matching params, newest first.
+func (l *Lob) GetLetters(params GetLettersParams, isLive bool) (*LobGetLettersResponse, error) {
+	getLettersUrl := fmt.Sprintf("%s/%s/%s?%s", l.baseUrl, lobVersion, lettersRoute, params.encode())
+	req, err := http.NewRequest("GET", getLettersUrl, nil)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	setAuthHeaders(req, isLive)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
+	var getLettersResponse LobGetLettersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&getLettersResponse); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &getLettersResponse, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,21 +11,33 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
-const (
-	RecurseCenterName     = "Recurse Center"
-	RecurseAddressLine1   = "397 Bridge Street"
-	RecurseAddressLine2   = "5th Floor"
-	RecurseAddressCity    = "Brooklyn"
-	RecurseAddressState   = "NY"
-	RecurseAddressZip     = "11201"
-	RecurseAddressCountry = "US"
-)
+// LobAPI is the subset of the Lob API used by rc-postcard. *Lob implements it
+// against api.lob.com, and the lobtest package runs an in-process fake.
+type LobAPI interface {
+	CreatePostCard(fromLobAddress LobAddress, toLobAddress LobAddress, frontImage []byte, back string, isLive bool, fromRcId, toRcId int, mode, size string, sendDate time.Time, idempotencyKey string) (*LobCreatePostcardResponse, *LobError)
+	GetPostcards(params GetPostcardsParams, isLive bool) (*LobGetPostcardsResponse, error)
+	CancelPostcard(lobPostcardId string, isLive bool) error
+	CreateLetter(fromLobAddress LobAddress, toLobAddress LobAddress, file LetterFile, options LetterOptions, isLive bool, fromRcId, toRcId int, mode, idempotencyKey string) (*LobCreateLetterResponse, *LobError)
+	GetLetter(lobLetterId string, isLive bool) (*LobLetter, error)
+	GetLetters(params GetLettersParams, isLive bool) (*LobGetLettersResponse, error)
+	GetAddress(lobAddressId string, isLive bool) (*LobGetAddressResponse, error)
+	CreateAddress(name, addressLine1, addressLine2, city, state, zipCode, country string, rcId int, isLive bool) (*LobCreateAddressResponse, error)
+	CreateContactAddress(name, addressLine1, addressLine2, city, state, zipCode, country string, ownerRcId int, isLive bool) (*LobCreateAddressResponse, error)
+	DeleteAddress(lobAddressId string, isLive bool) error
+	VerifyAddress(addressLine1, addressLine2, city, state, zipCode string) (*LobVerifyAddressResponse, error)
+	VerifyIntlAddress(addressLine1, addressLine2, city, state, postalCode, country string) (*LobIntlVerifyAddressResponse, error)
+	Autocomplete(autocompleteRequest LobAutocompleteRequest) (*LobAutocompleteResponse, error)
+}
+
+var _ LobAPI = (*Lob)(nil)
 
 type Lob struct {
 	httpClient *http.Client
+	baseUrl    string
 }
 
 type LobError struct {
@@ -36,38 +47,71 @@ type LobError struct {
 	Err        error  `json:"err"`
 }
 
+func (e *LobError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("lob: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Transient reports whether a request failed without a definitive answer,
+// because it never got a response or Lob had a problem of its own. Lob may
+// have carried it out anyway.
+func (e *LobError) Transient() bool {
+	return e.Err != nil || e.StatusCode/100 >= 5
+}
+
 type LobErrorResponse struct {
 	LobError LobError `json:"error"`
 }
 
-const lobAddressBaseUrl = "https://api.lob.com"
+const DefaultBaseUrl = "https://api.lob.com"
 const lobVersion = "v1"
 const addressesRoute = "addresses"
 const postcardsRoute = "postcards"
+const lettersRoute = "letters"
 const verificationsRoute = "us_verifications"
 
 func NewLob(httpClient *http.Client) *Lob {
+	return NewLobWithBaseUrl(httpClient, DefaultBaseUrl)
+}
+
+// NewLobWithBaseUrl returns a Lob client that sends requests to baseUrl
+// instead of the public Lob API, e.g. a lobtest.Server.
+func NewLobWithBaseUrl(httpClient *http.Client, baseUrl string) *Lob {
 	return &Lob{
 		httpClient: httpClient,
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
 	}
 }
 
+type LobPostcard struct {
+	Id       string `json:"id"`
+	Url      string `json:"url"`
+	Metadata struct {
+		ToRcId   string `json:"to_rc_id"`
+		FromRcId string `json:"from_rc_id"`
+		Mode     string `json:"mode"`
+		// IdempotencyKey is set on postcards created with one.
+		IdempotencyKey string `json:"idempotency_key"`
+	} `json:"metadata"`
+	DateCreated          time.Time `json:"date_created"`
+	SendDate             time.Time `json:"send_date"`
+	ExpectedDeliveryDate string    `json:"expected_delivery_date"`
+}
+
 type LobGetPostcardsResponse struct {
-	Data []struct {
-		Id       string `json:"id"`
-		Url      string `json:"url"`
-		Metadata struct {
-			ToRcId   string `json:"to_rc_id"`
-			FromRcId string `json:"from_rc_id"`
-			Mode     string `json:"mode"`
-		} `json:"metadata"`
-		DateCreated          time.Time `json:"date_created"`
-		ExpectedDeliveryDate string    `json:"expected_delivery_date"`
-	} `json:"data"`
-}
-
-func (l *Lob) GetPostcards(recipientRecurseId int, isLive bool) (*LobGetPostcardsResponse, error) {
-	getPostcardsUrl := fmt.Sprintf("%s/%s/%s?metadata[to_rc_id]=%d", lobAddressBaseUrl, lobVersion, postcardsRoute, recipientRecurseId)
+	Data        []LobPostcard `json:"data"`
+	NextUrl     string        `json:"next_url"`
+	PreviousUrl string        `json:"previous_url"`
+	Count       int           `json:"count"`
+}
+
+// GetPostcards lists one page of postcards matching params, newest first.
+// Use NextCursor and PreviousCursor on the response to page, or
+// NewPostcardIter to walk every page.
+func (l *Lob) GetPostcards(params GetPostcardsParams, isLive bool) (*LobGetPostcardsResponse, error) {
+	getPostcardsUrl := fmt.Sprintf("%s/%s/%s?%s", l.baseUrl, lobVersion, postcardsRoute, params.encode())
 	req, err := http.NewRequest("GET", getPostcardsUrl, nil)
 	if err != nil {
 		log.Println(err)
@@ -82,6 +126,11 @@ func (l *Lob) GetPostcards(recipientRecurseId int, isLive bool) (*LobGetPostcard
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
 	var getPostcardsResponse LobGetPostcardsResponse
 	if err := json.NewDecoder(resp.Body).Decode(&getPostcardsResponse); err != nil {
 		log.Println(err)
@@ -91,6 +140,42 @@ func (l *Lob) GetPostcards(recipientRecurseId int, isLive bool) (*LobGetPostcard
 	return &getPostcardsResponse, nil
 }
 
+type LobCancelPostcardResponse struct {
+	Id      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+}
+
+// CancelPostcard cancels a postcard Lob hasn't sent to production yet, which
+// is only possible before its send_date.
+func (l *Lob) CancelPostcard(lobPostcardId string, isLive bool) error {
+	cancelPostcardUrl := fmt.Sprintf("%s/%s/%s/%s", l.baseUrl, lobVersion, postcardsRoute, lobPostcardId)
+	req, err := http.NewRequest("DELETE", cancelPostcardUrl, nil)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	setAuthHeaders(req, isLive)
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeLobError(resp)
+	}
+
+	var cancelPostcardResponse LobCancelPostcardResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cancelPostcardResponse); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
 type LobGetAddressResponse struct {
 	Name           string `json:"name"`
 	AddressLine1   string `json:"address_line1"`
@@ -102,7 +187,7 @@ type LobGetAddressResponse struct {
 }
 
 func (l *Lob) GetAddress(lobAddressId string, isLive bool) (*LobGetAddressResponse, error) {
-	getAddressUrl := fmt.Sprintf("%s/%s/%s/%s", lobAddressBaseUrl, lobVersion, addressesRoute, lobAddressId)
+	getAddressUrl := fmt.Sprintf("%s/%s/%s/%s", l.baseUrl, lobVersion, addressesRoute, lobAddressId)
 	req, err := http.NewRequest("GET", getAddressUrl, nil)
 	if err != nil {
 		log.Println(err)
@@ -119,6 +204,10 @@ func (l *Lob) GetAddress(lobAddressId string, isLive bool) (*LobGetAddressRespon
 
 	// read body
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
 	var getAddressResponse LobGetAddressResponse
 	if err := json.NewDecoder(resp.Body).Decode(&getAddressResponse); err != nil {
 		return nil, err
@@ -132,7 +221,7 @@ type LobDeleteAddressResponse struct {
 }
 
 func (l *Lob) DeleteAddress(lobAddressId string, isLive bool) error {
-	deleteAddressUrl := fmt.Sprintf("%s/%s/%s/%s", lobAddressBaseUrl, lobVersion, addressesRoute, lobAddressId)
+	deleteAddressUrl := fmt.Sprintf("%s/%s/%s/%s", l.baseUrl, lobVersion, addressesRoute, lobAddressId)
 	req, err := http.NewRequest("DELETE", deleteAddressUrl, nil)
 	if err != nil {
 		log.Println(err)
@@ -146,6 +235,11 @@ func (l *Lob) DeleteAddress(lobAddressId string, isLive bool) error {
 		return err
 	}
 
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeLobError(resp)
+	}
+
 	var deleteAddressResponse LobDeleteAddressResponse
 	if err := json.NewDecoder(resp.Body).Decode(&deleteAddressResponse); err != nil {
 		log.Println(err)
@@ -156,48 +250,73 @@ func (l *Lob) DeleteAddress(lobAddressId string, isLive bool) error {
 	return nil
 }
 
+// LobCreateAddressRequestMetadata records whose address it is: a Recurser's
+// own (RCId), or a contact in a Recurser's address book (OwnerRcId).
 type LobCreateAddressRequestMetadata struct {
-	RCId string `json:"rc_id"`
+	RCId      string `json:"rc_id,omitempty"`
+	OwnerRcId string `json:"owner_rc_id,omitempty"`
 }
 
+// LobCreateAddressRequest is a US address unless AddressCountry is set to
+// another ISO 3166 alpha-2 code.
 type LobCreateAddressRequest struct {
-	Name         string                          `json:"name"`
-	AddressLine1 string                          `json:"address_line1"`
-	AddressLine2 string                          `json:"address_line2"`
-	AddressCity  string                          `json:"address_city"`
-	AddressState string                          `json:"address_state"`
-	AddressZip   string                          `json:"address_zip"`
-	Metadata     LobCreateAddressRequestMetadata `json:"metadata"`
+	Name           string                          `json:"name"`
+	AddressLine1   string                          `json:"address_line1"`
+	AddressLine2   string                          `json:"address_line2"`
+	AddressCity    string                          `json:"address_city"`
+	AddressState   string                          `json:"address_state"`
+	AddressZip     string                          `json:"address_zip"`
+	AddressCountry string                          `json:"address_country,omitempty"`
+	Metadata       LobCreateAddressRequestMetadata `json:"metadata"`
 }
 
 type LobCreateAddressResponse struct {
-	AddressId    string `json:"id"`
-	Name         string `json:"name"`
-	AddressLine1 string `json:"address_line1"`
-	AddressLine2 string `json:"address_line2"`
-	AddressCity  string `json:"address_city"`
-	AddressState string `json:"address_state"`
-	AddressZip   string `json:"address_zip"`
-}
-
-func (l *Lob) CreateAddress(name, addressLine1, addressLine2, city, state, zipCode string, rcId int, isLive bool) (*LobCreateAddressResponse, error) {
-	createAddressRequest := &LobCreateAddressRequest{
-		Name:         name,
-		AddressLine1: addressLine1,
-		AddressLine2: addressLine2,
-		AddressCity:  city,
-		AddressState: state,
-		AddressZip:   zipCode,
-		Metadata:     LobCreateAddressRequestMetadata{RCId: strconv.Itoa(rcId)},
-	}
+	AddressId      string `json:"id"`
+	Name           string `json:"name"`
+	AddressLine1   string `json:"address_line1"`
+	AddressLine2   string `json:"address_line2"`
+	AddressCity    string `json:"address_city"`
+	AddressState   string `json:"address_state"`
+	AddressZip     string `json:"address_zip"`
+	AddressCountry string `json:"address_country"`
+}
+
+func (l *Lob) CreateAddress(name, addressLine1, addressLine2, city, state, zipCode, country string, rcId int, isLive bool) (*LobCreateAddressResponse, error) {
+	return l.createAddress(&LobCreateAddressRequest{
+		Name:           name,
+		AddressLine1:   addressLine1,
+		AddressLine2:   addressLine2,
+		AddressCity:    city,
+		AddressState:   state,
+		AddressZip:     zipCode,
+		AddressCountry: country,
+		Metadata:       LobCreateAddressRequestMetadata{RCId: strconv.Itoa(rcId)},
+	}, isLive)
+}
+
+// CreateContactAddress creates the address of a contact in ownerRcId's
+// address book.
+func (l *Lob) CreateContactAddress(name, addressLine1, addressLine2, city, state, zipCode, country string, ownerRcId int, isLive bool) (*LobCreateAddressResponse, error) {
+	return l.createAddress(&LobCreateAddressRequest{
+		Name:           name,
+		AddressLine1:   addressLine1,
+		AddressLine2:   addressLine2,
+		AddressCity:    city,
+		AddressState:   state,
+		AddressZip:     zipCode,
+		AddressCountry: country,
+		Metadata:       LobCreateAddressRequestMetadata{OwnerRcId: strconv.Itoa(ownerRcId)},
+	}, isLive)
+}
 
+func (l *Lob) createAddress(createAddressRequest *LobCreateAddressRequest, isLive bool) (*LobCreateAddressResponse, error) {
 	marshalledCreateAddressRequest, err := json.Marshal(createAddressRequest)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	createAddressUrl := fmt.Sprintf("%s/%s/%s", lobAddressBaseUrl, lobVersion, addressesRoute)
+	createAddressUrl := fmt.Sprintf("%s/%s/%s", l.baseUrl, lobVersion, addressesRoute)
 	req, err := http.NewRequest("POST", createAddressUrl, bytes.NewBuffer(marshalledCreateAddressRequest))
 	if err != nil {
 		log.Println(err)
@@ -212,6 +331,11 @@ func (l *Lob) CreateAddress(name, addressLine1, addressLine2, city, state, zipCo
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
 	var createAddressResponse LobCreateAddressResponse
 	if err := json.NewDecoder(resp.Body).Decode(&createAddressResponse); err != nil {
 		log.Println(err)
@@ -227,9 +351,38 @@ type LobCreatePostcardMetadata struct {
 }
 
 type LobCreatePostcardResponse struct {
-	Url string `json:"url"`
+	Id                   string    `json:"id"`
+	Url                  string    `json:"url"`
+	Size                 string    `json:"size"`
+	SendDate             time.Time `json:"send_date"`
+	ExpectedDeliveryDate string    `json:"expected_delivery_date"`
+}
+
+// Postcard sizes Lob prints.
+const (
+	Size4x6  = "4x6"
+	Size6x9  = "6x9"
+	Size6x11 = "6x11"
+)
+
+// PostcardSpec is the artwork Lob expects for a postcard size: the full
+// bleed, a sixteenth of an inch on each side beyond the trim size, at 300
+// DPI.
+type PostcardSpec struct {
+	Size     string
+	WidthPx  int
+	HeightPx int
+}
+
+var PostcardSpecs = map[string]PostcardSpec{
+	Size4x6:  {Size: Size4x6, WidthPx: 1875, HeightPx: 1275},
+	Size6x9:  {Size: Size6x9, WidthPx: 2775, HeightPx: 1875},
+	Size6x11: {Size: Size6x11, WidthPx: 3375, HeightPx: 1875},
 }
 
+// MaxSendDateHorizon is how far in the future Lob accepts a send_date.
+const MaxSendDateHorizon = 180 * 24 * time.Hour
+
 type LobAddress struct {
 	AddressId      string `json:"id"`
 	Name           string `json:"name"`
@@ -241,9 +394,36 @@ type LobAddress struct {
 	AddressCountry string `json:"address_country"`
 }
 
+// writeAddressFields writes address as the prefix ("to" or "from") of a
+// create request, by id if it has one and inline otherwise.
+func writeAddressFields(writer *multipart.Writer, prefix string, address LobAddress) {
+	if address.AddressId != "" {
+		_ = writer.WriteField(prefix, address.AddressId)
+		return
+	}
+	_ = writer.WriteField(prefix+"[name]", address.Name)
+	_ = writer.WriteField(prefix+"[address_line1]", address.AddressLine1)
+	_ = writer.WriteField(prefix+"[address_line2]", address.AddressLine2)
+	_ = writer.WriteField(prefix+"[address_city]", address.AddressCity)
+	_ = writer.WriteField(prefix+"[address_state]", address.AddressState)
+	_ = writer.WriteField(prefix+"[address_zip]", address.AddressZip)
+	if address.AddressCountry != "" {
+		_ = writer.WriteField(prefix+"[address_country]", address.AddressCountry)
+	}
+}
+
+// CreatePostCard creates a postcard of the given size, or Size4x6 if size is
+// empty. A non-zero sendDate, at most MaxSendDateHorizon away, has Lob hold
+// the postcard until then.
+//
+// A non-empty idempotencyKey is sent as Lob's Idempotency-Key, so that
+// repeating a request whose response was lost returns the postcard already
+// created instead of mailing another. It is also recorded in the postcard's
+// metadata, to find it again after Lob forgets the key a day later.
+//
 // https://gist.github.com/andrewmilson/19185aab2347f6ad29f5
 // https://gist.github.com/mattetti/5914158/f4d1393d83ebedc682a3c8e7bdc6b49670083b84
-func (l *Lob) CreatePostCard(fromLobAddress LobAddress, toLobAddress LobAddress, frontImage []byte, back string, isLive bool, fromRcId, toRcId int, mode string) (*LobCreatePostcardResponse, *LobError) {
+func (l *Lob) CreatePostCard(fromLobAddress LobAddress, toLobAddress LobAddress, frontImage []byte, back string, isLive bool, fromRcId, toRcId int, mode, size string, sendDate time.Time, idempotencyKey string) (*LobCreatePostcardResponse, *LobError) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -254,41 +434,34 @@ func (l *Lob) CreatePostCard(fromLobAddress LobAddress, toLobAddress LobAddress,
 
 	_ = writer.WriteField("back", back)
 
-	if fromLobAddress.AddressId != "" {
-		_ = writer.WriteField("from", fromLobAddress.AddressId)
-
-	} else {
-		_ = writer.WriteField("from[name]", fromLobAddress.Name)
-		_ = writer.WriteField("from[address_line1]", fromLobAddress.AddressLine1)
-		_ = writer.WriteField("from[address_line2]", fromLobAddress.AddressLine2)
-		_ = writer.WriteField("from[address_city]", fromLobAddress.AddressCity)
-		_ = writer.WriteField("from[address_state]", fromLobAddress.AddressState)
-		_ = writer.WriteField("from[address_zip]", fromLobAddress.AddressZip)
-	}
-
-	if toLobAddress.AddressId != "" {
-		_ = writer.WriteField("to", toLobAddress.AddressId)
-	} else {
-		_ = writer.WriteField("to[name]", toLobAddress.Name)
-		_ = writer.WriteField("to[address_line1]", toLobAddress.AddressLine1)
-		_ = writer.WriteField("to[address_line2]", toLobAddress.AddressLine2)
-		_ = writer.WriteField("to[address_city]", toLobAddress.AddressCity)
-		_ = writer.WriteField("to[address_state]", toLobAddress.AddressState)
-		_ = writer.WriteField("to[address_zip]", toLobAddress.AddressZip)
-	}
+	writeAddressFields(writer, "from", fromLobAddress)
+	writeAddressFields(writer, "to", toLobAddress)
 
 	_ = writer.WriteField("metadata[to_rc_id]", strconv.Itoa(toRcId))
 	_ = writer.WriteField("metadata[from_rc_id]", strconv.Itoa(fromRcId))
 	_ = writer.WriteField("metadata[mode]", mode)
+	if idempotencyKey != "" {
+		_ = writer.WriteField("metadata[idempotency_key]", idempotencyKey)
+	}
+
+	if size != "" {
+		_ = writer.WriteField("size", size)
+	}
+	if !sendDate.IsZero() {
+		_ = writer.WriteField("send_date", sendDate.UTC().Format(time.RFC3339))
+	}
 
 	writer.Close()
 
-	postPostcardUrl := fmt.Sprintf("%s/%s/%s", lobAddressBaseUrl, lobVersion, postcardsRoute)
+	postPostcardUrl := fmt.Sprintf("%s/%s/%s", l.baseUrl, lobVersion, postcardsRoute)
 	req, err := http.NewRequest("POST", postPostcardUrl, body)
 	if err != nil {
 		return nil, &LobError{Err: err}
 	}
 	req.Header.Add("Content-Type", writer.FormDataContentType())
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
 	setAuthHeaders(req, isLive)
 
 	resp, err := l.httpClient.Do(req)
@@ -325,8 +498,100 @@ type LobVerifyAddressRequest struct {
 	ZipCode       string `json:"zip_code"`
 }
 
+// LobVerifyAddressResponse is a US verification: the address as USPS
+// knows it, and whether mail to it can be delivered.
 type LobVerifyAddressResponse struct {
-	Deliverability string `json:"deliverability"`
+	Id                     string                    `json:"id"`
+	PrimaryLine            string                    `json:"primary_line"`
+	SecondaryLine          string                    `json:"secondary_line"`
+	Urbanization           string                    `json:"urbanization"`
+	LastLine               string                    `json:"last_line"`
+	Deliverability         string                    `json:"deliverability"`
+	Components             LobAddressComponents      `json:"components"`
+	DeliverabilityAnalysis LobDeliverabilityAnalysis `json:"deliverability_analysis"`
+}
+
+// LobAddressComponents are the normalized parts of a verified address.
+type LobAddressComponents struct {
+	PrimaryNumber            string  `json:"primary_number"`
+	StreetPredirection       string  `json:"street_predirection"`
+	StreetName               string  `json:"street_name"`
+	StreetSuffix             string  `json:"street_suffix"`
+	StreetPostdirection      string  `json:"street_postdirection"`
+	SecondaryDesignator      string  `json:"secondary_designator"`
+	SecondaryNumber          string  `json:"secondary_number"`
+	PmbDesignator            string  `json:"pmb_designator"`
+	PmbNumber                string  `json:"pmb_number"`
+	ExtraSecondaryDesignator string  `json:"extra_secondary_designator"`
+	ExtraSecondaryNumber     string  `json:"extra_secondary_number"`
+	City                     string  `json:"city"`
+	State                    string  `json:"state"`
+	ZipCode                  string  `json:"zip_code"`
+	ZipCodePlus4             string  `json:"zip_code_plus_4"`
+	ZipCodeType              string  `json:"zip_code_type"`
+	DeliveryPointBarcode     string  `json:"delivery_point_barcode"`
+	AddressType              string  `json:"address_type"`
+	RecordType               string  `json:"record_type"`
+	DefaultBuildingAddress   bool    `json:"default_building_address"`
+	County                   string  `json:"county"`
+	CountyFips               string  `json:"county_fips"`
+	CarrierRoute             string  `json:"carrier_route"`
+	CarrierRouteType         string  `json:"carrier_route_type"`
+	Latitude                 float64 `json:"latitude"`
+	Longitude                float64 `json:"longitude"`
+}
+
+// LobDeliverabilityAnalysis explains a verification's deliverability. The
+// DPV (delivery point validation) footnotes are described in
+// DpvFootnoteDescriptions.
+type LobDeliverabilityAnalysis struct {
+	DpvConfirmation string   `json:"dpv_confirmation"`
+	DpvCmra         string   `json:"dpv_cmra"`
+	DpvVacant       string   `json:"dpv_vacant"`
+	DpvActive       string   `json:"dpv_active"`
+	DpvFootnotes    []string `json:"dpv_footnotes"`
+	EwsMatch        bool     `json:"ews_match"`
+	LacsIndicator   string   `json:"lacs_indicator"`
+	LacsReturnCode  string   `json:"lacs_return_code"`
+	SuiteReturnCode string   `json:"suite_return_code"`
+}
+
+// DpvFootnoteDescriptions explains the USPS DPV footnote codes.
+var DpvFootnoteDescriptions = map[string]string{
+	"AA": "The street, city, state and ZIP code are valid.",
+	"A1": "The address could not be matched to a known street.",
+	"BB": "The address is a valid delivery point.",
+	"CC": "The apartment or suite number is not needed and was not recognized.",
+	"C1": "The apartment or suite number is needed but was not recognized.",
+	"F1": "The address is a military or diplomatic address.",
+	"G1": "The address is a general delivery address.",
+	"IA": "The address is an informed address.",
+	"M1": "The street number is missing.",
+	"M3": "The street number is not valid.",
+	"N1": "The address is a building that needs an apartment or suite number.",
+	"PB": "The address is a PO box written as a street address.",
+	"P1": "The PO, RR or HC box number is missing.",
+	"P3": "The PO, RR or HC box number is not valid.",
+	"RR": "The address is a valid delivery point with private mailbox information.",
+	"R1": "The address is a valid delivery point but is missing private mailbox information.",
+	"R7": "The address is on a carrier route USPS does not deliver to.",
+	"TA": "The street number was matched by dropping a trailing letter.",
+	"U1": "The address has a unique ZIP code.",
+}
+
+// SuggestedAddress is the verified address in the form it is saved in.
+func (v *LobVerifyAddressResponse) SuggestedAddress() LobAddress {
+	zip := v.Components.ZipCode
+	if v.Components.ZipCodePlus4 != "" {
+		zip += "-" + v.Components.ZipCodePlus4
+	}
+	return LobAddress{
+		AddressLine1: v.PrimaryLine,
+		AddressLine2: v.SecondaryLine,
+		AddressCity:  v.Components.City,
+		AddressState: v.Components.State,
+		AddressZip:   zip,
+	}
 }
 
 const (
@@ -337,6 +602,8 @@ const (
 	Undeliverable              = "undeliverable"
 )
 
+// VerifyAddress checks a US address against USPS data with Lob's
+// us_verifications endpoint.
 func (l *Lob) VerifyAddress(addressLine1, addressLine2, city, state, zipCode string) (*LobVerifyAddressResponse, error) {
 	verifyAddressRequest := &LobVerifyAddressRequest{
 		PrimaryLine:   addressLine1,
@@ -346,20 +613,13 @@ func (l *Lob) VerifyAddress(addressLine1, addressLine2, city, state, zipCode str
 		ZipCode:       zipCode,
 	}
 
-	log.Printf("PRIMARY %s SECONDARY %s CITY %s STATE %s ZIPCODE %s\n",
-		verifyAddressRequest.PrimaryLine,
-		verifyAddressRequest.SecondaryLine,
-		verifyAddressRequest.City,
-		verifyAddressRequest.State,
-		verifyAddressRequest.ZipCode)
-
 	marshalledVerifyAddressRequest, err := json.Marshal(verifyAddressRequest)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	verifyAddressUrl := fmt.Sprintf("%s/%s/%s", lobAddressBaseUrl, lobVersion, verificationsRoute)
+	verifyAddressUrl := fmt.Sprintf("%s/%s/%s", l.baseUrl, lobVersion, verificationsRoute)
 	req, err := http.NewRequest("POST", verifyAddressUrl, bytes.NewBuffer(marshalledVerifyAddressRequest))
 	if err != nil {
 		log.Println(err)
@@ -375,6 +635,11 @@ func (l *Lob) VerifyAddress(addressLine1, addressLine2, city, state, zipCode str
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeLobError(resp)
+	}
+
 	var verifyAddressResponse LobVerifyAddressResponse
 	if err := json.NewDecoder(resp.Body).Decode(&verifyAddressResponse); err != nil {
 		log.Println(err)
@@ -384,64 +649,16 @@ func (l *Lob) VerifyAddress(addressLine1, addressLine2, city, state, zipCode str
 	return &verifyAddressResponse, nil
 }
 
-func (l *Lob) VerifyAddressBySendingTestPostcard(addressLine1, addressLine2, city, state, zipCode string) (*LobVerifyAddressResponse, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	_ = writer.WriteField("front", fmt.Sprintf("<body>Hello!</body>"))
-	_ = writer.WriteField("back", fmt.Sprintf("<body>Goodbye!</body>"))
-
-	_ = writer.WriteField("from[name]", "Recurse Center")
-	_ = writer.WriteField("from[address_line1]", RecurseAddressLine1)
-	_ = writer.WriteField("from[address_line2]", RecurseAddressLine1)
-	_ = writer.WriteField("from[address_city]", RecurseAddressCity)
-	_ = writer.WriteField("from[address_state]", RecurseAddressState)
-	_ = writer.WriteField("from[address_zip]", RecurseAddressZip)
-
-	_ = writer.WriteField("to[name]", "Your name")
-	_ = writer.WriteField("to[address_line1]", addressLine1)
-	_ = writer.WriteField("to[address_line2]", addressLine2)
-	_ = writer.WriteField("to[address_city]", city)
-	_ = writer.WriteField("to[address_state]", state)
-	_ = writer.WriteField("to[address_zip]", zipCode)
-
-	_ = writer.WriteField("metadata[mode]", "ver")
-
-	writer.Close()
-
-	postPostcardUrl := fmt.Sprintf("%s/%s/%s", lobAddressBaseUrl, lobVersion, postcardsRoute)
-	req, err := http.NewRequest("POST", postPostcardUrl, body)
-	if err != nil {
-		return nil, err
+// decodeLobError reads a Lob error body from a non-2xx response.
+func decodeLobError(resp *http.Response) *LobError {
+	var lobErrorResponse LobErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lobErrorResponse); err != nil {
+		return &LobError{StatusCode: resp.StatusCode, Err: err}
 	}
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-	setAuthHeaders(req, false)
-
-	resp, err := l.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 200 {
-		// update to read from actual response
-		var createPostcardResponse LobCreatePostcardResponse
-		if err := json.NewDecoder(resp.Body).Decode(&createPostcardResponse); err != nil {
-			return nil, err
-		}
-		return &LobVerifyAddressResponse{Deliverability: Deliverable}, nil
-	} else if resp.StatusCode == 422 {
-		return &LobVerifyAddressResponse{Deliverability: Undeliverable}, nil
-	} else {
-		var lobErrorResponse LobErrorResponse
-		if err := json.NewDecoder(resp.Body).Decode(&lobErrorResponse); err != nil {
-			return nil, err
-		}
-
-		log.Printf("STATUS CODE %d, Response %v\n", resp.StatusCode, lobErrorResponse)
-		return nil, errors.New("err_verifying_address")
+	if lobErrorResponse.LobError.StatusCode == 0 {
+		lobErrorResponse.LobError.StatusCode = resp.StatusCode
 	}
+	return &lobErrorResponse.LobError
 }
 
 func setAuthHeaders(req *http.Request, isLive bool) {
@@ -0,0 +1,408 @@
+package lob_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+	"github.com/rc-postcard/rc-postcard/lob/lobtest"
+)
+
+var testFromAddress = lob.LobAddress{
+	Name:         "Sender",
+	AddressLine1: "397 Bridge Street",
+	AddressLine2: "5th Floor",
+	AddressCity:  "Brooklyn",
+	AddressState: "NY",
+	AddressZip:   "11201",
+}
+
+func newTestLob(t *testing.T) (*lob.Lob, *lobtest.Server) {
+	t.Setenv("LOB_API_TEST_KEY", "test_key")
+	t.Setenv("LOB_API_LIVE_KEY", "live_key")
+	server := lobtest.NewServer()
+	t.Cleanup(server.Close)
+	return lob.NewLobWithBaseUrl(server.Client(), server.URL), server
+}
+
+func TestCreateAndGetPostcards(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	for _, toRcId := range []int{1, 2, 1} {
+		_, lobError := lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", false, 3, toRcId, "digital_send", "", time.Time{}, "")
+		if lobError != nil {
+			t.Fatalf("CreatePostCard: %v", lobError)
+		}
+	}
+
+	postcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{Metadata: map[string]string{"to_rc_id": "1"}}, false)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(postcards.Data) != 2 {
+		t.Fatalf("got %d postcards for recipient 1, want 2", len(postcards.Data))
+	}
+	for _, postcard := range postcards.Data {
+		if postcard.Metadata.ToRcId != "1" || postcard.Metadata.FromRcId != "3" || postcard.Metadata.Mode != "digital_send" {
+			t.Errorf("unexpected metadata %+v", postcard.Metadata)
+		}
+	}
+
+	// live and test keys are separate environments
+	livePostcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{Metadata: map[string]string{"to_rc_id": "1"}}, true)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(livePostcards.Data) != 0 {
+		t.Errorf("got %d live postcards, want 0", len(livePostcards.Data))
+	}
+	if got := len(server.Postcards("test_key")); got != 3 {
+		t.Errorf("server has %d test postcards, want 3", got)
+	}
+}
+
+func TestGetPostcardsPagination(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	server.Now = func() time.Time { return now }
+	for i := 0; i < 25; i++ {
+		if _, lobError := lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", false, 3, 1, "digital_send", "", time.Time{}, ""); lobError != nil {
+			t.Fatalf("CreatePostCard: %v", lobError)
+		}
+		now = now.Add(24 * time.Hour)
+	}
+
+	first, err := lobClient.GetPostcards(lob.GetPostcardsParams{Limit: 10}, false)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(first.Data) != 10 || first.PreviousCursor() != "" || first.NextCursor() == "" {
+		t.Fatalf("first page has %d postcards, previous %q, next %q", len(first.Data), first.PreviousCursor(), first.NextCursor())
+	}
+
+	second, err := lobClient.GetPostcards(lob.GetPostcardsParams{Limit: 10, After: first.NextCursor()}, false)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(second.Data) != 10 || !second.Data[0].DateCreated.Before(first.Data[9].DateCreated) {
+		t.Fatalf("second page does not continue the first: %+v", second.Data)
+	}
+
+	back, err := lobClient.GetPostcards(lob.GetPostcardsParams{Limit: 10, Before: second.PreviousCursor()}, false)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(back.Data) != 10 || back.Data[0].Id != first.Data[0].Id {
+		t.Errorf("paging back did not return the first page")
+	}
+
+	// the first five days of March, exclusive at both ends
+	inRange, err := lobClient.GetPostcards(lob.GetPostcardsParams{
+		DateCreatedAfter:  start,
+		DateCreatedBefore: start.AddDate(0, 0, 5),
+	}, false)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(inRange.Data) != 4 {
+		t.Errorf("got %d postcards in range, want 4", len(inRange.Data))
+	}
+
+	it := lob.NewPostcardIter(lobClient, lob.GetPostcardsParams{Limit: 10}, false)
+	seen := map[string]bool{}
+	for it.Next() {
+		seen[it.Postcard().Id] = true
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterating: %v", err)
+	}
+	if len(seen) != 25 {
+		t.Errorf("iterated over %d postcards, want 25", len(seen))
+	}
+}
+
+func TestCreatePostCardSendDate(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	server.Now = func() time.Time { return now }
+
+	sendDate := now.AddDate(0, 0, 30)
+	resp, lobError := lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", true, 1, 2, "physical_send", "", sendDate, "")
+	if lobError != nil {
+		t.Fatalf("CreatePostCard: %v", lobError)
+	}
+	if !resp.SendDate.Equal(sendDate) || resp.ExpectedDeliveryDate != "2022-04-04" {
+		t.Errorf("got send date %v and expected delivery %s", resp.SendDate, resp.ExpectedDeliveryDate)
+	}
+
+	for _, sendDate := range []time.Time{now.Add(-time.Hour), now.Add(lob.MaxSendDateHorizon + time.Hour)} {
+		if _, lobError := lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", true, 1, 2, "physical_send", "", sendDate, ""); lobError == nil || lobError.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("send date %v: expected a validation error, got %v", sendDate, lobError)
+		}
+	}
+}
+
+func TestCreatePostCardIdempotencyKey(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		resp, lobError := lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", true, 1, 2, "physical_send", "", time.Time{}, "postcard-7")
+		if lobError != nil {
+			t.Fatalf("CreatePostCard: %v", lobError)
+		}
+		ids = append(ids, resp.Id)
+	}
+	if ids[0] != ids[1] || len(server.Postcards("live_key")) != 1 {
+		t.Errorf("repeating an idempotency key created postcards %v", ids)
+	}
+
+	postcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{Metadata: map[string]string{"idempotency_key": "postcard-7"}}, true)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(postcards.Data) != 1 || postcards.Data[0].Id != ids[0] {
+		t.Errorf("looking the postcard up by its idempotency key got %+v", postcards.Data)
+	}
+}
+
+func TestCancelPostcard(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	server.Now = func() time.Time { return now }
+
+	resp, lobError := lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", true, 1, 2, "physical_send", "", now.Add(10*time.Minute), "")
+	if lobError != nil {
+		t.Fatalf("CreatePostCard: %v", lobError)
+	}
+	if err := lobClient.CancelPostcard(resp.Id, true); err != nil {
+		t.Fatalf("CancelPostcard: %v", err)
+	}
+	postcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{}, true)
+	if err != nil {
+		t.Fatalf("GetPostcards: %v", err)
+	}
+	if len(postcards.Data) != 0 {
+		t.Errorf("cancelled postcard is still listed")
+	}
+
+	// past its send date the postcard is in production
+	resp, lobError = lobClient.CreatePostCard(testFromAddress, testFromAddress, []byte("front"), "back", true, 1, 2, "physical_send", "", now.Add(10*time.Minute), "")
+	if lobError != nil {
+		t.Fatalf("CreatePostCard: %v", lobError)
+	}
+	now = now.Add(time.Hour)
+	err = lobClient.CancelPostcard(resp.Id, true)
+	if lobError, ok := err.(*lob.LobError); !ok || lobError.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a validation error cancelling a mailed postcard, got %v", err)
+	}
+}
+
+func TestCreatePostCardValidationError(t *testing.T) {
+	lobClient, _ := newTestLob(t)
+
+	toAddress := testFromAddress
+	toAddress.AddressZip = "not a zip"
+	_, lobError := lobClient.CreatePostCard(testFromAddress, toAddress, []byte("front"), "back", false, 1, 2, "digital_send", "", time.Time{}, "")
+	if lobError == nil {
+		t.Fatal("expected an error for a malformed zip code")
+	}
+	if lobError.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d, want %d", lobError.StatusCode, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestCreateLetter(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	pdf := []byte("%PDF-1.4 letter")
+	resp, lobError := lobClient.CreateLetter(testFromAddress, testFromAddress, lob.LetterFile{PDF: pdf},
+		lob.LetterOptions{Color: true, ReturnEnvelope: true, PerforatedPage: 1}, false, 1, 2, "digital_send", "")
+	if lobError != nil {
+		t.Fatalf("CreateLetter: %v", lobError)
+	}
+	letters := server.Letters("test_key")
+	if len(letters) != 1 {
+		t.Fatalf("server has %d letters, want 1", len(letters))
+	}
+	if string(letters[0].File) != string(pdf) || !letters[0].Color || letters[0].DoubleSided || !letters[0].ReturnEnvelope {
+		t.Errorf("unexpected letter %+v", letters[0])
+	}
+
+	letter, err := lobClient.GetLetter(resp.Id, false)
+	if err != nil {
+		t.Fatalf("GetLetter: %v", err)
+	}
+	if letter.Url != resp.Url || letter.Metadata.ToRcId != "2" {
+		t.Errorf("unexpected letter %+v", letter)
+	}
+
+	// a return envelope needs a perforated page to tear off
+	_, lobError = lobClient.CreateLetter(testFromAddress, testFromAddress, lob.LetterFile{HTML: "<p>hi</p>"},
+		lob.LetterOptions{ReturnEnvelope: true}, false, 1, 2, "digital_send", "")
+	if lobError == nil || lobError.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a validation error, got %v", lobError)
+	}
+}
+
+func TestCreateLetterIdempotencyKey(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		resp, lobError := lobClient.CreateLetter(testFromAddress, testFromAddress, lob.LetterFile{HTML: "<p>hi</p>"}, lob.LetterOptions{}, true, 1, 2, "physical_send", "letter-7")
+		if lobError != nil {
+			t.Fatalf("CreateLetter: %v", lobError)
+		}
+		ids = append(ids, resp.Id)
+	}
+	if ids[0] != ids[1] || len(server.Letters("live_key")) != 1 {
+		t.Errorf("repeating an idempotency key created letters %v", ids)
+	}
+
+	letters, err := lobClient.GetLetters(lob.GetLettersParams{Metadata: map[string]string{"idempotency_key": "letter-7"}}, true)
+	if err != nil {
+		t.Fatalf("GetLetters: %v", err)
+	}
+	if len(letters.Data) != 1 || letters.Data[0].Id != ids[0] {
+		t.Errorf("looking the letter up by its idempotency key got %+v", letters.Data)
+	}
+}
+
+func TestAddressLifecycle(t *testing.T) {
+	lobClient, _ := newTestLob(t)
+
+	created, err := lobClient.CreateAddress("Jane", "1 Main St", "", "Springfield", "IL", "62701", "", 42, true)
+	if err != nil {
+		t.Fatalf("CreateAddress: %v", err)
+	}
+
+	address, err := lobClient.GetAddress(created.AddressId, true)
+	if err != nil {
+		t.Fatalf("GetAddress: %v", err)
+	}
+	if address.Name != "Jane" || address.AddressCity != "Springfield" || address.AddressCountry != "US" {
+		t.Errorf("unexpected address %+v", address)
+	}
+
+	if err := lobClient.DeleteAddress(created.AddressId, true); err != nil {
+		t.Fatalf("DeleteAddress: %v", err)
+	}
+	if _, err := lobClient.GetAddress(created.AddressId, true); err == nil {
+		t.Error("expected an error getting a deleted address")
+	}
+
+	if _, err := lobClient.CreateAddress("Jane", "", "", "Springfield", "IL", "62701", "", 42, true); err == nil {
+		t.Error("expected an error creating an address without address_line1")
+	}
+}
+
+func TestCreateContactAddress(t *testing.T) {
+	lobClient, server := newTestLob(t)
+
+	created, err := lobClient.CreateContactAddress("Mom", "1 Main St", "", "Springfield", "IL", "62701", "", 42, true)
+	if err != nil {
+		t.Fatalf("CreateContactAddress: %v", err)
+	}
+
+	addresses := server.Addresses("live_key")
+	if len(addresses) != 1 || addresses[0].AddressId != created.AddressId {
+		t.Fatalf("unexpected addresses %+v", addresses)
+	}
+	if metadata := addresses[0].Metadata; metadata["owner_rc_id"] != "42" || metadata["rc_id"] != "" {
+		t.Errorf("expected owner metadata only, got %v", metadata)
+	}
+}
+
+func TestVerifyAddress(t *testing.T) {
+	lobClient, _ := newTestLob(t)
+
+	for _, deliverability := range []string{lob.Deliverable, lob.Undeliverable} {
+		response, err := lobClient.VerifyAddress(deliverability, "", "", "", "11111")
+		if err != nil {
+			t.Fatalf("VerifyAddress: %v", err)
+		}
+		if response.Deliverability != deliverability {
+			t.Errorf("got deliverability %q, want %q", response.Deliverability, deliverability)
+		}
+	}
+
+	response, err := lobClient.VerifyAddress(lob.DeliverableMissingUnit, "", "brooklyn", "ny", "11201-1234")
+	if err != nil {
+		t.Fatalf("VerifyAddress: %v", err)
+	}
+	if footnotes := response.DeliverabilityAnalysis.DpvFootnotes; len(footnotes) != 2 || footnotes[1] != "N1" {
+		t.Errorf("unexpected DPV footnotes %v", footnotes)
+	}
+	suggested := response.SuggestedAddress()
+	if suggested.AddressCity != "BROOKLYN" || suggested.AddressState != "NY" || suggested.AddressZip != "11201-1234" {
+		t.Errorf("unexpected suggested address %+v", suggested)
+	}
+}
+
+func TestVerifyIntlAddress(t *testing.T) {
+	lobClient, _ := newTestLob(t)
+
+	response, err := lobClient.VerifyIntlAddress("10 downing st", "", "london", "", "sw1a 2aa", "GB")
+	if err != nil {
+		t.Fatalf("VerifyIntlAddress: %v", err)
+	}
+	if response.Deliverability != lob.IntlDeliverable {
+		t.Errorf("got deliverability %q, want %q", response.Deliverability, lob.IntlDeliverable)
+	}
+	suggested := response.SuggestedAddress()
+	if suggested.AddressLine1 != "10 DOWNING ST" || suggested.AddressZip != "SW1A 2AA" || suggested.AddressCountry != "GB" {
+		t.Errorf("unexpected suggested address %+v", suggested)
+	}
+
+	if _, err := lobClient.VerifyIntlAddress("10 downing st", "", "london", "", "", "US"); err == nil {
+		t.Error("expected US addresses to be rejected")
+	}
+
+	for _, country := range []string{"GB", "de", "UNITED KINGDOM"} {
+		if !lob.IsInternational(country) {
+			t.Errorf("IsInternational(%q) = false", country)
+		}
+	}
+	for _, country := range []string{"", "US", "UNITED STATES"} {
+		if lob.IsInternational(country) {
+			t.Errorf("IsInternational(%q) = true", country)
+		}
+	}
+}
+
+func TestConstructWebhookEvent(t *testing.T) {
+	body := []byte(`{"id":"evt_1","reference_id":"psc_1","date_created":"2022-03-01T12:00:00Z","event_type":{"id":"postcard.in_transit","resource":"postcards"},"body":{"id":"psc_1"}}`)
+	now := time.Date(2022, 3, 1, 12, 1, 0, 0, time.UTC)
+	timestamp := strconv.FormatInt(now.UnixMilli(), 10)
+	signature := lob.SignWebhook("secret", timestamp, body)
+
+	event, err := lob.ConstructWebhookEvent(body, signature, timestamp, "secret", now)
+	if err != nil {
+		t.Fatalf("ConstructWebhookEvent: %v", err)
+	}
+	if event.Id != "evt_1" || event.ReferenceId != "psc_1" || event.EventType.Id != lob.EventPostcardInTransit {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if _, err := lob.ConstructWebhookEvent(body, signature, timestamp, "other secret", now); err != lob.ErrInvalidSignature {
+		t.Errorf("wrong secret: got %v, want %v", err, lob.ErrInvalidSignature)
+	}
+	tampered := append([]byte(nil), body...)
+	tampered[10] = '2'
+	if _, err := lob.ConstructWebhookEvent(tampered, signature, timestamp, "secret", now); err != lob.ErrInvalidSignature {
+		t.Errorf("tampered body: got %v, want %v", err, lob.ErrInvalidSignature)
+	}
+	if _, err := lob.ConstructWebhookEvent(body, signature, timestamp, "secret", now.Add(time.Hour)); err != lob.ErrStaleSignature {
+		t.Errorf("replayed delivery: got %v, want %v", err, lob.ErrStaleSignature)
+	}
+	if _, err := lob.ConstructWebhookEvent(body, "", "", "secret", now); err != lob.ErrMissingSignature {
+		t.Errorf("unsigned delivery: got %v, want %v", err, lob.ErrMissingSignature)
+	}
+}
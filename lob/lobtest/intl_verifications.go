@@ -0,0 +1,87 @@
+package lobtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// intlDeliverabilities are the magic primary_line values the fake answers
+// intl_verifications with, like deliverabilities for us_verifications.
+var intlDeliverabilities = []string{
+	lob.IntlDeliverable,
+	lob.IntlDeliverableMissingInfo,
+	lob.IntlUndeliverable,
+	lob.IntlNoMatch,
+}
+
+func (s *Server) serveIntlVerifications(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKey(r); !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var verifyAddressRequest lob.LobIntlVerifyAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&verifyAddressRequest); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", err.Error())
+		return
+	}
+	if verifyAddressRequest.PrimaryLine == "" {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "primary_line is required")
+		return
+	}
+	if len(verifyAddressRequest.Country) != 2 {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "country must be a 2 letter country short-name code (ISO 3166)")
+		return
+	}
+	if !lob.IsInternational(verifyAddressRequest.Country) {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "country must not be US, use us_verifications instead")
+		return
+	}
+
+	deliverability := lob.IntlDeliverable
+	for _, d := range intlDeliverabilities {
+		if strings.EqualFold(verifyAddressRequest.PrimaryLine, d) {
+			deliverability = d
+		}
+	}
+	status := map[string]string{
+		lob.IntlDeliverable:            "LV4",
+		lob.IntlDeliverableMissingInfo: "LV2",
+		lob.IntlUndeliverable:          "LV1",
+		lob.IntlNoMatch:                "LF",
+	}[deliverability]
+
+	s.mu.Lock()
+	id := s.newId("intl_ver")
+	s.mu.Unlock()
+
+	primaryLine := strings.ToUpper(strings.TrimSpace(verifyAddressRequest.PrimaryLine))
+	components := lob.LobIntlAddressComponents{
+		City:       strings.ToUpper(verifyAddressRequest.City),
+		State:      strings.ToUpper(verifyAddressRequest.State),
+		PostalCode: strings.ToUpper(verifyAddressRequest.PostalCode),
+	}
+	if fields := strings.Fields(primaryLine); len(fields) > 1 {
+		components.PrimaryNumber = fields[0]
+		components.StreetName = strings.Join(fields[1:], " ")
+	}
+
+	writeJSON(w, http.StatusOK, lob.LobIntlVerifyAddressResponse{
+		Id:             id,
+		PrimaryLine:    primaryLine,
+		SecondaryLine:  strings.ToUpper(verifyAddressRequest.SecondaryLine),
+		LastLine:       strings.Join(strings.Fields(components.City+" "+components.State+" "+components.PostalCode), " "),
+		Country:        strings.ToUpper(verifyAddressRequest.Country),
+		Coverage:       "SUBBUILDING",
+		Deliverability: deliverability,
+		Status:         status,
+		Components:     components,
+	})
+}
@@ -0,0 +1,218 @@
+package lobtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+type Letter struct {
+	Id                   string            `json:"id"`
+	Object               string            `json:"object"`
+	Url                  string            `json:"url"`
+	To                   lob.LobAddress    `json:"to"`
+	From                 lob.LobAddress    `json:"from"`
+	Metadata             map[string]string `json:"metadata"`
+	Color                bool              `json:"color"`
+	DoubleSided          bool              `json:"double_sided"`
+	AddressPlacement     string            `json:"address_placement"`
+	ReturnEnvelope       bool              `json:"return_envelope"`
+	PerforatedPage       int               `json:"perforated_page,omitempty"`
+	DateCreated          time.Time         `json:"date_created"`
+	SendDate             time.Time         `json:"send_date"`
+	ExpectedDeliveryDate string            `json:"expected_delivery_date"`
+
+	// File holds what was uploaded, for assertions in tests.
+	File []byte `json:"-"`
+}
+
+// Letters returns the letters created with apiKey, oldest first.
+func (s *Server) Letters(apiKey string) []*Letter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Letter(nil), s.account(apiKey).letters...)
+}
+
+func (s *Server) serveLetters(w http.ResponseWriter, r *http.Request) {
+	key, ok := apiKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.createLetter(w, r, key)
+	case http.MethodGet:
+		s.listLetters(w, r, key)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func (s *Server) createLetter(w http.ResponseWriter, r *http.Request, key string) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", err.Error())
+		return
+	} else if err == http.ErrNotMultipart {
+		r.ParseForm()
+	}
+
+	var file []byte
+	if f, _, err := r.FormFile("file"); err == nil {
+		file, _ = ioutil.ReadAll(f)
+		f.Close()
+	} else {
+		file = []byte(r.FormValue("file"))
+	}
+	if len(file) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "file is required")
+		return
+	}
+
+	color, err := strconv.ParseBool(r.FormValue("color"))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "color is required and must be a boolean")
+		return
+	}
+	doubleSided := true
+	if r.FormValue("double_sided") != "" {
+		if doubleSided, err = strconv.ParseBool(r.FormValue("double_sided")); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "double_sided must be a boolean")
+			return
+		}
+	}
+	addressPlacement := lob.AddressPlacementTopFirstPage
+	if r.FormValue("address_placement") != "" {
+		addressPlacement = r.FormValue("address_placement")
+		if addressPlacement != lob.AddressPlacementTopFirstPage && addressPlacement != lob.AddressPlacementInsertBlankPage {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "address_placement must be one of [top_first_page, insert_blank_page]")
+			return
+		}
+	}
+	returnEnvelope := r.FormValue("return_envelope") == "true"
+	perforatedPage, _ := strconv.Atoi(r.FormValue("perforated_page"))
+	if returnEnvelope && perforatedPage < 1 {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "perforated_page is required when return_envelope is true")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.account(key)
+
+	// like Lob, answer a repeated Idempotency-Key with the original letter
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if letter, ok := a.idempotentLetters[idempotencyKey]; ok {
+		writeJSON(w, http.StatusOK, letter)
+		return
+	}
+
+	to, statusCode, message := s.resolveAddress(a, r, "to")
+	if message != "" {
+		writeError(w, statusCode, "invalid", message)
+		return
+	}
+	from, statusCode, message := s.resolveAddress(a, r, "from")
+	if message != "" {
+		writeError(w, statusCode, "invalid", message)
+		return
+	}
+
+	metadata := map[string]string{}
+	for field, values := range r.Form {
+		if strings.HasPrefix(field, "metadata[") && strings.HasSuffix(field, "]") {
+			metadata[strings.TrimSuffix(strings.TrimPrefix(field, "metadata["), "]")] = values[0]
+		}
+	}
+
+	now := s.Now().UTC()
+	id := s.newId("ltr")
+	letter := &Letter{
+		Id:                   id,
+		Object:               "letter",
+		Url:                  fmt.Sprintf("%s/rendered/%s.pdf", s.URL, id),
+		To:                   to,
+		From:                 from,
+		Metadata:             metadata,
+		Color:                color,
+		DoubleSided:          doubleSided,
+		AddressPlacement:     addressPlacement,
+		ReturnEnvelope:       returnEnvelope,
+		PerforatedPage:       perforatedPage,
+		DateCreated:          now,
+		SendDate:             now,
+		ExpectedDeliveryDate: now.AddDate(0, 0, 5).Format("2006-01-02"),
+		File:                 file,
+	}
+	a.letters = append(a.letters, letter)
+	if idempotencyKey != "" {
+		a.idempotentLetters[idempotencyKey] = letter
+	}
+
+	writeJSON(w, http.StatusOK, letter)
+}
+
+// listLetters lists letters newest first. Unlike listPostcards, it only
+// supports limit and metadata filters.
+func (s *Server) listLetters(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+
+	limit := DefaultListLimit
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "limit must be between 1 and 100")
+			return
+		}
+	}
+
+	metadata := map[string]string{}
+	for field, values := range query {
+		if strings.HasPrefix(field, "metadata[") && strings.HasSuffix(field, "]") {
+			metadata[strings.TrimSuffix(strings.TrimPrefix(field, "metadata["), "]")] = values[0]
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page := []*Letter{}
+	letters := s.account(key).letters
+	for i := len(letters) - 1; i >= 0 && len(page) < limit; i-- {
+		if matchesMetadata(letters[i].Metadata, metadata) {
+			page = append(page, letters[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, listResponse{Data: page, Object: "list", Count: len(page)})
+}
+
+func (s *Server) serveLetter(w http.ResponseWriter, r *http.Request) {
+	key, ok := apiKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/letters/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, letter := range s.account(key).letters {
+		if letter.Id == id {
+			writeJSON(w, http.StatusOK, letter)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "not_found", "letter not found")
+}
@@ -0,0 +1,764 @@
+// Package lobtest runs an in-process stand-in for the parts of the Lob API
+// used by rc-postcard, so handlers can be exercised end to end without
+// talking to api.lob.com.
+//
+// Each API key gets its own set of postcards, letters and addresses, like Lob's
+// separate test and live environments.
+package lobtest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+// DefaultListLimit is the page size Lob uses when no limit is given.
+const DefaultListLimit = 10
+
+type Postcard struct {
+	Id                   string            `json:"id"`
+	Object               string            `json:"object"`
+	Url                  string            `json:"url"`
+	Size                 string            `json:"size"`
+	To                   lob.LobAddress    `json:"to"`
+	From                 lob.LobAddress    `json:"from"`
+	Metadata             map[string]string `json:"metadata"`
+	DateCreated          time.Time         `json:"date_created"`
+	SendDate             time.Time         `json:"send_date"`
+	ExpectedDeliveryDate string            `json:"expected_delivery_date"`
+	Deleted              bool              `json:"deleted,omitempty"`
+
+	// Front and Back hold what was uploaded, for assertions in tests.
+	Front []byte `json:"-"`
+	Back  string `json:"-"`
+}
+
+type Address struct {
+	lob.LobAddress
+	Object   string            `json:"object"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type account struct {
+	postcards []*Postcard
+	letters   []*Letter
+	addresses map[string]*Address
+	// idempotent and idempotentLetters hold the postcard or letter created
+	// for each Idempotency-Key.
+	idempotent        map[string]*Postcard
+	idempotentLetters map[string]*Letter
+}
+
+// Server is a fake Lob API. The embedded httptest.Server's URL can be passed
+// to lob.NewLobWithBaseUrl.
+type Server struct {
+	*httptest.Server
+
+	// Now returns the current time. Tests may replace it to control
+	// date_created and send_date.
+	Now func() time.Time
+
+	// AutocompleteAddresses are what us_autocompletions suggests from.
+	AutocompleteAddresses []lob.LobAutocompleteSuggestion
+
+	mu              sync.Mutex
+	accounts        map[string]*account
+	nextId          int
+	autocompletions int
+}
+
+// NewServer starts a fake Lob API. Callers should Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Now:                   time.Now,
+		AutocompleteAddresses: defaultAutocompleteAddresses,
+		accounts:              map[string]*account{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/postcards", s.servePostcards)
+	mux.HandleFunc("/v1/postcards/", s.servePostcard)
+	mux.HandleFunc("/v1/letters", s.serveLetters)
+	mux.HandleFunc("/v1/letters/", s.serveLetter)
+	mux.HandleFunc("/v1/addresses", s.serveAddresses)
+	mux.HandleFunc("/v1/addresses/", s.serveAddress)
+	mux.HandleFunc("/v1/us_verifications", s.serveUsVerifications)
+	mux.HandleFunc("/v1/intl_verifications", s.serveIntlVerifications)
+	mux.HandleFunc("/v1/us_autocompletions", s.serveUsAutocompletions)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Postcards returns the postcards created with apiKey, oldest first.
+func (s *Server) Postcards(apiKey string) []*Postcard {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Postcard(nil), s.account(apiKey).postcards...)
+}
+
+// Addresses returns the addresses created with apiKey that have not been deleted.
+func (s *Server) Addresses(apiKey string) []*Address {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addresses []*Address
+	for _, address := range s.account(apiKey).addresses {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].AddressId < addresses[j].AddressId })
+	return addresses
+}
+
+// Autocompletions returns how many us_autocompletions requests were made.
+func (s *Server) Autocompletions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.autocompletions
+}
+
+// account returns the data for apiKey. s.mu must be held.
+func (s *Server) account(apiKey string) *account {
+	a, ok := s.accounts[apiKey]
+	if !ok {
+		a = &account{addresses: map[string]*Address{}, idempotent: map[string]*Postcard{}, idempotentLetters: map[string]*Letter{}}
+		s.accounts[apiKey] = a
+	}
+	return a
+}
+
+// newId returns a fresh Lob style id. s.mu must be held.
+func (s *Server) newId(prefix string) string {
+	s.nextId++
+	return fmt.Sprintf("%s_%016x", prefix, s.nextId)
+}
+
+// apiKey extracts the key from the Basic auth header Lob clients send.
+func apiKey(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Basic ") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authHeader, "Basic "))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(string(decoded), ":"), true
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeJSON(w, statusCode, lob.LobErrorResponse{LobError: lob.LobError{
+		Message:    message,
+		StatusCode: statusCode,
+		Code:       code,
+	}})
+}
+
+func (s *Server) servePostcards(w http.ResponseWriter, r *http.Request) {
+	key, ok := apiKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		s.createPostcard(w, r, key)
+	case http.MethodGet:
+		s.listPostcards(w, r, key)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func (s *Server) createPostcard(w http.ResponseWriter, r *http.Request, key string) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", err.Error())
+		return
+	} else if err == http.ErrNotMultipart {
+		r.ParseForm()
+	}
+
+	var front []byte
+	if file, _, err := r.FormFile("front"); err == nil {
+		front, _ = ioutil.ReadAll(file)
+		file.Close()
+	} else {
+		front = []byte(r.FormValue("front"))
+	}
+	back := r.FormValue("back")
+	if len(front) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "front is required")
+		return
+	}
+	if back == "" {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "back is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.account(key)
+
+	// like Lob, answer a repeated Idempotency-Key with the original postcard
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if postcard, ok := a.idempotent[idempotencyKey]; ok {
+		writeJSON(w, http.StatusOK, postcard)
+		return
+	}
+
+	to, statusCode, message := s.resolveAddress(a, r, "to")
+	if message != "" {
+		writeError(w, statusCode, "invalid", message)
+		return
+	}
+	from, statusCode, message := s.resolveAddress(a, r, "from")
+	if message != "" {
+		writeError(w, statusCode, "invalid", message)
+		return
+	}
+
+	metadata := map[string]string{}
+	for field, values := range r.Form {
+		if strings.HasPrefix(field, "metadata[") && strings.HasSuffix(field, "]") {
+			metadata[strings.TrimSuffix(strings.TrimPrefix(field, "metadata["), "]")] = values[0]
+		}
+	}
+
+	size := lob.Size4x6
+	if r.FormValue("size") != "" {
+		size = r.FormValue("size")
+		if _, ok := lob.PostcardSpecs[size]; !ok {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "size must be one of [4x6, 6x9, 6x11]")
+			return
+		}
+	}
+
+	now := s.Now().UTC()
+	sendDate := now
+	if r.FormValue("send_date") != "" {
+		var err error
+		if sendDate, err = time.Parse(time.RFC3339, r.FormValue("send_date")); err != nil {
+			if sendDate, err = time.Parse("2006-01-02", r.FormValue("send_date")); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, "invalid", "send_date must be a date or date-time")
+				return
+			}
+		}
+		if sendDate.Before(now) || sendDate.Sub(now) > lob.MaxSendDateHorizon {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "send_date must be in the future and within 180 days")
+			return
+		}
+		sendDate = sendDate.UTC()
+	}
+
+	id := s.newId("psc")
+	postcard := &Postcard{
+		Id:                   id,
+		Object:               "postcard",
+		Url:                  fmt.Sprintf("%s/rendered/%s.pdf", s.URL, id),
+		Size:                 size,
+		To:                   to,
+		From:                 from,
+		Metadata:             metadata,
+		DateCreated:          now,
+		SendDate:             sendDate,
+		ExpectedDeliveryDate: sendDate.AddDate(0, 0, 4).Format("2006-01-02"),
+		Front:                front,
+		Back:                 back,
+	}
+	a.postcards = append(a.postcards, postcard)
+	if idempotencyKey != "" {
+		a.idempotent[idempotencyKey] = postcard
+	}
+
+	writeJSON(w, http.StatusOK, postcard)
+}
+
+// resolveAddress reads either an address id or inline address fields for
+// prefix ("to" or "from") from the form. On failure it returns a status code
+// and a non-empty message.
+func (s *Server) resolveAddress(a *account, r *http.Request, prefix string) (lob.LobAddress, int, string) {
+	if id := r.FormValue(prefix); id != "" {
+		address, ok := a.addresses[id]
+		if !ok {
+			return lob.LobAddress{}, http.StatusNotFound, fmt.Sprintf("%s address not found", prefix)
+		}
+		return address.LobAddress, 0, ""
+	}
+
+	address := lob.LobAddress{
+		Name:           r.FormValue(prefix + "[name]"),
+		AddressLine1:   r.FormValue(prefix + "[address_line1]"),
+		AddressLine2:   r.FormValue(prefix + "[address_line2]"),
+		AddressCity:    r.FormValue(prefix + "[address_city]"),
+		AddressState:   r.FormValue(prefix + "[address_state]"),
+		AddressZip:     r.FormValue(prefix + "[address_zip]"),
+		AddressCountry: r.FormValue(prefix + "[address_country]"),
+	}
+	if message := validateAddress(address); message != "" {
+		return lob.LobAddress{}, http.StatusUnprocessableEntity, fmt.Sprintf("%s.%s", prefix, message)
+	}
+	if address.AddressCountry == "" {
+		address.AddressCountry = "US"
+	}
+	return address, 0, ""
+}
+
+var usZipRegexp = regexp.MustCompile(`^\d{5}(-\d{4})?$`)
+
+// validateAddress mirrors the 422 responses Lob gives for malformed
+// addresses. It returns an empty string if the address is acceptable.
+func validateAddress(address lob.LobAddress) string {
+	if address.Name == "" {
+		return "name is required"
+	}
+	if address.AddressLine1 == "" {
+		return "address_line1 is required"
+	}
+	if address.AddressCountry == "" || address.AddressCountry == "US" {
+		if address.AddressZip == "" && (address.AddressCity == "" || address.AddressState == "") {
+			return "address_zip is required, or both address_city and address_state"
+		}
+		if address.AddressZip != "" && !usZipRegexp.MatchString(address.AddressZip) {
+			return "address_zip must be in a valid zip or zip+4 format"
+		}
+	} else if address.AddressCity == "" {
+		return "address_city is required for international addresses"
+	}
+	return ""
+}
+
+type listResponse struct {
+	Data        interface{} `json:"data"`
+	Object      string      `json:"object"`
+	NextUrl     *string     `json:"next_url"`
+	PreviousUrl *string     `json:"previous_url"`
+	Count       int         `json:"count"`
+}
+
+func (s *Server) listPostcards(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+
+	limit := DefaultListLimit
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "limit must be between 1 and 100")
+			return
+		}
+	}
+	if query.Get("before") != "" && query.Get("after") != "" {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "before and after cannot both be set")
+		return
+	}
+
+	metadata := map[string]string{}
+	for field, values := range query {
+		if strings.HasPrefix(field, "metadata[") && strings.HasSuffix(field, "]") {
+			metadata[strings.TrimSuffix(strings.TrimPrefix(field, "metadata["), "]")] = values[0]
+		}
+	}
+
+	dateCreated, err := parseDateFilter(query.Get("date_created"))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "date_created "+err.Error())
+		return
+	}
+	sendDate, err := parseDateFilter(query.Get("send_date"))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "send_date "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Lob lists newest first.
+	matched := []*Postcard{}
+	postcards := s.account(key).postcards
+	for i := len(postcards) - 1; i >= 0; i-- {
+		if !postcards[i].Deleted &&
+			matchesMetadata(postcards[i].Metadata, metadata) &&
+			dateCreated.matches(postcards[i].DateCreated) &&
+			sendDate.matches(postcards[i].SendDate) {
+			matched = append(matched, postcards[i])
+		}
+	}
+
+	// Cursors are the id of the postcard the page starts after or ends
+	// before. Real Lob cursors are opaque.
+	start, end := 0, len(matched)
+	if after := query.Get("after"); after != "" {
+		start = indexOf(matched, after) + 1
+		if start == 0 {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "after is not a valid cursor")
+			return
+		}
+	}
+	if before := query.Get("before"); before != "" {
+		end = indexOf(matched, before)
+		if end == -1 {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "before is not a valid cursor")
+			return
+		}
+		if end-limit > start {
+			start = end - limit
+		}
+	}
+	if end-start > limit {
+		end = start + limit
+	}
+	page := matched[start:end]
+
+	resp := listResponse{Data: page, Object: "list", Count: len(page)}
+	if len(page) > 0 && end < len(matched) {
+		resp.NextUrl = s.pageUrl(r, "after", page[len(page)-1].Id)
+	}
+	if len(page) > 0 && start > 0 {
+		resp.PreviousUrl = s.pageUrl(r, "before", page[0].Id)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func indexOf(postcards []*Postcard, id string) int {
+	for i, postcard := range postcards {
+		if postcard.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// pageUrl returns r's URL with the cursor replaced.
+func (s *Server) pageUrl(r *http.Request, cursor, id string) *string {
+	query := r.URL.Query()
+	query.Del("before")
+	query.Del("after")
+	query.Set(cursor, id)
+	pageUrl := fmt.Sprintf("%s%s?%s", s.URL, r.URL.Path, query.Encode())
+	return &pageUrl
+}
+
+// dateFilter is a range like {"gt": "2022-03-01", "lte": "2022-03-31T12:00:00Z"}.
+type dateFilter map[string]time.Time
+
+func parseDateFilter(s string) (dateFilter, error) {
+	filter := dateFilter{}
+	if s == "" {
+		return filter, nil
+	}
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("must be an object like {\"gt\": \"2022-03-01\"}")
+	}
+	for op, value := range raw {
+		if op != "gt" && op != "gte" && op != "lt" && op != "lte" {
+			return nil, fmt.Errorf("has unknown operator %s", op)
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", value); err != nil {
+				return nil, fmt.Errorf("has malformed date %s", value)
+			}
+		}
+		filter[op] = t
+	}
+	return filter, nil
+}
+
+func (f dateFilter) matches(t time.Time) bool {
+	for op, bound := range f {
+		switch {
+		case op == "gt" && !t.After(bound),
+			op == "gte" && t.Before(bound),
+			op == "lt" && !t.Before(bound),
+			op == "lte" && t.After(bound):
+			return false
+		}
+	}
+	return true
+}
+
+func matchesMetadata(metadata, filter map[string]string) bool {
+	for k, v := range filter {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) serveAddresses(w http.ResponseWriter, r *http.Request) {
+	key, ok := apiKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var createAddressRequest struct {
+		lob.LobAddress
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&createAddressRequest); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", err.Error())
+		return
+	}
+	if message := validateAddress(createAddressRequest.LobAddress); message != "" {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", message)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := &Address{
+		LobAddress: createAddressRequest.LobAddress,
+		Object:     "address",
+		Metadata:   createAddressRequest.Metadata,
+	}
+	address.AddressId = s.newId("adr")
+	if address.AddressCountry == "" {
+		address.AddressCountry = "US"
+	}
+	s.account(key).addresses[address.AddressId] = address
+
+	writeJSON(w, http.StatusOK, address)
+}
+
+func (s *Server) serveAddress(w http.ResponseWriter, r *http.Request) {
+	key, ok := apiKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/addresses/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.account(key)
+
+	address, ok := a.addresses[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "address not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, address)
+	case http.MethodDelete:
+		delete(a.addresses, id)
+		writeJSON(w, http.StatusOK, lob.LobDeleteAddressResponse{AddressId: id, Deleted: true})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func (s *Server) servePostcard(w http.ResponseWriter, r *http.Request) {
+	key, ok := apiKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/postcards/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var postcard *Postcard
+	for _, p := range s.account(key).postcards {
+		if p.Id == id && !p.Deleted {
+			postcard = p
+		}
+	}
+	if postcard == nil {
+		writeError(w, http.StatusNotFound, "not_found", "postcard not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, postcard)
+	case http.MethodDelete:
+		// like Lob, only postcards that haven't reached their send date
+		// can be cancelled
+		if !s.Now().Before(postcard.SendDate) {
+			writeError(w, http.StatusUnprocessableEntity, "invalid", "postcard has already been sent to production and cannot be cancelled")
+			return
+		}
+		postcard.Deleted = true
+		writeJSON(w, http.StatusOK, lob.LobCancelPostcardResponse{Id: id, Deleted: true})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// deliverabilities are the magic primary_line values Lob's test environment
+// answers with, see https://docs.lob.com/#tag/US-Verifications/Test-Env.
+var deliverabilities = []string{
+	lob.Deliverable,
+	lob.DeliverableUnnecessaryUnit,
+	lob.DeliverableIncorrectUnit,
+	lob.DeliverableMissingUnit,
+	lob.Undeliverable,
+}
+
+func (s *Server) serveUsVerifications(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKey(r); !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var verifyAddressRequest lob.LobVerifyAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&verifyAddressRequest); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", err.Error())
+		return
+	}
+	if verifyAddressRequest.PrimaryLine == "" {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "primary_line is required")
+		return
+	}
+	if verifyAddressRequest.ZipCode == "" && (verifyAddressRequest.City == "" || verifyAddressRequest.State == "") {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "zip_code is required, or both city and state")
+		return
+	}
+
+	deliverability := lob.Deliverable
+	for _, d := range deliverabilities {
+		if strings.EqualFold(verifyAddressRequest.PrimaryLine, d) {
+			deliverability = d
+		}
+	}
+
+	s.mu.Lock()
+	id := s.newId("us_ver")
+	s.mu.Unlock()
+
+	primaryLine := strings.ToUpper(strings.TrimSpace(verifyAddressRequest.PrimaryLine))
+	zipCode, zipCodePlus4 := verifyAddressRequest.ZipCode, ""
+	if i := strings.Index(zipCode, "-"); i >= 0 {
+		zipCode, zipCodePlus4 = zipCode[:i], zipCode[i+1:]
+	}
+	components := lob.LobAddressComponents{
+		City:         strings.ToUpper(verifyAddressRequest.City),
+		State:        strings.ToUpper(verifyAddressRequest.State),
+		ZipCode:      zipCode,
+		ZipCodePlus4: zipCodePlus4,
+		AddressType:  "residential",
+		RecordType:   "street",
+	}
+	if fields := strings.Fields(primaryLine); len(fields) > 1 {
+		components.PrimaryNumber = fields[0]
+		components.StreetName = strings.Join(fields[1:], " ")
+	}
+
+	analysis := lob.LobDeliverabilityAnalysis{DpvConfirmation: "Y", DpvCmra: "N", DpvVacant: "N", DpvActive: "Y"}
+	switch deliverability {
+	case lob.Deliverable:
+		analysis.DpvFootnotes = []string{"AA", "BB"}
+	case lob.DeliverableUnnecessaryUnit:
+		analysis.DpvConfirmation = "S"
+		analysis.DpvFootnotes = []string{"AA", "CC"}
+	case lob.DeliverableIncorrectUnit:
+		analysis.DpvConfirmation = "S"
+		analysis.DpvFootnotes = []string{"AA", "C1"}
+	case lob.DeliverableMissingUnit:
+		analysis.DpvConfirmation = "D"
+		analysis.DpvFootnotes = []string{"AA", "N1"}
+	case lob.Undeliverable:
+		analysis = lob.LobDeliverabilityAnalysis{DpvFootnotes: []string{"A1"}}
+	}
+
+	writeJSON(w, http.StatusOK, lob.LobVerifyAddressResponse{
+		Id:            id,
+		PrimaryLine:   primaryLine,
+		SecondaryLine: strings.ToUpper(verifyAddressRequest.SecondaryLine),
+		LastLine: strings.TrimSpace(fmt.Sprintf("%s %s %s",
+			components.City,
+			components.State,
+			verifyAddressRequest.ZipCode)),
+		Deliverability:         deliverability,
+		Components:             components,
+		DeliverabilityAnalysis: analysis,
+	})
+}
+
+// MaxAutocompleteSuggestions is the most suggestions Lob returns.
+const MaxAutocompleteSuggestions = 10
+
+var defaultAutocompleteAddresses = []lob.LobAutocompleteSuggestion{
+	{PrimaryLine: "397 BRIDGE ST", City: "BROOKLYN", State: "NY", ZipCode: "11201"},
+	{PrimaryLine: "185 BERRY ST", City: "SAN FRANCISCO", State: "CA", ZipCode: "94107"},
+	{PrimaryLine: "1 MAIN ST", City: "BROOKLYN", State: "NY", ZipCode: "11201"},
+	{PrimaryLine: "1 MAIN ST", City: "SPRINGFIELD", State: "IL", ZipCode: "62701"},
+	{PrimaryLine: "10 MAIN ST", City: "SPRINGFIELD", State: "IL", ZipCode: "62701"},
+}
+
+func (s *Server) serveUsAutocompletions(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiKey(r); !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Your API key is not valid.")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	var autocompleteRequest lob.LobAutocompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&autocompleteRequest); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", err.Error())
+		return
+	}
+	if autocompleteRequest.AddressPrefix == "" {
+		writeError(w, http.StatusUnprocessableEntity, "invalid", "address_prefix is required")
+		return
+	}
+
+	s.mu.Lock()
+	s.autocompletions++
+	id := s.newId("us_auto")
+	s.mu.Unlock()
+
+	suggestions := []lob.LobAutocompleteSuggestion{}
+	prefix := strings.ToUpper(autocompleteRequest.AddressPrefix)
+	for _, address := range s.AutocompleteAddresses {
+		if !strings.HasPrefix(address.PrimaryLine, prefix) ||
+			(autocompleteRequest.City != "" && !strings.EqualFold(address.City, autocompleteRequest.City)) ||
+			(autocompleteRequest.State != "" && !strings.EqualFold(address.State, autocompleteRequest.State)) ||
+			(autocompleteRequest.ZipCode != "" && address.ZipCode != autocompleteRequest.ZipCode) {
+			continue
+		}
+		suggestions = append(suggestions, address)
+		if len(suggestions) == MaxAutocompleteSuggestions {
+			break
+		}
+	}
+
+	writeJSON(w, http.StatusOK, lob.LobAutocompleteResponse{Id: id, Suggestions: suggestions})
+}
@@ -0,0 +1,156 @@
+package lob
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MaxListLimit is the largest page Lob will return.
+const MaxListLimit = 100
+
+// GetPostcardsParams filters and pages a postcard listing. Zero values are
+// left out of the request, so Lob's defaults apply.
+type GetPostcardsParams struct {
+	// Limit is the page size, at most MaxListLimit. Lob defaults to 10.
+	Limit int
+	// Before and After are cursors from a previous page. At most one may be set.
+	Before string
+	After  string
+
+	DateCreatedAfter  time.Time
+	DateCreatedBefore time.Time
+	SendDateAfter     time.Time
+	SendDateBefore    time.Time
+
+	// Metadata only matches postcards with all of these metadata values.
+	Metadata map[string]string
+}
+
+// dateFilter encodes a range the way Lob's list endpoints expect it, e.g.
+// {"gt":"2022-03-01T00:00:00Z"}. It returns "" for an unbounded range.
+func dateFilter(after, before time.Time) string {
+	filter := map[string]string{}
+	if !after.IsZero() {
+		filter["gt"] = after.UTC().Format(time.RFC3339)
+	}
+	if !before.IsZero() {
+		filter["lt"] = before.UTC().Format(time.RFC3339)
+	}
+	if len(filter) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(filter)
+	return string(encoded)
+}
+
+func (p GetPostcardsParams) encode() string {
+	values := url.Values{}
+	if p.Limit > 0 {
+		values.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Before != "" {
+		values.Set("before", p.Before)
+	}
+	if p.After != "" {
+		values.Set("after", p.After)
+	}
+	if filter := dateFilter(p.DateCreatedAfter, p.DateCreatedBefore); filter != "" {
+		values.Set("date_created", filter)
+	}
+	if filter := dateFilter(p.SendDateAfter, p.SendDateBefore); filter != "" {
+		values.Set("send_date", filter)
+	}
+	for k, v := range p.Metadata {
+		values.Set("metadata["+k+"]", v)
+	}
+	return values.Encode()
+}
+
+// cursorFrom extracts the named cursor from one of Lob's next_url or
+// previous_url links.
+func cursorFrom(link, name string) string {
+	if link == "" {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(name)
+}
+
+// NextCursor returns the After cursor for the next (older) page, or "" if
+// this is the last page.
+func (r *LobGetPostcardsResponse) NextCursor() string {
+	return cursorFrom(r.NextUrl, "after")
+}
+
+// PreviousCursor returns the Before cursor for the previous (newer) page, or
+// "" if this is the first page.
+func (r *LobGetPostcardsResponse) PreviousCursor() string {
+	return cursorFrom(r.PreviousUrl, "before")
+}
+
+// PostcardIter walks every postcard matching a listing, fetching pages as
+// needed:
+//
+//	it := lob.NewPostcardIter(lobClient, params, isLive)
+//	for it.Next() {
+//		postcard := it.Postcard()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type PostcardIter struct {
+	lobClient LobAPI
+	params    GetPostcardsParams
+	isLive    bool
+
+	page    []LobPostcard
+	index   int
+	done    bool
+	current *LobPostcard
+	err     error
+}
+
+func NewPostcardIter(lobClient LobAPI, params GetPostcardsParams, isLive bool) *PostcardIter {
+	if params.Limit == 0 {
+		params.Limit = MaxListLimit
+	}
+	return &PostcardIter{lobClient: lobClient, params: params, isLive: isLive, index: -1}
+}
+
+// Next advances to the next postcard. It returns false at the end or on error.
+func (it *PostcardIter) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.index++
+	for it.index >= len(it.page) {
+		if it.done {
+			it.current = nil
+			return false
+		}
+		resp, err := it.lobClient.GetPostcards(it.params, it.isLive)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page, it.index = resp.Data, 0
+		it.params.After, it.params.Before = resp.NextCursor(), ""
+		it.done = it.params.After == ""
+	}
+	it.current = &it.page[it.index]
+	return true
+}
+
+// Postcard returns the current postcard.
+func (it *PostcardIter) Postcard() *LobPostcard {
+	return it.current
+}
+
+// Err returns the error that stopped iteration, if any.
+func (it *PostcardIter) Err() error {
+	return it.err
+}
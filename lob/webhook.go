@@ -0,0 +1,101 @@
+package lob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers Lob signs webhook deliveries with.
+const (
+	SignatureHeader          = "Lob-Signature"
+	SignatureTimestampHeader = "Lob-Signature-Timestamp"
+)
+
+// WebhookTolerance is how old a signed delivery may be before it is
+// rejected as a possible replay.
+const WebhookTolerance = 5 * time.Minute
+
+// Postcard tracking event types.
+const (
+	EventPostcardInTransit            = "postcard.in_transit"
+	EventPostcardInLocalArea          = "postcard.in_local_area"
+	EventPostcardProcessedForDelivery = "postcard.processed_for_delivery"
+	EventPostcardReRouted             = "postcard.re-routed"
+	EventPostcardReturnedToSender     = "postcard.returned_to_sender"
+)
+
+var PostcardTrackingEvents = []string{
+	EventPostcardInTransit,
+	EventPostcardInLocalArea,
+	EventPostcardProcessedForDelivery,
+	EventPostcardReRouted,
+	EventPostcardReturnedToSender,
+}
+
+var (
+	ErrMissingSignature = errors.New("missing Lob-Signature or Lob-Signature-Timestamp header")
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	ErrStaleSignature   = errors.New("webhook timestamp is outside the tolerance")
+)
+
+// WebhookEvent is a webhook delivery. Body holds the object the event is
+// about, e.g. a postcard.
+type WebhookEvent struct {
+	Id          string          `json:"id"`
+	ReferenceId string          `json:"reference_id"`
+	DateCreated time.Time       `json:"date_created"`
+	Body        json.RawMessage `json:"body"`
+	EventType   struct {
+		Id       string `json:"id"`
+		Resource string `json:"resource"`
+	} `json:"event_type"`
+}
+
+// SignWebhook computes the signature Lob sends for body at timestamp: a hex
+// HMAC-SHA256 of the timestamp and body joined by a dot.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSignatureTimestamp accepts unix milliseconds or RFC 3339.
+func parseSignatureTimestamp(timestamp string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, timestamp)
+}
+
+// ConstructWebhookEvent verifies a delivery's signature headers against
+// secret and parses it.
+func ConstructWebhookEvent(body []byte, signature, timestamp, secret string, now time.Time) (*WebhookEvent, error) {
+	if signature == "" || timestamp == "" {
+		return nil, ErrMissingSignature
+	}
+	expected := SignWebhook(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return nil, ErrInvalidSignature
+	}
+
+	signedAt, err := parseSignatureTimestamp(timestamp)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if age := now.Sub(signedAt); age > WebhookTolerance || age < -WebhookTolerance {
+		return nil, ErrStaleSignature
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
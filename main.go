@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	lob "github.com/rc-postcard/rc-postcard/lob"
@@ -14,7 +15,7 @@ var client *http.Client = &http.Client{
 	Timeout: time.Second * 20,
 }
 
-var lobClient *lob.Lob
+var lobClient lob.LobAPI
 
 var addr = flag.String("addr", ":8080", "http service address")
 
@@ -31,7 +32,9 @@ func main() {
 		"PG_DATABASE_URL",
 		"STRIPE_WEBHOOK_TEST_SECRET",
 		"STRIPE_WEBHOOK_PROD_SECRET",
-		"STRIPE_PAYMENT_LINK_ID",
+		"STRIPE_PROD_KEY",
+		"STRIPE_TEST_KEY",
+		"STRIPE_PRICE_CREDITS",
 	} {
 		if _, ok := os.LookupEnv(env); !ok {
 			log.Println("Required environment variable missing:", env)
@@ -43,6 +46,57 @@ func main() {
 		os.Exit(1)
 	}
 
+	var err error
+	if org, err = loadOrganization(os.Getenv("ORG_CONFIG")); err != nil {
+		log.Println("Error loading ORG_CONFIG:", err)
+		os.Exit(1)
+	}
+	oauthConf.Endpoint = org.oauthEndpoint()
+
+	if priceCredits, err = parsePriceCredits(os.Getenv("STRIPE_PRICE_CREDITS")); err != nil {
+		log.Println("Error parsing STRIPE_PRICE_CREDITS:", err)
+		os.Exit(1)
+	}
+
+	if livemode, ok := os.LookupEnv("STRIPE_LIVEMODE"); ok {
+		if stripeLivemode, err = strconv.ParseBool(livemode); err != nil {
+			log.Println("Error parsing STRIPE_LIVEMODE:", err)
+			os.Exit(1)
+		}
+	}
+	if stripeLivemode {
+		log.Println("Creating Stripe checkout sessions in live mode")
+	} else {
+		log.Println("Creating Stripe checkout sessions in test mode")
+	}
+
+	if adminRecurseIds, err = parseRecurseIds(os.Getenv("ADMIN_RECURSE_IDS")); err != nil {
+		log.Println("Error parsing ADMIN_RECURSE_IDS:", err)
+		os.Exit(1)
+	}
+
+	patCacheTTL, patCacheNegativeTTL := defaultPatCacheTTL, defaultPatCacheNegativeTTL
+	if ttl, ok := os.LookupEnv("PAT_CACHE_TTL"); ok {
+		if patCacheTTL, err = time.ParseDuration(ttl); err != nil {
+			log.Println("Error parsing PAT_CACHE_TTL:", err)
+			os.Exit(1)
+		}
+	}
+	if ttl, ok := os.LookupEnv("PAT_CACHE_NEGATIVE_TTL"); ok {
+		if patCacheNegativeTTL, err = time.ParseDuration(ttl); err != nil {
+			log.Println("Error parsing PAT_CACHE_NEGATIVE_TTL:", err)
+			os.Exit(1)
+		}
+	}
+	if window, ok := os.LookupEnv("POSTCARD_CANCEL_WINDOW"); ok {
+		if postcardCancelWindow, err = time.ParseDuration(window); err != nil || postcardCancelWindow < 0 || postcardCancelWindow > lobScheduleHorizon {
+			log.Println("Error parsing POSTCARD_CANCEL_WINDOW:", window)
+			os.Exit(1)
+		}
+	}
+
+	pacCache = newPatCache(patCacheTTL, patCacheNegativeTTL, defaultPatCacheMaxEntries)
+
 	// setup postgres connection
 	if err := postgresClient.setupPostgresConnection(); err != nil {
 		log.Println("Error setting up postgres:", err)
@@ -50,7 +104,19 @@ func main() {
 	}
 	defer db.Close()
 
-	lobClient = lob.NewLob(client)
+	sessionStore = &postgresSessionStore{}
+
+	if lobBaseUrl, ok := os.LookupEnv("LOB_API_BASE_URL"); ok {
+		lobClient = lob.NewLobWithBaseUrl(client, lobBaseUrl)
+	} else {
+		lobClient = lob.NewLob(client)
+	}
+
+	go runPostcardScheduler(schedulerInterval)
+
+	if lobWebhookSecret = os.Getenv("LOB_WEBHOOK_SECRET"); lobWebhookSecret == "" {
+		log.Println("LOB_WEBHOOK_SECRET is not set, postcard tracking events will not be received")
+	}
 
 	var staticFS = http.FS(staticFiles)
 	fs := http.FileServer(staticFS)
@@ -58,6 +124,7 @@ func main() {
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/login", serveLogin)
 	http.HandleFunc("/auth", serveAuth)
+	http.HandleFunc("/logout", serveLogout)
 	http.Handle("/static/", fs)
 
 	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
@@ -66,15 +133,27 @@ func main() {
 	})
 
 	http.Handle("/addresses", authMiddleware(http.HandlerFunc(serveAddress)))
+	http.Handle("/addresses/", authMiddleware(http.HandlerFunc(serveAddressRoutes)))
 	http.Handle("/postcards", authMiddleware(http.HandlerFunc(servePostcards)))
+	http.Handle("/postcards/", authMiddleware(http.HandlerFunc(servePostcardRoutes)))
+	http.Handle("/letters", authMiddleware(http.HandlerFunc(serveLetters)))
+	http.Handle("/letters/", authMiddleware(http.HandlerFunc(getLetter)))
+	http.Handle("/addressbook", authMiddleware(http.HandlerFunc(serveAddressBook)))
+	http.Handle("/addressbook/", authMiddleware(http.HandlerFunc(serveAddressBookContact)))
 	http.Handle("/contacts", authMiddleware(http.HandlerFunc(serveContacts)))
+	http.Handle("/credits", authMiddleware(http.HandlerFunc(serveCredits)))
+	http.Handle("/credits/checkout", authMiddleware(http.HandlerFunc(serveCreditsCheckout)))
+	http.Handle("/notifications", authMiddleware(http.HandlerFunc(serveNotifications)))
+	http.Handle("/tokens", authMiddleware(http.HandlerFunc(serveTokens)))
 	http.Handle("/profiles", authMiddleware(http.HandlerFunc(serveProfiles)))
+	http.Handle("/admin/tokenCache", authMiddleware(adminMiddleware(http.HandlerFunc(serveAdminTokenCache))))
 	http.HandleFunc("/stripeWebhook", serveProdStripeWebhook)
 	http.HandleFunc("/testStripeWebhook", serveTestStripeWebhook)
+	http.HandleFunc("/lobWebhook", serveLobWebhook)
 
 	log.Printf("Running on port %s\n", *addr)
 
-	err := http.ListenAndServe(*addr, nil)
+	err = http.ListenAndServe(*addr, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
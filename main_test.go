@@ -1,6 +1,903 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+	"github.com/rc-postcard/rc-postcard/lob/lobtest"
+)
 
 func TestNothing(t *testing.T) {
 }
+
+// useLobtest points lobClient at a fresh lobtest.Server for the duration of
+// the test.
+func useLobtest(t *testing.T) *lobtest.Server {
+	t.Setenv("LOB_API_TEST_KEY", "test_key")
+	t.Setenv("LOB_API_LIVE_KEY", "live_key")
+	server := lobtest.NewServer()
+	previous := lobClient
+	lobClient = lob.NewLobWithBaseUrl(server.Client(), server.URL)
+	t.Cleanup(func() {
+		lobClient = previous
+		server.Close()
+	})
+	return server
+}
+
+// withUser returns r with user attached the way authMiddleware would.
+func withUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// frontImage returns a blank PNG the right shape and resolution for size.
+func frontImage(t *testing.T, size string) []byte {
+	spec := lob.PostcardSpecs[size]
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, spec.WidthPx, spec.HeightPx))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newPostcardRequest(t *testing.T, target, back string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	front, err := writer.CreateFormFile("front-postcard-file", "front.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	front.Write(frontImage(t, lob.Size4x6))
+	writer.WriteField("back", back)
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, target, body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestDigitalPreview(t *testing.T) {
+	server := useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	w := httptest.NewRecorder()
+	servePostcards(w, withUser(newPostcardRequest(t, "/postcards?mode=digital_preview&toRecurseId=0", "hello"), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp CreatePostcardResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Url == "" {
+		t.Error("expected a preview url")
+	}
+
+	postcards := server.Postcards("test_key")
+	if len(postcards) != 1 {
+		t.Fatalf("got %d postcards at lob, want 1", len(postcards))
+	}
+	if postcards[0].To.Name != org.Name || postcards[0].From.Name != "Ada" {
+		t.Errorf("unexpected addresses to=%+v from=%+v", postcards[0].To, postcards[0].From)
+	}
+	if !bytes.Contains([]byte(postcards[0].Back), []byte("hello")) {
+		t.Errorf("back of postcard does not contain message: %s", postcards[0].Back)
+	}
+}
+
+func TestGetPostcards(t *testing.T) {
+	useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	for _, toRcId := range []int{7, 8} {
+		if _, lobError := lobClient.CreatePostCard(lob.LobAddress{Name: "Bob", AddressLine1: "1 Main St", AddressZip: "11201"},
+			lob.LobAddress{Name: "Ada", AddressLine1: "1 Main St", AddressZip: "11201"},
+			[]byte("front"), "back", false, 8, toRcId, DigitalSend, "", time.Time{}, ""); lobError != nil {
+			t.Fatal(lobError)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	servePostcards(w, withUser(httptest.NewRequest(http.MethodGet, "/postcards?mode=digital_send", nil), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp GetPostcardsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].Metadata.ToRcId != "7" {
+		t.Errorf("expected only the postcard sent to user 7, got %+v", resp.Data)
+	}
+	if resp.NextCursor != "" {
+		t.Errorf("expected no next page, got cursor %q", resp.NextCursor)
+	}
+
+	for _, target := range []string{"/postcards?limit=0", "/postcards?limit=101", "/postcards?since=yesterday"} {
+		w = httptest.NewRecorder()
+		servePostcards(w, withUser(httptest.NewRequest(http.MethodGet, target, nil), user))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	if sendAt, err := parseSendAt("", now); err != nil || !sendAt.IsZero() {
+		t.Errorf("empty sendAt should mean now, got %v %v", sendAt, err)
+	}
+	if sendAt, err := parseSendAt("2022-06-01T09:00:00-04:00", now); err != nil || !sendAt.Equal(time.Date(2022, 6, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %v %v", sendAt, err)
+	}
+	for _, malformed := range []string{"2022-06-01", "2022-03-01T11:00:00Z", "2023-03-02T12:00:00Z"} {
+		if _, err := parseSendAt(malformed, now); err == nil {
+			t.Errorf("expected an error parsing %q", malformed)
+		}
+	}
+}
+
+func TestParseSaveAddressForm(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	form := func(values string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/addresses", strings.NewReader(values))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	label, makeDefault, effectiveFrom, err := parseSaveAddressForm(form(""), now)
+	if err != nil || label != defaultAddressLabel || makeDefault || !effectiveFrom.IsZero() {
+		t.Errorf("got %q %v %v %v", label, makeDefault, effectiveFrom, err)
+	}
+	label, _, effectiveFrom, err = parseSaveAddressForm(form("label=Summer&effectiveFrom=2022-06-01T00:00:00Z"), now)
+	if err != nil || label != "summer" || !effectiveFrom.Equal(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %q %v %v", label, effectiveFrom, err)
+	}
+	for _, malformed := range []string{
+		"label=%2Fetc",
+		"default=maybe",
+		"effectiveFrom=2022-02-01T00:00:00Z",
+		"default=true&effectiveFrom=2022-06-01T00:00:00Z",
+	} {
+		if _, _, _, err := parseSaveAddressForm(form(malformed), now); err == nil {
+			t.Errorf("expected an error parsing %q", malformed)
+		}
+	}
+}
+
+func TestOnlyPhysicalPostcardsCanBeScheduled(t *testing.T) {
+	useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	front, _ := writer.CreateFormFile("front-postcard-file", "front.png")
+	front.Write(frontImage(t, lob.Size4x6))
+	writer.WriteField("back", "hello")
+	writer.WriteField("sendAt", time.Now().Add(24*time.Hour).Format(time.RFC3339))
+	writer.Close()
+	r := httptest.NewRequest(http.MethodPost, "/postcards?mode=digital_send&toRecurseId=8", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	servePostcards(w, withUser(r, user))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestContactsOnlyGetPhysicalPostcards(t *testing.T) {
+	useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	for _, target := range []string{
+		"/postcards?mode=digital_send&toContactId=3",
+		"/postcards?mode=physical_send&toContactId=three",
+	} {
+		w := httptest.NewRecorder()
+		servePostcards(w, withUser(newPostcardRequest(t, target, "hello"), user))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestValidateFrontImage(t *testing.T) {
+	for size := range postcardCredits {
+		if err := validateFrontImage(frontImage(t, size), size, PhysicalSend); err != nil {
+			t.Errorf("%s: %v", size, err)
+		}
+	}
+
+	var small bytes.Buffer
+	png.Encode(&small, image.NewGray(image.Rect(0, 0, 625, 425)))
+	if err := validateFrontImage(small.Bytes(), lob.Size4x6, PhysicalSend); err == nil {
+		t.Error("expected a low resolution image to be rejected")
+	}
+	if err := validateFrontImage(small.Bytes(), lob.Size4x6, DigitalPreview); err != nil {
+		t.Errorf("expected a low resolution image to be previewable: %v", err)
+	}
+	if err := validateFrontImage(frontImage(t, lob.Size4x6), lob.Size6x11, PhysicalSend); err == nil {
+		t.Error("expected a 4x6 image to be rejected for a 6x11 postcard")
+	}
+	if err := validateFrontImage([]byte("fake image"), lob.Size4x6, DigitalPreview); err == nil {
+		t.Error("expected something that isn't an image to be rejected")
+	}
+}
+
+func TestDigitalPreviewSize(t *testing.T) {
+	server := useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	front, _ := writer.CreateFormFile("front-postcard-file", "front.png")
+	front.Write(frontImage(t, lob.Size6x11))
+	writer.WriteField("back", "hello")
+	writer.Close()
+	r := httptest.NewRequest(http.MethodPost, "/postcards?mode=digital_preview&toRecurseId=0&size=6x11", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	servePostcards(w, withUser(r, user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	postcards := server.Postcards("test_key")
+	if len(postcards) != 1 || postcards[0].Size != lob.Size6x11 {
+		t.Fatalf("expected a 6x11 postcard at lob, got %+v", postcards)
+	}
+	if !bytes.Contains([]byte(postcards[0].Back), []byte("11.25in")) {
+		t.Error("expected the back to use the 6x11 template")
+	}
+
+	w = httptest.NewRecorder()
+	servePostcards(w, withUser(newPostcardRequest(t, "/postcards?mode=digital_preview&toRecurseId=0&size=5x7", "hello"), user))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown size: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDigitalPreviewLetter(t *testing.T) {
+	server := useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	newLetterRequest := func(field, filename string, content []byte) *http.Request {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		if filename != "" {
+			part, _ := writer.CreateFormFile(field, filename)
+			part.Write(content)
+		} else {
+			writer.WriteField(field, string(content))
+		}
+		writer.WriteField("color", "true")
+		writer.Close()
+		r := httptest.NewRequest(http.MethodPost, "/letters?mode=digital_preview&toRecurseId=0", body)
+		r.Header.Set("Content-Type", writer.FormDataContentType())
+		return withUser(r, user)
+	}
+
+	w := httptest.NewRecorder()
+	serveLetters(w, newLetterRequest("message", "", []byte("a longer note")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp CreateLetterResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Url == "" {
+		t.Fatalf("expected a preview url, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	serveLetters(w, newLetterRequest("letter-file", "letter.pdf", []byte("%PDF-1.4 letter")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	letters := server.Letters("test_key")
+	if len(letters) != 2 {
+		t.Fatalf("expected 2 letters at lob, got %d", len(letters))
+	}
+	if !bytes.Contains(letters[0].File, []byte("a longer note")) || !letters[0].Color {
+		t.Errorf("unexpected letter %+v", letters[0])
+	}
+	if string(letters[1].File) != "%PDF-1.4 letter" {
+		t.Errorf("expected the uploaded PDF, got %q", letters[1].File)
+	}
+
+	w = httptest.NewRecorder()
+	serveLetters(w, newLetterRequest("letter-file", "letter.png", frontImage(t, lob.Size4x6)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("non-PDF upload: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestVerifyAddress(t *testing.T) {
+	useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	verify := func(values string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/addresses/verify", strings.NewReader(values))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveAddressRoutes(w, withUser(r, user))
+		return w
+	}
+
+	w := verify("address1=1+main+st&city=brooklyn&state=ny&zip=11201")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp VerifyAddressResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Deliverable || !resp.Changed || resp.SuggestedAddress.AddressLine1 != "1 MAIN ST" {
+		t.Errorf("expected a corrected deliverable address, got %+v", resp)
+	}
+	if len(resp.DpvFootnotes) == 0 || resp.DpvFootnotes[0].Description == "" {
+		t.Errorf("expected described DPV footnotes, got %+v", resp.DpvFootnotes)
+	}
+
+	w = verify("address1=undeliverable&zip=11201")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Deliverable {
+		t.Errorf("expected an undeliverable analysis, got %d %+v", w.Code, resp)
+	}
+
+	if w = verify("zip=11201"); w.Code != http.StatusBadRequest {
+		t.Errorf("missing address line: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestVerifyIntlAddress(t *testing.T) {
+	useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	verify := func(values string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/addresses/verify", strings.NewReader(values))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveAddressRoutes(w, withUser(r, user))
+		return w
+	}
+
+	w := verify("address1=10+downing+st&city=london&zip=sw1a+2aa&country=gb")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp VerifyAddressResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Deliverable || resp.SuggestedAddress.AddressCountry != "GB" || resp.Components != nil {
+		t.Errorf("expected a deliverable international address, got %+v", resp)
+	}
+
+	w = verify("address1=no_match&city=paris&zip=75001&country=FR")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Deliverable {
+		t.Errorf("expected an undeliverable address, got %d %+v", w.Code, resp)
+	}
+}
+
+func TestValidateFormAddress(t *testing.T) {
+	for _, test := range []struct {
+		values  string
+		country string
+	}{
+		{"city=brooklyn&state=ny&zip=11201", "US"},
+		{"zip=11201-1234&country=us", "US"},
+		{"city=toronto&state=on&zip=m5v+3l9&country=CA", "CA"},
+		{"city=london&zip=SW1A+2AA&country=GB", "GB"},
+		{"city=berlin&zip=10115&country=DE", "DE"},
+		{"city=singapore&zip=018956&country=SG", "SG"},
+		{"city=brooklyn&state=zz&zip=11201", ""},
+		{"city=brooklyn&state=ny&zip=1120", ""},
+		{"city=toronto&zip=m5v+3l9&country=CA", ""},
+		{"city=berlin&zip=1011&country=DE", ""},
+		{"zip=10115&country=DE", ""},
+		{"city=berlin&zip=10115&country=germany", ""},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/addresses", strings.NewReader(test.values))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		country, err := validateFormAddress(r)
+		if test.country == "" && err == nil {
+			t.Errorf("%s: expected an error", test.values)
+		} else if test.country != "" && (err != nil || country != test.country) {
+			t.Errorf("%s: got %q, %v, want %q", test.values, country, err, test.country)
+		}
+	}
+}
+
+func TestInternationalPostcardsCostMore(t *testing.T) {
+	useLobtest(t)
+
+	for size, credits := range postcardCredits {
+		if internationalPostcardCredits[size] <= credits {
+			t.Errorf("%s: international postcards cost %d, domestic %d", size, internationalPostcardCredits[size], credits)
+		}
+	}
+
+	created, err := lobClient.CreateContactAddress("Grace", "10 Downing St", "", "London", "", "SW1A 2AA", "GB", 7, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		address       lob.LobAddress
+		international bool
+	}{
+		{lob.LobAddress{AddressId: created.AddressId}, true},
+		{lob.LobAddress{AddressCountry: org.Address.AddressCountry}, false},
+		{lob.LobAddress{AddressCountry: "CA"}, true},
+	} {
+		international, err := isInternationalAddress(test.address)
+		if err != nil || international != test.international {
+			t.Errorf("%+v: got %v, %v, want %v", test.address, international, err, test.international)
+		}
+	}
+}
+
+func TestSetReturnAddressValidation(t *testing.T) {
+	user := &User{Id: 7, Name: "Ada"}
+
+	for _, values := range []string{"returnAddress=home", "returnAddress=alternate", "returnAddress=alternate&label=+"} {
+		r := httptest.NewRequest(http.MethodPost, "/addresses/return", strings.NewReader(values))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveAddressRoutes(w, withUser(r, user))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", values, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDigitalPostcardsAreFromTheRCSpace(t *testing.T) {
+	server := useLobtest(t)
+	user := &User{Id: 7, Name: "Ada"}
+
+	w := httptest.NewRecorder()
+	servePostcards(w, withUser(newPostcardRequest(t, "/postcards?mode=digital_preview&toRecurseId=0", "hello"), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	postcards := server.Postcards("test_key")
+	if len(postcards) != 1 {
+		t.Fatalf("expected 1 postcard at lob, got %d", len(postcards))
+	}
+	if from := postcards[0].From; from.Name != "Ada" || from.AddressLine1 != org.Address.AddressLine1 {
+		t.Errorf("expected a return address at the RC space, got %+v", from)
+	}
+}
+
+func TestSendPostcardRecordsIt(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+	user := &User{Id: 7, Name: "Ada"}
+
+	w := httptest.NewRecorder()
+	servePostcards(w, withUser(newPostcardRequest(t, "/postcards?mode=physical_send&toRecurseId=0", "hello"), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp CreatePostcardResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	lobPostcards := server.Postcards("live_key")
+	if len(lobPostcards) != 1 {
+		t.Fatalf("got %d postcards at Lob, want 1", len(lobPostcards))
+	}
+	postcard, err := postgresClient.getPostcard(resp.PostcardId, "")
+	if err != nil {
+		t.Fatalf("postcard %d: %v", resp.PostcardId, err)
+	}
+	if postcard.LobId != lobPostcards[0].Id || postcard.Status != PostcardCreated || postcard.BackMessage != "hello" {
+		t.Errorf("recorded %+v for Lob postcard %s", postcard, lobPostcards[0].Id)
+	}
+	if key := lobPostcards[0].Metadata["idempotency_key"]; key != postcard.lobIdempotencyKey() {
+		t.Errorf("sent with idempotency key %q, want %q", key, postcard.lobIdempotencyKey())
+	}
+	assertCredits(t, 7, 5-postcardCredits[lob.Size4x6])
+	if resp.Credits != 5-postcardCredits[lob.Size4x6] {
+		t.Errorf("response reports %d credits", resp.Credits)
+	}
+
+	var status string
+	if err = db.QueryRow("SELECT status FROM credit_transactions WHERE id = $1", postcard.CreditTransactionId).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != CreditCommitted {
+		t.Errorf("credit transaction is %s, want %s", status, CreditCommitted)
+	}
+}
+
+func TestSendPostcardLeavesUnansweredSendsPending(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+	user := &User{Id: 7, Name: "Ada"}
+	lobRetryDelay = 0
+	t.Cleanup(func() { lobRetryDelay = time.Second })
+
+	// Lob is unreachable, so it may or may not have the postcards
+	server.Close()
+	var postcardIds []int64
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		servePostcards(w, withUser(newPostcardRequest(t, "/postcards?mode=physical_send&toRecurseId=0", "hello"), user))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		var postcardId int64
+		if err := db.QueryRow("SELECT max(id) FROM postcards WHERE status = $1", PostcardPending).Scan(&postcardId); err != nil {
+			t.Fatal(err)
+		}
+		postcardIds = append(postcardIds, postcardId)
+	}
+	assertCredits(t, 7, 5-2*postcardCredits[lob.Size4x6])
+
+	// Lob turns out to have the first one
+	useLobtest(t)
+	first, err := postgresClient.getPostcard(postcardIds[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobPostcard, lobError := lobClient.CreatePostCard(org.address(user.Name), org.address(org.Name), frontImage(t, lob.Size4x6), "hello", true, 7, 0, PhysicalSend, "", time.Time{}, first.lobIdempotencyKey())
+	if lobError != nil {
+		t.Fatal(lobError)
+	}
+
+	if err = reconcilePendingPostcards(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if first, err = postgresClient.getPostcard(postcardIds[0], ""); err != nil || first.Status != PostcardPending {
+		t.Errorf("postcard was settled too soon: %+v, %v", first, err)
+	}
+
+	if err = reconcilePendingPostcards(time.Now().Add(pendingPostcardTimeout + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	first, err = postgresClient.getPostcard(postcardIds[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != PostcardCreated || first.LobId != lobPostcard.Id {
+		t.Errorf("postcard Lob has: got status %s and Lob id %q, want %s and %s", first.Status, first.LobId, PostcardCreated, lobPostcard.Id)
+	}
+	second, err := postgresClient.getPostcard(postcardIds[1], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Status != PostcardFailed {
+		t.Errorf("postcard Lob never got: got status %s, want %s", second.Status, PostcardFailed)
+	}
+	assertCredits(t, 7, 5-postcardCredits[lob.Size4x6])
+}
+
+func TestSendLetterLeavesUnansweredSendsPending(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+	user := &User{Id: 7, Name: "Ada"}
+	lobRetryDelay = 0
+	t.Cleanup(func() { lobRetryDelay = time.Second })
+
+	sendLetter := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/letters?mode=physical_send&toRecurseId=0", strings.NewReader("message=hello"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		serveLetters(w, withUser(r, user))
+		return w
+	}
+
+	// Lob is unreachable, so it may or may not have the letters
+	server.Close()
+	var letterIds []int64
+	for i := 0; i < 2; i++ {
+		if w := sendLetter(); w.Code != http.StatusInternalServerError {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		var letterId int64
+		if err := db.QueryRow("SELECT max(id) FROM letters WHERE status = $1", PostcardPending).Scan(&letterId); err != nil {
+			t.Fatal(err)
+		}
+		letterIds = append(letterIds, letterId)
+	}
+	assertCredits(t, 7, 5-2*letterCredits)
+
+	// Lob turns out to have the first one
+	useLobtest(t)
+	first, err := postgresClient.getLetter(letterIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lobLetter, lobError := lobClient.CreateLetter(org.address(user.Name), org.address(org.Name), lob.LetterFile{HTML: "<p>hello</p>"}, lob.LetterOptions{}, true, 7, 0, PhysicalSend, first.lobIdempotencyKey())
+	if lobError != nil {
+		t.Fatal(lobError)
+	}
+
+	if err = reconcilePendingLetters(time.Now().Add(pendingPostcardTimeout + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if first, err = postgresClient.getLetter(letterIds[0]); err != nil || first.Status != PostcardCreated || first.LobId != lobLetter.Id {
+		t.Errorf("letter Lob has: got %+v, %v, want status %s and Lob id %s", first, err, PostcardCreated, lobLetter.Id)
+	}
+	if second, err := postgresClient.getLetter(letterIds[1]); err != nil || second.Status != PostcardFailed {
+		t.Errorf("letter Lob never got: got %+v, %v, want status %s", second, err, PostcardFailed)
+	}
+	assertCredits(t, 7, 5-letterCredits)
+
+	// once Lob answers, the letter is recorded as sent
+	w := sendLetter()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp CreateLetterResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if letter, err := postgresClient.getLetter(resp.LetterId); err != nil || letter.Status != PostcardCreated || letter.LobId == "" {
+		t.Errorf("got %+v, %v, want a created letter", letter, err)
+	}
+	assertCredits(t, 7, 5-2*letterCredits)
+}
+
+func TestGetLettersPages(t *testing.T) {
+	useTestDatabase(t)
+	for i := 0; i < 2; i++ {
+		if err := postgresClient.insertLetter(&Letter{FromRecurseId: 7, ToRecurseId: 8, Mode: DigitalSend, LobId: "ltr_" + strconv.Itoa(i), Status: PostcardDelivered}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not sent, so not shown to the recipient
+	if err := postgresClient.insertLetter(&Letter{FromRecurseId: 7, ToRecurseId: 8, Mode: DigitalSend, Status: PostcardPending}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	getLetters(w, withUser(httptest.NewRequest(http.MethodGet, "/letters?limit=2", nil), &User{Id: 8}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp GetLettersResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 || resp.NextCursor != "" {
+		t.Errorf("an exact last page: got %d letters and cursor %q", len(resp.Data), resp.NextCursor)
+	}
+}
+
+// insertLobPostcard sends a physical postcard from fromRecurseId through Lob,
+// to be mailed in ten minutes, and records it as the handler would.
+func insertLobPostcard(t *testing.T, fromRecurseId int) *Postcard {
+	t.Helper()
+	resp, lobError := lobClient.CreatePostCard(org.address("Ada"), org.address(org.Name), frontImage(t, lob.Size4x6), "hello", true, fromRecurseId, 0, PhysicalSend, "", time.Now().Add(10*time.Minute), "")
+	if lobError != nil {
+		t.Fatal(lobError)
+	}
+	creditTransactionId, err := postgresClient.reserveCredits(fromRecurseId, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = postgresClient.commitCredits(creditTransactionId, resp.Id); err != nil {
+		t.Fatal(err)
+	}
+	postcard := &Postcard{FromRecurseId: fromRecurseId, Mode: PhysicalSend, Size: lob.Size4x6, LobId: resp.Id, CreditTransactionId: creditTransactionId, SendAt: &resp.SendDate, Status: PostcardCreated}
+	if err = postgresClient.insertPostcard(postcard); err != nil {
+		t.Fatal(err)
+	}
+	return postcard
+}
+
+func TestCancelPostcard(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+	insertTestUser(t, 8, 5)
+	postcard := insertLobPostcard(t, 7)
+
+	cancel := func(user *User) int {
+		w := httptest.NewRecorder()
+		servePostcardRoutes(w, withUser(httptest.NewRequest(http.MethodDelete, "/postcards/"+strconv.FormatInt(postcard.Id, 10), nil), user))
+		return w.Code
+	}
+
+	if code := cancel(&User{Id: 8, Name: "Bob"}); code != http.StatusNotFound {
+		t.Errorf("someone else cancelling: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if server.Postcards("live_key")[0].Deleted {
+		t.Fatal("someone else cancelled the postcard at Lob")
+	}
+
+	if code := cancel(&User{Id: 7, Name: "Ada"}); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if got, err := postgresClient.getPostcard(postcard.Id, ""); err != nil || got.Status != PostcardCancelled {
+		t.Errorf("got %+v, %v, want a cancelled postcard", got, err)
+	}
+	if !server.Postcards("live_key")[0].Deleted {
+		t.Error("postcard was not cancelled at Lob")
+	}
+	assertCredits(t, 7, 5)
+}
+
+func TestInterruptedCancellationsAreFinished(t *testing.T) {
+	useTestDatabase(t)
+	useLobtest(t)
+	insertTestUser(t, 7, 5)
+
+	// one cancellation stopped before asking Lob, the other after
+	before := insertLobPostcard(t, 7)
+	after := insertLobPostcard(t, 7)
+	for _, postcard := range []*Postcard{before, after} {
+		if err := postgresClient.startCancellingPostcard(postcard.Id, PostcardCreated); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lobClient.CancelPostcard(after.LobId, true); err != nil {
+		t.Fatal(err)
+	}
+	assertCredits(t, 7, 3)
+
+	if err := reconcileCancellingPostcards(); err != nil {
+		t.Fatal(err)
+	}
+	for _, postcard := range []*Postcard{before, after} {
+		if got, err := postgresClient.getPostcard(postcard.Id, ""); err != nil || got.Status != PostcardCancelled {
+			t.Errorf("got %+v, %v, want a cancelled postcard", got, err)
+		}
+	}
+	assertCredits(t, 7, 5)
+}
+
+func TestRefusedCancellationsKeepTheirStatus(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+
+	postcard := insertLobPostcard(t, 7)
+	if _, err := db.Exec("UPDATE postcards SET status = $2 WHERE id = $1", postcard.Id, PostcardScheduled); err != nil {
+		t.Fatal(err)
+	}
+	if err := postgresClient.startCancellingPostcard(postcard.Id, PostcardScheduled); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lob has sent it to production by the time the cancellation is retried
+	server.Now = func() time.Time { return postcard.SendAt.Add(time.Minute) }
+	if err := reconcileCancellingPostcards(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := postgresClient.getPostcard(postcard.Id, ""); err != nil || got.Status != PostcardScheduled {
+		t.Errorf("got %+v, %v, want a scheduled postcard", got, err)
+	}
+	assertCredits(t, 7, 4)
+
+	if err := postgresClient.cancelLobPostcard(postcard.Id, postcard.CreditTransactionId); err != errCancellationSettled {
+		t.Errorf("recording a cancellation of a postcard not being cancelled: got %v, want %v", err, errCancellationSettled)
+	}
+	assertCredits(t, 7, 4)
+}
+
+func TestGetLetter(t *testing.T) {
+	useTestDatabase(t)
+	useLobtest(t)
+
+	resp, lobError := lobClient.CreateLetter(org.address("Ada"), org.address("Bob"), lob.LetterFile{HTML: "<p>hello</p>"}, lob.LetterOptions{}, false, 7, 8, DigitalSend, "")
+	if lobError != nil {
+		t.Fatal(lobError)
+	}
+	letter := &Letter{FromRecurseId: 7, ToRecurseId: 8, Mode: DigitalSend, LobId: resp.Id, Message: "hello", Status: PostcardDelivered}
+	if err := postgresClient.insertLetter(letter); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		recurseId int
+		want      int
+	}{
+		{7, http.StatusOK},
+		{8, http.StatusOK},
+		{9, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		getLetter(w, withUser(httptest.NewRequest(http.MethodGet, "/letters/"+strconv.FormatInt(letter.Id, 10), nil), &User{Id: test.recurseId}))
+		if w.Code != test.want {
+			t.Errorf("user %d: got status %d, want %d", test.recurseId, w.Code, test.want)
+			continue
+		}
+		var got Letter
+		if w.Code == http.StatusOK && (json.Unmarshal(w.Body.Bytes(), &got) != nil || got.Url == "") {
+			t.Errorf("user %d: expected a link to the letter, got %s", test.recurseId, w.Body.String())
+		}
+	}
+}
+
+func TestAddressBookKeepsAddresses(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+	user := &User{Id: 7, Name: "Ada"}
+
+	r := httptest.NewRequest(http.MethodPost, "/addressbook", strings.NewReader("name=Grace&address1=1+main+st&city=brooklyn&state=ny&zip=11201"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	serveAddressBook(w, withUser(r, user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	// saved before addresses were kept, with a Lob address that is gone
+	if _, err := db.Exec("INSERT INTO address_book (owner_rc_id, name, lob_address_id) VALUES (7, 'Alan', 'adr_gone')"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the address book is listed without Lob
+	server.Close()
+	w = httptest.NewRecorder()
+	serveAddressBook(w, withUser(httptest.NewRequest(http.MethodGet, "/addressbook", nil), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var resp GetAddressBookResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Contacts) != 2 || resp.Contacts[0].AddressLine1 == "" || resp.Contacts[1].Name != "Alan" {
+		t.Errorf("got contacts %s", w.Body.String())
+	}
+}
+
+func TestSentPostcardsNameTheirRecipients(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 7, 5)
+	insertTestUser(t, 8, 5)
+	contact := &AddressBookContact{Name: "Grace", lobAddressId: "adr_1"}
+	if err := postgresClient.insertAddressBookContact(7, contact); err != nil {
+		t.Fatal(err)
+	}
+	for _, postcard := range []*Postcard{
+		{FromRecurseId: 7, ToRecurseId: 8, Mode: PhysicalSend, LobId: "psc_1", Status: PostcardCreated},
+		{FromRecurseId: 7, ToContactId: contact.Id, Mode: PhysicalSend, LobId: "psc_2", Status: PostcardCreated},
+	} {
+		if err := postgresClient.insertPostcard(postcard); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	postcards, err := postgresClient.getSentPostcards(7, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postcards) != 2 {
+		t.Fatalf("got %d postcards, want 2", len(postcards))
+	}
+	if postcards[0].RecipientName != "Grace" || postcards[0].ToContactId != contact.Id {
+		t.Errorf("postcard to a contact: got recipient %q and contact %d", postcards[0].RecipientName, postcards[0].ToContactId)
+	}
+	if postcards[1].RecipientName != "User 8" || postcards[1].ToContactId != 0 {
+		t.Errorf("postcard to a user: got recipient %q and contact %d", postcards[1].RecipientName, postcards[1].ToContactId)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+	"golang.org/x/oauth2"
+)
+
+// Organization is the community a deployment serves: where mail to it goes,
+// how its members sign in and what new members start with. Members are
+// identified by their id at the organization's profile API.
+type Organization struct {
+	Name string `json:"name"`
+	// Address is the organization's mailing address, used for postcards to
+	// the organization and as the default return address. Its name is
+	// ignored.
+	Address lob.LobAddress `json:"address"`
+	// Inbox is the user with id 0 that stands for the organization in the
+	// list of recipients.
+	Inbox Inbox     `json:"inbox"`
+	OAuth OAuthUrls `json:"oauth"`
+	// ProfileMeUrl returns the profile of the member a token belongs to.
+	ProfileMeUrl string `json:"profileMeUrl"`
+	// FreeCredits are granted to every new member.
+	FreeCredits int      `json:"freeCredits"`
+	Branding    Branding `json:"branding"`
+}
+
+type Inbox struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// OAuthUrls are the organization's OAuth 2 authorization server endpoints.
+type OAuthUrls struct {
+	AuthURL  string `json:"authUrl"`
+	TokenURL string `json:"tokenUrl"`
+}
+
+// Branding is printed on the back of every postcard.
+type Branding struct {
+	Tagline string `json:"tagline"`
+	// Color is the CSS background color of the tagline.
+	Color string `json:"color"`
+}
+
+// recurseCenter is the organization rc-postcard was written for, and the
+// default when ORG_CONFIG is not set.
+var recurseCenter = Organization{
+	Name: "Recurse Center",
+	Address: lob.LobAddress{
+		AddressLine1:   "397 Bridge Street",
+		AddressLine2:   "5th Floor",
+		AddressCity:    "Brooklyn",
+		AddressState:   "NY",
+		AddressZip:     "11201",
+		AddressCountry: "US",
+	},
+	Inbox: Inbox{Name: "Recurse Id", Email: "admissions@recurse.com"},
+	OAuth: OAuthUrls{
+		AuthURL:  "https://www.recurse.com/oauth/authorize",
+		TokenURL: "https://www.recurse.com/oauth/token",
+	},
+	ProfileMeUrl: "https://recurse.com/api/v1/profiles/me",
+	FreeCredits:  2,
+	Branding:     Branding{Tagline: "NEVER GRADUATE", Color: "#a2d1f8"},
+}
+
+// org is the organization this deployment serves.
+var org = recurseCenter
+
+// loadOrganization reads the JSON organization config at path. Settings the
+// file leaves out keep the Recurse Center's values, so a staging deployment
+// only needs to give what differs. An empty path is the Recurse Center.
+func loadOrganization(path string) (Organization, error) {
+	o := recurseCenter
+	if path == "" {
+		return o, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Organization{}, err
+	}
+	if err = json.Unmarshal(b, &o); err != nil {
+		return Organization{}, err
+	}
+
+	if o.Name == "" || o.Inbox.Name == "" || o.Inbox.Email == "" {
+		return Organization{}, errors.New("name, inbox.name and inbox.email are required")
+	}
+	if o.Address.AddressLine1 == "" || o.Address.AddressCity == "" || o.Address.AddressZip == "" {
+		return Organization{}, errors.New("address needs at least address_line1, address_city and address_zip")
+	}
+	if lob.IsInternational(o.Address.AddressCountry) {
+		return Organization{}, fmt.Errorf("address must be in the US to send mail from, not %s", o.Address.AddressCountry)
+	}
+	if o.OAuth.AuthURL == "" || o.OAuth.TokenURL == "" || o.ProfileMeUrl == "" {
+		return Organization{}, errors.New("oauth.authUrl, oauth.tokenUrl and profileMeUrl are required")
+	}
+	if o.FreeCredits < 0 {
+		return Organization{}, errors.New("freeCredits can't be negative")
+	}
+	return o, nil
+}
+
+// oauthEndpoint is where members of the organization sign in.
+func (o Organization) oauthEndpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{AuthURL: o.OAuth.AuthURL, TokenURL: o.OAuth.TokenURL}
+}
+
+// address is the organization's mailing address, addressed to name.
+func (o Organization) address(name string) lob.LobAddress {
+	address := o.Address
+	address.AddressId = ""
+	address.Name = name
+	return address
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeOrganizationConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "org.json")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadOrganization(t *testing.T) {
+	o, err := loadOrganization("")
+	if err != nil || o.Name != "Recurse Center" || o.FreeCredits != 2 {
+		t.Errorf("expected the Recurse Center by default, got %+v, %v", o, err)
+	}
+
+	o, err = loadOrganization(writeOrganizationConfig(t, `{
+		"name": "Example Community",
+		"oauth": {"authUrl": "https://example.com/oauth/authorize", "tokenUrl": "https://example.com/oauth/token"},
+		"freeCredits": 0,
+		"branding": {"tagline": "HELLO"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Name != "Example Community" || o.FreeCredits != 0 || o.oauthEndpoint().TokenURL != "https://example.com/oauth/token" {
+		t.Errorf("unexpected organization %+v", o)
+	}
+	if o.Address.AddressZip != "11201" || o.Branding.Color != "#a2d1f8" {
+		t.Errorf("expected settings left out to keep their defaults, got %+v", o)
+	}
+
+	for _, config := range []string{
+		`{"name": ""}`,
+		`{"address": {"address_line1": "10 Downing St", "address_city": "London", "address_zip": "SW1A 2AA", "address_country": "GB"}}`,
+		`{"freeCredits": -1}`,
+		`{"profileMeUrl": ""}`,
+		`not json`,
+	} {
+		if _, err := loadOrganization(writeOrganizationConfig(t, config)); err == nil {
+			t.Errorf("%s: expected an error", config)
+		}
+	}
+	if _, err := loadOrganization(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected a missing file to be an error")
+	}
+}
+
+func TestBackOfPostcardBranding(t *testing.T) {
+	for size, tpl := range backOfPostcard {
+		var back bytes.Buffer
+		if err := tpl.Execute(&back, backOfPostcardData{Message: "hello", Branding: Branding{Tagline: "HELLO FROM EXAMPLE", Color: "#f8d1a2"}}); err != nil {
+			t.Fatalf("%s: %v", size, err)
+		}
+		if !strings.Contains(back.String(), "HELLO FROM EXAMPLE") || !strings.Contains(back.String(), "#f8d1a2") {
+			t.Errorf("%s: branding missing from the back of the postcard", size)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"math"
 	"os"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -16,6 +19,125 @@ var postgresClient = &PostgresClient{}
 
 var db *sql.DB
 
+// schema is run on startup, so every statement must be idempotent.
+var schema = []string{
+	"CREATE TABLE IF NOT EXISTS user_info (recurse_id int UNIQUE NOT NULL, lob_address_id text DEFAULT '', accepts_physical_mail BOOLEAN DEFAULT FALSE, num_credits int DEFAULT 0 NOT NULL, user_name text NOT NULL, user_email text NOT NULL, batch text DEFAULT '');",
+	// credit_transactions is the ledger behind user_info.num_credits. Spends
+	// are reserved before calling Lob and committed or refunded afterwards.
+	"CREATE TABLE IF NOT EXISTS credit_transactions (id bigserial PRIMARY KEY, recurse_id int NOT NULL, amount int NOT NULL, kind text NOT NULL, status text NOT NULL DEFAULT 'committed', stripe_event_id text, lob_postcard_id text, related_transaction_id bigint REFERENCES credit_transactions (id), created_at timestamptz NOT NULL DEFAULT now());",
+	"CREATE INDEX IF NOT EXISTS credit_transactions_recurse_id ON credit_transactions (recurse_id);",
+	"CREATE UNIQUE INDEX IF NOT EXISTS credit_transactions_refund_once ON credit_transactions (related_transaction_id) WHERE kind = 'refund';",
+	"ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS stripe_checkout_session_id text;",
+	"ALTER TABLE credit_transactions ADD COLUMN IF NOT EXISTS stripe_payment_intent_id text;",
+	"CREATE INDEX IF NOT EXISTS credit_transactions_payment_intent ON credit_transactions (stripe_payment_intent_id);",
+	// credits_flagged_at is set when revoking credits leaves a negative balance.
+	"ALTER TABLE user_info ADD COLUMN IF NOT EXISTS credits_flagged_at timestamptz;",
+	// stripe_events records every verified webhook delivery so that retried
+	// deliveries are handled once, and keeps the raw payload for auditing.
+	"CREATE TABLE IF NOT EXISTS stripe_events (id text PRIMARY KEY, type text NOT NULL, livemode boolean NOT NULL, recurse_id int, payload jsonb NOT NULL, received_at timestamptz NOT NULL DEFAULT now());",
+	// api_tokens are app-issued tokens for scripts and bots. Only a hash of
+	// each token is stored; scopes are space separated.
+	"CREATE TABLE IF NOT EXISTS api_tokens (id bigserial PRIMARY KEY, recurse_id int NOT NULL, name text NOT NULL, token_hash text UNIQUE NOT NULL, scopes text NOT NULL, created_at timestamptz NOT NULL DEFAULT now(), expires_at timestamptz NOT NULL, last_used_at timestamptz, revoked_at timestamptz);",
+	"CREATE INDEX IF NOT EXISTS api_tokens_recurse_id ON api_tokens (recurse_id);",
+	// postcards records every digital and physical send, alongside Lob.
+	"CREATE TABLE IF NOT EXISTS postcards (id bigserial PRIMARY KEY, from_rc_id int NOT NULL, to_rc_id int NOT NULL, mode text NOT NULL, lob_id text UNIQUE, back_message text NOT NULL DEFAULT '', front_image_ref text NOT NULL DEFAULT '', credit_transaction_id bigint REFERENCES credit_transactions (id), created_at timestamptz NOT NULL DEFAULT now(), expected_delivery_date date, status text NOT NULL);",
+	"CREATE INDEX IF NOT EXISTS postcards_from_rc_id ON postcards (from_rc_id, created_at);",
+	"CREATE INDEX IF NOT EXISTS postcards_to_rc_id ON postcards (to_rc_id, created_at);",
+	// postcard_events is the tracking timeline Lob reports for each postcard
+	// through its webhook, keyed by Lob's event id so retries are stored once.
+	"CREATE TABLE IF NOT EXISTS postcard_events (id bigserial PRIMARY KEY, lob_event_id text UNIQUE NOT NULL, lob_postcard_id text NOT NULL, type text NOT NULL, payload jsonb NOT NULL, occurred_at timestamptz NOT NULL, received_at timestamptz NOT NULL DEFAULT now());",
+	"CREATE INDEX IF NOT EXISTS postcard_events_lob_postcard_id ON postcard_events (lob_postcard_id, occurred_at);",
+	// address_verified is cleared when a postcard to the address is returned
+	// to sender, and set again when the user re-confirms their address.
+	"ALTER TABLE user_info ADD COLUMN IF NOT EXISTS address_verified boolean NOT NULL DEFAULT TRUE;",
+	"ALTER TABLE user_info ADD COLUMN IF NOT EXISTS address_updated_at timestamptz;",
+	// notifications are shown to users in the app.
+	"CREATE TABLE IF NOT EXISTS notifications (id bigserial PRIMARY KEY, recurse_id int NOT NULL, kind text NOT NULL, message text NOT NULL, postcard_id bigint REFERENCES postcards (id), created_at timestamptz NOT NULL DEFAULT now(), read_at timestamptz);",
+	"CREATE INDEX IF NOT EXISTS notifications_recurse_id ON notifications (recurse_id, created_at);",
+	// send_at is when a scheduled postcard is to be mailed. Postcards too far
+	// out for Lob to hold wait in scheduled_postcards until they are due.
+	"ALTER TABLE postcards ADD COLUMN IF NOT EXISTS send_at timestamptz;",
+	"CREATE TABLE IF NOT EXISTS scheduled_postcards (postcard_id bigint PRIMARY KEY REFERENCES postcards (id), send_at timestamptz NOT NULL, front_image bytea NOT NULL, back_html text NOT NULL);",
+	"CREATE INDEX IF NOT EXISTS scheduled_postcards_send_at ON scheduled_postcards (send_at);",
+	"ALTER TABLE postcards ADD COLUMN IF NOT EXISTS size text NOT NULL DEFAULT '4x6';",
+	// letters is our own record of letters sent through Lob, like postcards.
+	"CREATE TABLE IF NOT EXISTS letters (id bigserial PRIMARY KEY, from_rc_id int NOT NULL, to_rc_id int NOT NULL, mode text NOT NULL, lob_id text UNIQUE, message text NOT NULL DEFAULT '', file_ref text NOT NULL DEFAULT '', color boolean NOT NULL, double_sided boolean NOT NULL, return_envelope boolean NOT NULL, credit_transaction_id bigint REFERENCES credit_transactions (id), created_at timestamptz NOT NULL DEFAULT now(), expected_delivery_date date, status text NOT NULL);",
+	"CREATE INDEX IF NOT EXISTS letters_to_rc_id ON letters (to_rc_id, created_at);",
+	// address_book holds the contacts users can mail physical postcards to
+	// besides Recursers. Their addresses are created at Lob; deleted contacts
+	// are kept so postcards sent to them still reference a row.
+	"CREATE TABLE IF NOT EXISTS address_book (id bigserial PRIMARY KEY, owner_rc_id int NOT NULL, name text NOT NULL, lob_address_id text NOT NULL, created_at timestamptz NOT NULL DEFAULT now(), deleted_at timestamptz);",
+	"CREATE INDEX IF NOT EXISTS address_book_owner_rc_id ON address_book (owner_rc_id);",
+	"ALTER TABLE postcards ADD COLUMN IF NOT EXISTS to_contact_id bigint REFERENCES address_book (id);",
+	// a copy of each contact's Lob address, to list them without asking Lob.
+	// It is NULL for contacts saved before it was kept, until they are next
+	// listed.
+	"ALTER TABLE address_book ADD COLUMN IF NOT EXISTS address_line1 text;",
+	"ALTER TABLE address_book ADD COLUMN IF NOT EXISTS address_line2 text;",
+	"ALTER TABLE address_book ADD COLUMN IF NOT EXISTS address_city text;",
+	"ALTER TABLE address_book ADD COLUMN IF NOT EXISTS address_state text;",
+	"ALTER TABLE address_book ADD COLUMN IF NOT EXISTS address_zip text;",
+	"ALTER TABLE address_book ADD COLUMN IF NOT EXISTS address_country text;",
+	// user_addresses are a user's saved, labeled addresses. The default one is
+	// mirrored in user_info.lob_address_id, and one with effective_from
+	// becomes the default at that time. Addresses saved before labels
+	// existed become "home".
+	"CREATE TABLE IF NOT EXISTS user_addresses (id bigserial PRIMARY KEY, recurse_id int NOT NULL, label text NOT NULL, lob_address_id text NOT NULL, is_default boolean NOT NULL DEFAULT FALSE, effective_from timestamptz, created_at timestamptz NOT NULL DEFAULT now(), UNIQUE (recurse_id, label));",
+	"CREATE INDEX IF NOT EXISTS user_addresses_effective_from ON user_addresses (effective_from) WHERE effective_from IS NOT NULL;",
+	"INSERT INTO user_addresses (recurse_id, label, lob_address_id, is_default) SELECT recurse_id, 'home', lob_address_id, TRUE FROM user_info u WHERE lob_address_id <> '' AND NOT EXISTS (SELECT 1 FROM user_addresses a WHERE a.recurse_id = u.recurse_id) ON CONFLICT (recurse_id, label) DO NOTHING;",
+	// return_address is where a user's physical mail is returned to: the
+	// organization, their default address, or the saved address labeled
+	// return_address_label.
+	"ALTER TABLE user_info ADD COLUMN IF NOT EXISTS return_address text NOT NULL DEFAULT 'rc';",
+	"ALTER TABLE user_info ADD COLUMN IF NOT EXISTS return_address_label text NOT NULL DEFAULT '';",
+	// attempts counts the times sending a scheduled postcard failed without an
+	// answer from Lob, and next_attempt_at is when to try it again.
+	"ALTER TABLE scheduled_postcards ADD COLUMN IF NOT EXISTS attempts int NOT NULL DEFAULT 0;",
+	"ALTER TABLE scheduled_postcards ADD COLUMN IF NOT EXISTS next_attempt_at timestamptz;",
+	// status_before_cancel is what a postcard being cancelled goes back to if
+	// Lob won't cancel it.
+	"ALTER TABLE postcards ADD COLUMN IF NOT EXISTS status_before_cancel text;",
+	// sessions backs postgresSessionStore.
+	"CREATE TABLE IF NOT EXISTS sessions (token_hash text PRIMARY KEY, session jsonb NOT NULL, created_at timestamptz NOT NULL, last_seen_at timestamptz NOT NULL);",
+}
+
+// Kinds of credit_transactions entries.
+const (
+	CreditPurchase = "purchase"
+	CreditGrant    = "grant"
+	CreditSpend    = "spend"
+	CreditRefund   = "refund"
+	CreditRevoke   = "revoke"
+)
+
+// Statuses of credit_transactions entries. Only spends are ever reserved.
+const (
+	CreditReserved  = "reserved"
+	CreditCommitted = "committed"
+)
+
+var errInsufficientCredits = errors.New("insufficient credits")
+
+// errNotFound is returned when a row to update doesn't exist or belongs to
+// another user.
+var errNotFound = errors.New("not found")
+
+// errDefaultAddress is returned when deleting the address mail currently
+// goes to.
+var errDefaultAddress = errors.New("the default address can't be deleted")
+
+// errReturnAddress is returned when deleting the saved address a user's mail
+// is returned to.
+var errReturnAddress = errors.New("the return address can't be deleted")
+
+// errNotCancellable is returned when cancelling a postcard that has already
+// been handed to Lob.
+var errNotCancellable = errors.New("postcard can no longer be cancelled")
+
+// errCancellationSettled is returned when recording a cancellation Lob made
+// finds the postcard is no longer being cancelled.
+var errCancellationSettled = errors.New("postcard is no longer being cancelled")
+
 func (*PostgresClient) setupPostgresConnection() error {
 	var err error
 	db, err = sql.Open("pgx", os.Getenv("PG_DATABASE_URL"))
@@ -30,13 +152,17 @@ func (*PostgresClient) setupPostgresConnection() error {
 		return err
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS user_info (recurse_id int UNIQUE NOT NULL, lob_address_id text DEFAULT '', accepts_physical_mail BOOLEAN DEFAULT FALSE, num_credits int DEFAULT 0 NOT NULL, user_name text NOT NULL, user_email text NOT NULL, batch text DEFAULT '');")
-
-	if err != nil {
-		return err
+	for _, statement := range schema {
+		if _, err = db.Exec(statement); err != nil {
+			return err
+		}
 	}
 
-	_, err = db.Exec("INSERT INTO user_info (recurse_id, accepts_physical_mail, user_name, user_email) VALUES (0, TRUE, 'Recurse Id', 'admissions@recurse.com') ON CONFLICT (recurse_id) DO NOTHING;")
+	// recurse_id 0 stands for the organization itself
+	_, err = db.Exec(
+		"INSERT INTO user_info (recurse_id, accepts_physical_mail, user_name, user_email) VALUES (0, TRUE, $1, $2) ON CONFLICT (recurse_id) DO UPDATE SET user_name = EXCLUDED.user_name, user_email = EXCLUDED.user_email;",
+		org.Inbox.Name,
+		org.Inbox.Email)
 
 	return err
 }
@@ -50,6 +176,28 @@ func (*PostgresClient) getUserInfo(recurseId int) (lobAddressId string, acceptsP
 	return
 }
 
+// getMailingAddress returns the Lob address physical mail to recurseId goes
+// to, and whether it can be sent: they must accept physical mail, and mail to
+// the address mustn't have been returned since they last confirmed it.
+func (*PostgresClient) getMailingAddress(recurseId int) (lobAddressId string, acceptsPhysicalMail bool, err error) {
+	if err = db.QueryRow("SELECT lob_address_id, accepts_physical_mail AND address_verified FROM user_info WHERE recurse_id = $1", recurseId).Scan(&lobAddressId, &acceptsPhysicalMail); err != nil {
+		log.Printf("QueryRow failed: %v\n", err)
+		return "", false, err
+	}
+
+	return
+}
+
+func (*PostgresClient) getAddressVerified(recurseId int) (bool, error) {
+	var addressVerified bool
+	if err := db.QueryRow("SELECT address_verified FROM user_info WHERE recurse_id = $1", recurseId).Scan(&addressVerified); err != nil {
+		log.Printf("QueryRow failed: %v\n", err)
+		return false, err
+	}
+
+	return addressVerified, nil
+}
+
 func (*PostgresClient) getLobAddressId(recurseId int) (string, error) {
 	var lobAddressId string
 	if err := db.QueryRow("SELECT lob_address_id FROM user_info WHERE recurse_id = $1", recurseId).Scan(&lobAddressId); err != nil {
@@ -70,28 +218,213 @@ func (*PostgresClient) getCredits(recurseId int) (int, error) {
 	return credits, nil
 }
 
-func (*PostgresClient) decrementCredits(recurseId int) error {
-	if _, err := db.Exec(
-		"UPDATE user_info SET num_credits = num_credits - 1 WHERE recurse_id = $1",
-		recurseId); err != nil {
+// creditTransaction is a ledger entry that changes a user's balance.
+type creditTransaction struct {
+	RecurseId               int
+	Amount                  int
+	Kind                    string
+	StripeEventId           string
+	StripeCheckoutSessionId string
+	StripePaymentIntentId   string
+}
+
+// addCreditsTx adds t.Amount (which may be negative) to a user's balance and
+// records t in the ledger.
+func addCreditsTx(tx *sql.Tx, t creditTransaction) error {
+	result, err := tx.Exec(
+		"UPDATE user_info SET num_credits = num_credits + $2 WHERE recurse_id = $1",
+		t.RecurseId,
+		t.Amount)
+	if err != nil {
 		return err
 	}
-	return nil
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO credit_transactions (recurse_id, amount, kind, stripe_event_id, stripe_checkout_session_id, stripe_payment_intent_id)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''))`,
+		t.RecurseId,
+		t.Amount,
+		t.Kind,
+		t.StripeEventId,
+		t.StripeCheckoutSessionId,
+		t.StripePaymentIntentId)
+	return err
 }
 
-func (*PostgresClient) incrementCredits(recurseId int) error {
-	if _, err := db.Exec(
-		"UPDATE user_info SET num_credits = num_credits + 1 WHERE recurse_id = $1",
-		recurseId); err != nil {
+// revokePurchaseCreditsTx takes back credits bought with a Stripe payment
+// intent that has been refunded or disputed, so that in total
+// revokedNumerator/revokedDenominator of the purchase is revoked. Earlier
+// revocations for the same payment intent are accounted for, so partial
+// refunds can be applied one after another. The balance is allowed to go
+// negative if the credits were already spent, in which case the user is
+// flagged for an admin to follow up.
+func revokePurchaseCreditsTx(tx *sql.Tx, eventId, paymentIntentId string, revokedNumerator, revokedDenominator int64) error {
+	var recurseId int
+	var purchased int64
+	var checkoutSessionId string
+	err := tx.QueryRow(
+		"SELECT recurse_id, amount, COALESCE(stripe_checkout_session_id, '') FROM credit_transactions WHERE kind = $1 AND stripe_payment_intent_id = $2 FOR UPDATE",
+		CreditPurchase,
+		paymentIntentId).Scan(&recurseId, &purchased, &checkoutSessionId)
+	if err == sql.ErrNoRows {
+		log.Printf("No purchase found for payment intent %s, nothing to revoke\n", paymentIntentId)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = setStripeEventRecurseId(tx, eventId, recurseId); err != nil {
+		return err
+	}
+
+	var alreadyRevoked int64
+	if err = tx.QueryRow(
+		"SELECT COALESCE(SUM(-amount), 0) FROM credit_transactions WHERE kind = $1 AND stripe_payment_intent_id = $2",
+		CreditRevoke,
+		paymentIntentId).Scan(&alreadyRevoked); err != nil {
+		return err
+	}
+
+	// round to the nearest credit
+	toRevoke := (purchased*revokedNumerator+revokedDenominator/2)/revokedDenominator - alreadyRevoked
+	if toRevoke <= 0 {
+		return nil
+	}
+
+	log.Printf("Revoking %d credits from %d for payment intent %s\n", toRevoke, recurseId, paymentIntentId)
+	if err = addCreditsTx(tx, creditTransaction{
+		RecurseId:               recurseId,
+		Amount:                  int(-toRevoke),
+		Kind:                    CreditRevoke,
+		StripeEventId:           eventId,
+		StripeCheckoutSessionId: checkoutSessionId,
+		StripePaymentIntentId:   paymentIntentId,
+	}); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		"UPDATE user_info SET credits_flagged_at = now() WHERE recurse_id = $1 AND num_credits < 0",
+		recurseId)
+	if err != nil {
 		return err
 	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		log.Printf("User %d has a negative credit balance and was flagged for review\n", recurseId)
+	}
 	return nil
 }
 
+// reserveCredits takes amount credits from a user's balance before a physical
+// send. The balance check and the decrement are a single conditional UPDATE,
+// so concurrent sends cannot overdraw. It returns errInsufficientCredits if
+// the balance is too low. The reservation must be followed by commitCredits
+// or refundCredits.
+func (*PostgresClient) reserveCredits(recurseId, amount int) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE user_info SET num_credits = num_credits - $2 WHERE recurse_id = $1 AND num_credits >= $2",
+		recurseId,
+		amount)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, errInsufficientCredits
+	}
+
+	var transactionId int64
+	if err = tx.QueryRow(
+		"INSERT INTO credit_transactions (recurse_id, amount, kind, status) VALUES ($1, $2, $3, $4) RETURNING id",
+		recurseId,
+		-amount,
+		CreditSpend,
+		CreditReserved).Scan(&transactionId); err != nil {
+		return 0, err
+	}
+
+	return transactionId, tx.Commit()
+}
+
+// commitCredits marks a reservation as spent on the given Lob postcard.
+func (*PostgresClient) commitCredits(transactionId int64, lobPostcardId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = commitCreditsTx(tx, transactionId, lobPostcardId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func commitCreditsTx(tx *sql.Tx, transactionId int64, lobPostcardId string) error {
+	_, err := tx.Exec(
+		"UPDATE credit_transactions SET status = $2, lob_postcard_id = $3 WHERE id = $1 AND kind = $4",
+		transactionId,
+		CreditCommitted,
+		lobPostcardId,
+		CreditSpend)
+	return err
+}
+
+// refundCredits returns the credits taken by a spend to the user. Refunding
+// the same spend twice is a no-op.
+func (*PostgresClient) refundCredits(transactionId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = refundCreditsTx(tx, transactionId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func refundCreditsTx(tx *sql.Tx, transactionId int64) error {
+	var recurseId, amount int
+	err := tx.QueryRow(
+		`INSERT INTO credit_transactions (recurse_id, amount, kind, lob_postcard_id, related_transaction_id)
+		SELECT recurse_id, -amount, $2, lob_postcard_id, id FROM credit_transactions WHERE id = $1 AND kind = $3
+		ON CONFLICT (related_transaction_id) WHERE kind = 'refund' DO NOTHING
+		RETURNING recurse_id, amount`,
+		transactionId,
+		CreditRefund,
+		CreditSpend).Scan(&recurseId, &amount)
+	if err == sql.ErrNoRows {
+		// already refunded
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE user_info SET num_credits = num_credits + $2 WHERE recurse_id = $1",
+		recurseId,
+		amount)
+	return err
+}
+
 func (*PostgresClient) getContacts() ([]*Contact, error) {
 
 	var contacts []*Contact
-	rows, err := db.Query("SELECT recurse_id, accepts_physical_mail, user_name, user_email, batch FROM user_info")
+	rows, err := db.Query("SELECT recurse_id, accepts_physical_mail AND address_verified, user_name, user_email, batch FROM user_info")
 	if err != nil {
 		log.Printf("QueryRow failed: %v\n", err)
 		return nil, err
@@ -116,35 +449,1330 @@ func (*PostgresClient) getContacts() ([]*Contact, error) {
 	return contacts, nil
 }
 
+// processStripeEvent records a Stripe event and runs handle in the same
+// transaction, so an event's side effects are applied exactly once. If the
+// event was already recorded handle is not run and alreadyHandled is true.
+// handle may be nil for events we only log.
+func (*PostgresClient) processStripeEvent(eventId, eventType string, livemode bool, payload []byte, handle func(tx *sql.Tx) error) (alreadyHandled bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO stripe_events (id, type, livemode, payload) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING",
+		eventId,
+		eventType,
+		livemode,
+		string(payload))
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 0 {
+		return true, nil
+	}
+
+	if handle != nil {
+		if err = handle(tx); err != nil {
+			return false, err
+		}
+	}
+
+	return false, tx.Commit()
+}
+
+// setStripeEventRecurseId records which user a Stripe event belongs to.
+func setStripeEventRecurseId(tx *sql.Tx, eventId string, recurseId int) error {
+	_, err := tx.Exec("UPDATE stripe_events SET recurse_id = $2 WHERE id = $1", eventId, recurseId)
+	return err
+}
+
+// insertUser creates a user with numCredits free credits, recorded in the
+// ledger as a grant.
 func (*PostgresClient) insertUser(recurseId int, userName, userEmail, batch string, numCredits int) error {
-	if _, err := db.Exec(
-		"INSERT INTO user_info (recurse_id, user_name, user_email, batch, num_credits) VALUES ($1, $2, $3, $4, $5)",
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(
+		"INSERT INTO user_info (recurse_id, user_name, user_email, batch) VALUES ($1, $2, $3, $4)",
 		recurseId,
 		userName,
 		userEmail,
-		batch,
-		numCredits); err != nil {
+		batch); err != nil {
 		return err
 	}
-	return nil
+
+	if numCredits > 0 {
+		if err = addCreditsTx(tx, creditTransaction{RecurseId: recurseId, Amount: numCredits, Kind: CreditGrant}); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-func (*PostgresClient) updateAddress(recurseId int, lobAddressId string, acceptsPhysicalMail bool) error {
-	if _, err := db.Exec(
-		"UPDATE user_info SET lob_address_id = $2, accepts_physical_mail = $3 WHERE recurse_id = $1",
+// saveAddress saves a labeled address for a user, replacing any address
+// with that label, and returns the Lob address it replaced. The address
+// becomes the default now if makeDefault is set, if it replaces the default,
+// or if the user has no other; otherwise a non-zero effectiveFrom schedules
+// it to become the default then, replacing any other pending change.
+// Changing the default to a different address also re-confirms it if mail
+// to the old one was returned.
+func (*PostgresClient) saveAddress(recurseId int, label, lobAddressId string, acceptsPhysicalMail, makeDefault bool, effectiveFrom time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var supersededLobAddressId string
+	var wasDefault bool
+	err = tx.QueryRow(
+		"SELECT lob_address_id, is_default FROM user_addresses WHERE recurse_id = $1 AND label = $2 FOR UPDATE",
+		recurseId,
+		label).Scan(&supersededLobAddressId, &wasDefault)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var hasOtherDefault bool
+	if err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM user_addresses WHERE recurse_id = $1 AND label <> $2 AND is_default)",
+		recurseId,
+		label).Scan(&hasOtherDefault); err != nil {
+		return "", err
+	}
+
+	if _, err = tx.Exec(
+		`INSERT INTO user_addresses (recurse_id, label, lob_address_id) VALUES ($1, $2, $3)
+		ON CONFLICT (recurse_id, label) DO UPDATE SET lob_address_id = EXCLUDED.lob_address_id`,
+		recurseId,
+		label,
+		lobAddressId); err != nil {
+		return "", err
+	}
+	if _, err = tx.Exec(
+		"UPDATE user_info SET accepts_physical_mail = $2 WHERE recurse_id = $1",
 		recurseId,
-		lobAddressId,
 		acceptsPhysicalMail); err != nil {
+		return "", err
+	}
+
+	if wasDefault || makeDefault || !hasOtherDefault {
+		err = setDefaultAddressTx(tx, recurseId, label)
+	} else if !effectiveFrom.IsZero() {
+		err = scheduleDefaultAddressTx(tx, recurseId, label, effectiveFrom)
+	}
+	if err != nil {
+		return "", err
+	}
+	return supersededLobAddressId, tx.Commit()
+}
+
+// setDefaultAddress makes a saved address the default now, or at
+// effectiveFrom if it is non-zero. It returns errNotFound if the user has
+// no address with label.
+func (*PostgresClient) setDefaultAddress(recurseId int, label string, effectiveFrom time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM user_addresses WHERE recurse_id = $1 AND label = $2)",
+		recurseId,
+		label).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errNotFound
+	}
+
+	if !effectiveFrom.IsZero() {
+		err = scheduleDefaultAddressTx(tx, recurseId, label, effectiveFrom)
+	} else {
+		err = setDefaultAddressTx(tx, recurseId, label)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scheduleDefaultAddressTx makes label the user's only pending address change.
+func scheduleDefaultAddressTx(tx *sql.Tx, recurseId int, label string, effectiveFrom time.Time) error {
+	_, err := tx.Exec(
+		"UPDATE user_addresses SET effective_from = CASE WHEN label = $2 THEN $3::timestamptz END WHERE recurse_id = $1",
+		recurseId,
+		label,
+		effectiveFrom)
+	return err
+}
+
+// setDefaultAddressTx makes label the user's default address and mirrors it
+// in user_info. Only a different Lob address counts as re-confirmed.
+func setDefaultAddressTx(tx *sql.Tx, recurseId int, label string) error {
+	if _, err := tx.Exec(
+		`UPDATE user_addresses SET is_default = (label = $2), effective_from = CASE WHEN label = $2 THEN NULL ELSE effective_from END
+		WHERE recurse_id = $1`,
+		recurseId,
+		label); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		`UPDATE user_info SET lob_address_id = a.lob_address_id, address_verified = TRUE, address_updated_at = now()
+		FROM user_addresses a WHERE user_info.recurse_id = $1 AND a.recurse_id = $1 AND a.label = $2
+		AND user_info.lob_address_id IS DISTINCT FROM a.lob_address_id`,
+		recurseId,
+		label)
+	return err
+}
+
+// applyDueAddressChange makes the most overdue scheduled address change due
+// by now, if there is one.
+func (*PostgresClient) applyDueAddressChange(now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var recurseId int
+	var label string
+	err = tx.QueryRow(
+		`SELECT recurse_id, label FROM user_addresses WHERE effective_from <= $1
+		ORDER BY effective_from LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		now).Scan(&recurseId, &label)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err = setDefaultAddressTx(tx, recurseId, label); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// getSavedAddresses returns a user's saved addresses, default first.
+func (*PostgresClient) getSavedAddresses(recurseId int) ([]*SavedAddress, error) {
+	addresses := []*SavedAddress{}
+	rows, err := db.Query(
+		"SELECT label, lob_address_id, is_default, effective_from FROM user_addresses WHERE recurse_id = $1 ORDER BY is_default DESC, label",
+		recurseId)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		address := new(SavedAddress)
+		var effectiveFrom sql.NullTime
+		if err := rows.Scan(&address.Label, &address.lobAddressId, &address.IsDefault, &effectiveFrom); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		if effectiveFrom.Valid {
+			address.EffectiveFrom = &effectiveFrom.Time
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+// deleteSavedAddress removes a user's address and returns its Lob address.
+// The default address can't be deleted.
+func (*PostgresClient) deleteSavedAddress(recurseId int, label string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var lobAddressId string
+	var isDefault bool
+	err = tx.QueryRow(
+		"DELETE FROM user_addresses WHERE recurse_id = $1 AND label = $2 RETURNING lob_address_id, is_default",
+		recurseId,
+		label).Scan(&lobAddressId, &isDefault)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if isDefault {
+		return "", errDefaultAddress
+	}
+	var isReturnAddress bool
+	if err = tx.QueryRow(
+		"SELECT return_address = $2 AND return_address_label = $3 FROM user_info WHERE recurse_id = $1",
+		recurseId,
+		ReturnAddressAlternate,
+		label).Scan(&isReturnAddress); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if isReturnAddress {
+		return "", errReturnAddress
+	}
+	return lobAddressId, tx.Commit()
+}
+
+// getReturnAddress returns a user's return address preference and the Lob
+// address it resolves to, which is empty for the organization's address.
+func (*PostgresClient) getReturnAddress(recurseId int) (returnAddress, label, lobAddressId string, err error) {
+	err = db.QueryRow(
+		`SELECT u.return_address, u.return_address_label,
+			CASE u.return_address WHEN $2 THEN u.lob_address_id WHEN $3 THEN COALESCE(a.lob_address_id, '') ELSE '' END
+		FROM user_info u LEFT JOIN user_addresses a ON a.recurse_id = u.recurse_id AND a.label = u.return_address_label
+		WHERE u.recurse_id = $1`,
+		recurseId,
+		ReturnAddressSaved,
+		ReturnAddressAlternate).Scan(&returnAddress, &label, &lobAddressId)
+	if err == sql.ErrNoRows {
+		return "", "", "", errNotFound
+	}
+	return returnAddress, label, lobAddressId, err
+}
+
+// setReturnAddress sets a user's return address preference. The label of an
+// alternate return address must be one of their saved addresses.
+func (*PostgresClient) setReturnAddress(recurseId int, returnAddress, label string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if returnAddress == ReturnAddressAlternate {
+		var exists bool
+		if err = tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM user_addresses WHERE recurse_id = $1 AND label = $2)",
+			recurseId,
+			label).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return errNotFound
+		}
+	} else {
+		label = ""
+	}
+
+	result, err := tx.Exec(
+		"UPDATE user_info SET return_address = $2, return_address_label = $3 WHERE recurse_id = $1",
+		recurseId,
+		returnAddress,
+		label)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotFound
+	}
+	return tx.Commit()
+}
+
+// scanAddressBookContact reads a contact selected as id, name,
+// lob_address_id, created_at, whether its address is stored, and the stored
+// address.
+func scanAddressBookContact(row interface{ Scan(...interface{}) error }) (*AddressBookContact, error) {
+	contact := new(AddressBookContact)
+	if err := row.Scan(&contact.Id, &contact.Name, &contact.lobAddressId, &contact.CreatedAt, &contact.hasAddress, &contact.AddressLine1, &contact.AddressLine2,
+		&contact.AddressCity, &contact.AddressState, &contact.AddressZip, &contact.AddressCountry); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// insertAddressBookContact saves contact in ownerRecurseId's address book,
+// setting its id and creation time.
+func (*PostgresClient) insertAddressBookContact(ownerRecurseId int, contact *AddressBookContact) error {
+	return db.QueryRow(
+		`INSERT INTO address_book (owner_rc_id, name, lob_address_id, address_line1, address_line2, address_city, address_state, address_zip, address_country)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at`,
+		ownerRecurseId,
+		contact.Name,
+		contact.lobAddressId,
+		contact.AddressLine1,
+		contact.AddressLine2,
+		contact.AddressCity,
+		contact.AddressState,
+		contact.AddressZip,
+		contact.AddressCountry).Scan(&contact.Id, &contact.CreatedAt)
+}
+
+// getAddressBookContacts returns a user's contacts, oldest first.
+func (*PostgresClient) getAddressBookContacts(ownerRecurseId int) ([]*AddressBookContact, error) {
+	contacts := []*AddressBookContact{}
+	rows, err := db.Query(
+		`SELECT id, name, lob_address_id, created_at, address_line1 IS NOT NULL, COALESCE(address_line1, ''), COALESCE(address_line2, ''), COALESCE(address_city, ''), COALESCE(address_state, ''), COALESCE(address_zip, ''), COALESCE(address_country, '')
+		FROM address_book WHERE owner_rc_id = $1 AND deleted_at IS NULL ORDER BY id`,
+		ownerRecurseId)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		contact, err := scanAddressBookContact(rows)
+		if err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+// getAddressBookContact returns one of a user's contacts, or errNotFound.
+func (*PostgresClient) getAddressBookContact(ownerRecurseId int, id int64) (*AddressBookContact, error) {
+	contact, err := scanAddressBookContact(db.QueryRow(
+		`SELECT id, name, lob_address_id, created_at, address_line1 IS NOT NULL, COALESCE(address_line1, ''), COALESCE(address_line2, ''), COALESCE(address_city, ''), COALESCE(address_state, ''), COALESCE(address_zip, ''), COALESCE(address_country, '')
+		FROM address_book WHERE id = $1 AND owner_rc_id = $2 AND deleted_at IS NULL`,
+		id,
+		ownerRecurseId))
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return contact, err
+}
+
+// updateAddressBookContact replaces the name and address of the contact
+// with contact's id, and returns its old Lob address, or errNotFound.
+func (*PostgresClient) updateAddressBookContact(ownerRecurseId int, contact *AddressBookContact) (string, error) {
+	var oldLobAddressId string
+	err := db.QueryRow(
+		`UPDATE address_book SET name = $3, lob_address_id = $4, address_line1 = $5, address_line2 = $6, address_city = $7, address_state = $8, address_zip = $9, address_country = $10
+		FROM address_book old
+		WHERE address_book.id = old.id AND address_book.id = $1 AND address_book.owner_rc_id = $2 AND address_book.deleted_at IS NULL
+		RETURNING old.lob_address_id, address_book.created_at`,
+		contact.Id,
+		ownerRecurseId,
+		contact.Name,
+		contact.lobAddressId,
+		contact.AddressLine1,
+		contact.AddressLine2,
+		contact.AddressCity,
+		contact.AddressState,
+		contact.AddressZip,
+		contact.AddressCountry).Scan(&oldLobAddressId, &contact.CreatedAt)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return oldLobAddressId, err
+}
+
+// storeAddressBookContactAddress keeps a copy of the address of a contact
+// saved before addresses were copied.
+func (*PostgresClient) storeAddressBookContactAddress(contact *AddressBookContact) error {
+	_, err := db.Exec(
+		`UPDATE address_book SET address_line1 = $3, address_line2 = $4, address_city = $5, address_state = $6, address_zip = $7, address_country = $8
+		WHERE id = $1 AND lob_address_id = $2 AND address_line1 IS NULL`,
+		contact.Id,
+		contact.lobAddressId,
+		contact.AddressLine1,
+		contact.AddressLine2,
+		contact.AddressCity,
+		contact.AddressState,
+		contact.AddressZip,
+		contact.AddressCountry)
+	return err
+}
+
+// deleteAddressBookContact removes a contact and returns its Lob address, or
+// errNotFound.
+func (*PostgresClient) deleteAddressBookContact(ownerRecurseId int, id int64) (string, error) {
+	var lobAddressId string
+	err := db.QueryRow(
+		"UPDATE address_book SET deleted_at = now() WHERE id = $1 AND owner_rc_id = $2 AND deleted_at IS NULL RETURNING lob_address_id",
+		id,
+		ownerRecurseId).Scan(&lobAddressId)
+	if err == sql.ErrNoRows {
+		return "", errNotFound
+	}
+	return lobAddressId, err
 }
 
 func (*PostgresClient) deleteUser(recurseId int) error {
 	if _, err := db.Exec(
-		"DELETE FROM user_info WHERE recurse_id = $1",
+		"DELETE FROM user_addresses WHERE recurse_id = $1",
 		recurseId); err != nil {
 		return err
 	}
+	if _, err := db.Exec(
+		"DELETE FROM user_info WHERE recurse_id = $1",
+		recurseId); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (*PostgresClient) insertApiToken(recurseId int, name, tokenHash string, scopes []string, expiresAt time.Time) (*ApiToken, error) {
+	apiToken := &ApiToken{Name: name, Scopes: scopes}
+	if err := db.QueryRow(
+		"INSERT INTO api_tokens (recurse_id, name, token_hash, scopes, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at, expires_at",
+		recurseId,
+		name,
+		tokenHash,
+		strings.Join(scopes, " "),
+		expiresAt).Scan(&apiToken.Id, &apiToken.CreatedAt, &apiToken.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return apiToken, nil
+}
+
+// getApiTokenUser returns the user and scopes of a live API token and marks
+// it as used.
+func (*PostgresClient) getApiTokenUser(tokenHash string) (*User, []string, error) {
+	var user User
+	var scopes string
+	if err := db.QueryRow(
+		`UPDATE api_tokens t SET last_used_at = now() FROM user_info u
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL AND t.expires_at > now() AND u.recurse_id = t.recurse_id
+		RETURNING t.scopes, u.recurse_id, u.user_name, u.user_email`,
+		tokenHash).Scan(&scopes, &user.Id, &user.Name, &user.Email); err == sql.ErrNoRows {
+		return nil, nil, errors.New("unauthorized")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return &user, strings.Fields(scopes), nil
+}
+
+func (*PostgresClient) getApiTokens(recurseId int) ([]*ApiToken, error) {
+	tokens := []*ApiToken{}
+	rows, err := db.Query(
+		"SELECT id, name, scopes, created_at, expires_at, last_used_at FROM api_tokens WHERE recurse_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC",
+		recurseId)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		token := new(ApiToken)
+		var scopes string
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&token.Id, &token.Name, &scopes, &token.CreatedAt, &token.ExpiresAt, &lastUsedAt); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (*PostgresClient) revokeApiToken(recurseId int, id int64) error {
+	result, err := db.Exec(
+		"UPDATE api_tokens SET revoked_at = now() WHERE id = $2 AND recurse_id = $1 AND revoked_at IS NULL",
+		recurseId,
+		id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// insertPostcard records a postcard and sets its Id and CreatedAt.
+func (*PostgresClient) insertPostcard(postcard *Postcard) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = insertPostcardTx(tx, postcard); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertPostcardTx(tx *sql.Tx, postcard *Postcard) error {
+	return tx.QueryRow(
+		`INSERT INTO postcards (from_rc_id, to_rc_id, mode, lob_id, back_message, front_image_ref, credit_transaction_id, expected_delivery_date, status, send_at, size, to_contact_id)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, NULLIF($7, 0), $8, $9, $10, $11, NULLIF($12, 0)) RETURNING id, created_at`,
+		postcard.FromRecurseId,
+		postcard.ToRecurseId,
+		postcard.Mode,
+		postcard.LobId,
+		postcard.BackMessage,
+		postcard.FrontImageRef,
+		postcard.CreditTransactionId,
+		postcard.ExpectedDeliveryDate,
+		postcard.Status,
+		postcard.SendAt,
+		postcard.Size,
+		postcard.ToContactId).Scan(&postcard.Id, &postcard.CreatedAt)
+}
+
+// completePostcard records that Lob accepted a pending postcard, with the
+// Lob id, status and dates now set on postcard, and spends its credit. It does
+// nothing if the postcard has been settled since.
+func (*PostgresClient) completePostcard(postcard *Postcard) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = completePostcardTx(tx, postcard); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func completePostcardTx(tx *sql.Tx, postcard *Postcard) error {
+	result, err := tx.Exec(
+		"UPDATE postcards SET lob_id = $2, status = $3, expected_delivery_date = $4, send_at = $5 WHERE id = $1 AND status = $6",
+		postcard.Id,
+		postcard.LobId,
+		postcard.Status,
+		postcard.ExpectedDeliveryDate,
+		postcard.SendAt,
+		PostcardPending)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if postcard.CreditTransactionId != 0 {
+		return commitCreditsTx(tx, postcard.CreditTransactionId, postcard.LobId)
+	}
+	return nil
+}
+
+// getPendingPostcards returns the postcards that have been pending since
+// before createdBefore, oldest first.
+func (*PostgresClient) getPendingPostcards(createdBefore time.Time) ([]*Postcard, error) {
+	postcards := []*Postcard{}
+	rows, err := db.Query(
+		`SELECT id, from_rc_id, to_rc_id, mode, COALESCE(credit_transaction_id, 0), created_at
+		FROM postcards WHERE status = $1 AND created_at < $2
+		ORDER BY id`,
+		PostcardPending,
+		createdBefore)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		postcard := &Postcard{Status: PostcardPending}
+		if err := rows.Scan(&postcard.Id, &postcard.FromRecurseId, &postcard.ToRecurseId, &postcard.Mode, &postcard.CreditTransactionId, &postcard.CreatedAt); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		postcards = append(postcards, postcard)
+	}
+
+	return postcards, rows.Err()
+}
+
+// failPostcard marks a pending postcard Lob didn't accept as failed and
+// refunds its credit. It does nothing if the postcard has been settled since.
+func (*PostgresClient) failPostcard(postcardId int64, creditTransactionId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = failPostcardTx(tx, postcardId, creditTransactionId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failPostcardTx is failPostcard in tx, reporting whether the postcard was
+// still pending.
+func failPostcardTx(tx *sql.Tx, postcardId int64, creditTransactionId int64) (bool, error) {
+	result, err := tx.Exec("UPDATE postcards SET status = $2 WHERE id = $1 AND status = $3", postcardId, PostcardFailed, PostcardPending)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if creditTransactionId != 0 {
+		return true, refundCreditsTx(tx, creditTransactionId)
+	}
+	return true, nil
+}
+
+func (*PostgresClient) insertLetter(letter *Letter) error {
+	return db.QueryRow(
+		`INSERT INTO letters (from_rc_id, to_rc_id, mode, lob_id, message, file_ref, color, double_sided, return_envelope, credit_transaction_id, expected_delivery_date, status)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, NULLIF($10, 0), $11, $12) RETURNING id, created_at`,
+		letter.FromRecurseId,
+		letter.ToRecurseId,
+		letter.Mode,
+		letter.LobId,
+		letter.Message,
+		letter.FileRef,
+		letter.Color,
+		letter.DoubleSided,
+		letter.ReturnEnvelope,
+		letter.CreditTransactionId,
+		letter.ExpectedDeliveryDate,
+		letter.Status).Scan(&letter.Id, &letter.CreatedAt)
+}
+
+// completeLetter records that Lob accepted a pending letter, with the Lob
+// id, status and expected delivery date now set on letter, and spends its
+// credits. It does nothing if the letter has been settled since.
+func (*PostgresClient) completeLetter(letter *Letter) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE letters SET lob_id = $2, status = $3, expected_delivery_date = $4 WHERE id = $1 AND status = $5",
+		letter.Id,
+		letter.LobId,
+		letter.Status,
+		letter.ExpectedDeliveryDate,
+		PostcardPending)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if letter.CreditTransactionId != 0 {
+		if err = commitCreditsTx(tx, letter.CreditTransactionId, letter.LobId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getPendingLetters returns the letters that have been pending since before
+// createdBefore, oldest first.
+func (*PostgresClient) getPendingLetters(createdBefore time.Time) ([]*Letter, error) {
+	letters := []*Letter{}
+	rows, err := db.Query(
+		`SELECT id, from_rc_id, to_rc_id, mode, COALESCE(credit_transaction_id, 0), created_at
+		FROM letters WHERE status = $1 AND created_at < $2
+		ORDER BY id`,
+		PostcardPending,
+		createdBefore)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		letter := &Letter{Status: PostcardPending}
+		if err := rows.Scan(&letter.Id, &letter.FromRecurseId, &letter.ToRecurseId, &letter.Mode, &letter.CreditTransactionId, &letter.CreatedAt); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+
+	return letters, rows.Err()
+}
+
+// failLetter marks a pending letter Lob didn't accept as failed and refunds
+// its credits. It does nothing if the letter has been settled since.
+func (*PostgresClient) failLetter(letterId int64, creditTransactionId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = failLetterTx(tx, letterId, creditTransactionId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failLetterTx is failLetter in tx, reporting whether the letter was still
+// pending.
+func failLetterTx(tx *sql.Tx, letterId int64, creditTransactionId int64) (bool, error) {
+	result, err := tx.Exec("UPDATE letters SET status = $2 WHERE id = $1 AND status = $3", letterId, PostcardFailed, PostcardPending)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if creditTransactionId != 0 {
+		return true, refundCreditsTx(tx, creditTransactionId)
+	}
+	return true, nil
+}
+
+// getReceivedLetters returns up to limit letters sent to toRecurseId, newest
+// first, starting below beforeId if it is non-zero. Letters that haven't
+// been sent are left out.
+func (*PostgresClient) getReceivedLetters(toRecurseId int, beforeId int64, limit int) ([]*Letter, error) {
+	if beforeId == 0 {
+		beforeId = math.MaxInt64
+	}
+
+	letters := []*Letter{}
+	rows, err := db.Query(
+		`SELECT id, from_rc_id, to_rc_id, mode, COALESCE(lob_id, ''), message, file_ref, color, double_sided, return_envelope, created_at, expected_delivery_date, status
+		FROM letters
+		WHERE to_rc_id = $1 AND id < $2 AND status NOT IN ($4, $5)
+		ORDER BY id DESC LIMIT $3`,
+		toRecurseId,
+		beforeId,
+		limit,
+		PostcardPending,
+		PostcardFailed)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		letter := new(Letter)
+		var expectedDeliveryDate sql.NullTime
+		if err := rows.Scan(&letter.Id, &letter.FromRecurseId, &letter.ToRecurseId, &letter.Mode, &letter.LobId, &letter.Message, &letter.FileRef, &letter.Color, &letter.DoubleSided, &letter.ReturnEnvelope, &letter.CreatedAt, &expectedDeliveryDate, &letter.Status); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		if expectedDeliveryDate.Valid {
+			letter.ExpectedDeliveryDate = &expectedDeliveryDate.Time
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// getLetter returns the letter with the given id.
+func (*PostgresClient) getLetter(id int64) (*Letter, error) {
+	letter := new(Letter)
+	var expectedDeliveryDate sql.NullTime
+	err := db.QueryRow(
+		`SELECT id, from_rc_id, to_rc_id, mode, COALESCE(lob_id, ''), message, file_ref, color, double_sided, return_envelope, created_at, expected_delivery_date, status
+		FROM letters WHERE id = $1`,
+		id).Scan(&letter.Id, &letter.FromRecurseId, &letter.ToRecurseId, &letter.Mode, &letter.LobId, &letter.Message, &letter.FileRef, &letter.Color, &letter.DoubleSided, &letter.ReturnEnvelope, &letter.CreatedAt, &expectedDeliveryDate, &letter.Status)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if expectedDeliveryDate.Valid {
+		letter.ExpectedDeliveryDate = &expectedDeliveryDate.Time
+	}
+	return letter, nil
+}
+
+// insertScheduledPostcard records a postcard to be sent through Lob once it
+// is due, keeping what is needed to create it then.
+func (*PostgresClient) insertScheduledPostcard(postcard *Postcard, frontImage []byte, backHtml string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = insertPostcardTx(tx, postcard); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(
+		"INSERT INTO scheduled_postcards (postcard_id, send_at, front_image, back_html) VALUES ($1, $2, $3, $4)",
+		postcard.Id,
+		postcard.SendAt,
+		frontImage,
+		backHtml); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scheduledPostcard is a postcard waiting in scheduled_postcards.
+type scheduledPostcard struct {
+	Postcard
+	FrontImage []byte
+	BackHtml   string
+	Attempts   int
+}
+
+// claimDueScheduledPostcardTx locks the most overdue scheduled postcard due
+// by now, skipping any another instance is already sending and any waiting to
+// be tried again. It returns sql.ErrNoRows if none are due.
+func claimDueScheduledPostcardTx(tx *sql.Tx, now time.Time) (*scheduledPostcard, error) {
+	scheduled := new(scheduledPostcard)
+	var creditTransactionId sql.NullInt64
+	if err := tx.QueryRow(
+		`SELECT p.id, p.from_rc_id, p.to_rc_id, COALESCE(p.to_contact_id, 0), p.mode, p.size, p.back_message, p.credit_transaction_id, p.created_at, s.send_at, s.front_image, s.back_html, s.attempts
+		FROM scheduled_postcards s JOIN postcards p ON p.id = s.postcard_id
+		WHERE s.send_at <= $1 AND (s.next_attempt_at IS NULL OR s.next_attempt_at <= $1)
+		ORDER BY s.send_at LIMIT 1
+		FOR UPDATE OF s SKIP LOCKED`,
+		now).Scan(&scheduled.Id, &scheduled.FromRecurseId, &scheduled.ToRecurseId, &scheduled.ToContactId, &scheduled.Mode, &scheduled.Size, &scheduled.BackMessage, &creditTransactionId, &scheduled.CreatedAt, &scheduled.SendAt, &scheduled.FrontImage, &scheduled.BackHtml, &scheduled.Attempts); err != nil {
+		return nil, err
+	}
+	scheduled.CreditTransactionId = creditTransactionId.Int64
+	return scheduled, nil
+}
+
+// completeScheduledPostcardTx records that Lob accepted a scheduled postcard.
+func completeScheduledPostcardTx(tx *sql.Tx, postcardId int64, creditTransactionId int64, lobPostcardId string, expectedDeliveryDate *time.Time) error {
+	if _, err := tx.Exec(
+		"UPDATE postcards SET lob_id = $2, status = $3, expected_delivery_date = $4 WHERE id = $1",
+		postcardId,
+		lobPostcardId,
+		PostcardCreated,
+		expectedDeliveryDate); err != nil {
+		return err
+	}
+	if creditTransactionId != 0 {
+		if err := commitCreditsTx(tx, creditTransactionId, lobPostcardId); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("DELETE FROM scheduled_postcards WHERE postcard_id = $1", postcardId)
+	return err
+}
+
+// postponeScheduledPostcardTx records a failed attempt at sending a
+// scheduled postcard, to be tried again at nextAttemptAt.
+func postponeScheduledPostcardTx(tx *sql.Tx, postcardId int64, nextAttemptAt time.Time) error {
+	_, err := tx.Exec(
+		"UPDATE scheduled_postcards SET attempts = attempts + 1, next_attempt_at = $2 WHERE postcard_id = $1",
+		postcardId,
+		nextAttemptAt)
+	return err
+}
+
+// endScheduledPostcardTx takes a postcard off the schedule without sending
+// it, setting its status and refunding its credit.
+func endScheduledPostcardTx(tx *sql.Tx, postcardId int64, creditTransactionId int64, status string) error {
+	if _, err := tx.Exec("DELETE FROM scheduled_postcards WHERE postcard_id = $1", postcardId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE postcards SET status = $2 WHERE id = $1", postcardId, status); err != nil {
+		return err
+	}
+	if creditTransactionId != 0 {
+		return refundCreditsTx(tx, creditTransactionId)
+	}
+	return nil
+}
+
+// cancelScheduledPostcard cancels a postcard fromRecurseId scheduled and
+// refunds its credit. It returns errNotFound if they have no such postcard,
+// and errNotCancellable if it isn't waiting in scheduled_postcards.
+func (*PostgresClient) cancelScheduledPostcard(fromRecurseId int, postcardId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// blocks while the scheduler is sending this postcard
+	var creditTransactionId sql.NullInt64
+	err = tx.QueryRow(
+		`SELECT p.credit_transaction_id FROM scheduled_postcards s JOIN postcards p ON p.id = s.postcard_id
+		WHERE s.postcard_id = $1 AND p.from_rc_id = $2
+		FOR UPDATE OF s`,
+		postcardId,
+		fromRecurseId).Scan(&creditTransactionId)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM postcards WHERE id = $1 AND from_rc_id = $2)", postcardId, fromRecurseId).Scan(&exists); err != nil {
+			return err
+		} else if !exists {
+			return errNotFound
+		}
+		return errNotCancellable
+	} else if err != nil {
+		return err
+	}
+
+	if err = endScheduledPostcardTx(tx, postcardId, creditTransactionId.Int64, PostcardCancelled); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// startCancellingPostcard marks a postcard Lob holds as being cancelled,
+// before Lob is asked to, so that the cancellation can be finished later if
+// recording it fails, and remembers the status it had. It returns
+// errNotCancellable if the postcard's status is no longer status.
+func (*PostgresClient) startCancellingPostcard(postcardId int64, status string) error {
+	result, err := db.Exec(
+		`UPDATE postcards SET status = $2, status_before_cancel = CASE WHEN status = $2 THEN status_before_cancel ELSE status END
+		WHERE id = $1 AND status = $3 AND lob_id IS NOT NULL`,
+		postcardId,
+		PostcardCancelling,
+		status)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNotCancellable
+	}
+	return nil
+}
+
+// stopCancellingPostcard puts a postcard Lob wouldn't cancel back to the
+// status it had before it was being cancelled.
+func (*PostgresClient) stopCancellingPostcard(postcardId int64) error {
+	_, err := db.Exec(
+		"UPDATE postcards SET status = COALESCE(status_before_cancel, $2), status_before_cancel = NULL WHERE id = $1 AND status = $3",
+		postcardId,
+		PostcardCreated,
+		PostcardCancelling)
+	return err
+}
+
+// getCancellingPostcards returns the postcards still being cancelled.
+func (*PostgresClient) getCancellingPostcards() ([]*Postcard, error) {
+	postcards := []*Postcard{}
+	rows, err := db.Query(
+		"SELECT id, from_rc_id, lob_id, COALESCE(credit_transaction_id, 0) FROM postcards WHERE status = $1 ORDER BY id",
+		PostcardCancelling)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		postcard := &Postcard{Mode: PhysicalSend, Status: PostcardCancelling}
+		if err := rows.Scan(&postcard.Id, &postcard.FromRecurseId, &postcard.LobId, &postcard.CreditTransactionId); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		postcards = append(postcards, postcard)
+	}
+
+	return postcards, rows.Err()
+}
+
+// cancelLobPostcard records that a postcard being cancelled was cancelled at
+// Lob and refunds its credit. It returns errCancellationSettled if the
+// postcard is no longer being cancelled.
+func (*PostgresClient) cancelLobPostcard(postcardId int64, creditTransactionId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE postcards SET status = $2 WHERE id = $1 AND status = $3", postcardId, PostcardCancelled, PostcardCancelling)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errCancellationSettled
+	}
+	if creditTransactionId != 0 {
+		if err = refundCreditsTx(tx, creditTransactionId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getScheduledPostcards returns the postcards fromRecurseId has scheduled
+// that haven't been sent yet, soonest first.
+func (*PostgresClient) getScheduledPostcards(fromRecurseId int) ([]*SentPostcard, error) {
+	postcards := []*SentPostcard{}
+	rows, err := db.Query(
+		`SELECT p.id, p.from_rc_id, p.to_rc_id, COALESCE(p.to_contact_id, 0), p.mode, p.size, COALESCE(p.lob_id, ''), p.back_message, p.front_image_ref, p.created_at, p.send_at, p.status, COALESCE(c.name, u.user_name, '')
+		FROM postcards p LEFT JOIN address_book c ON c.id = p.to_contact_id
+		LEFT JOIN user_info u ON u.recurse_id = p.to_rc_id AND p.to_contact_id IS NULL
+		WHERE p.from_rc_id = $1 AND p.status = $2 AND p.send_at > now()
+		ORDER BY p.send_at, p.id`,
+		fromRecurseId,
+		PostcardScheduled)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		postcard := new(SentPostcard)
+		var sendAt time.Time
+		if err := rows.Scan(&postcard.Id, &postcard.FromRecurseId, &postcard.ToRecurseId, &postcard.ToContactId, &postcard.Mode, &postcard.Size, &postcard.LobId, &postcard.BackMessage, &postcard.FrontImageRef, &postcard.CreatedAt, &sendAt, &postcard.Status, &postcard.RecipientName); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		postcard.SendAt = &sendAt
+		postcards = append(postcards, postcard)
+	}
+
+	return postcards, rows.Err()
+}
+
+// getSentPostcards returns up to limit postcards sent by fromRecurseId,
+// newest first, starting below beforeId if it is non-zero.
+func (*PostgresClient) getSentPostcards(fromRecurseId int, beforeId int64, limit int) ([]*SentPostcard, error) {
+	if beforeId == 0 {
+		beforeId = math.MaxInt64
+	}
+
+	postcards := []*SentPostcard{}
+	rows, err := db.Query(
+		`SELECT p.id, p.from_rc_id, p.to_rc_id, COALESCE(p.to_contact_id, 0), p.mode, p.size, COALESCE(p.lob_id, ''), p.back_message, p.front_image_ref, p.created_at, p.expected_delivery_date, p.status, COALESCE(c.name, u.user_name, '')
+		FROM postcards p LEFT JOIN address_book c ON c.id = p.to_contact_id
+		LEFT JOIN user_info u ON u.recurse_id = p.to_rc_id AND p.to_contact_id IS NULL
+		WHERE p.from_rc_id = $1 AND p.id < $2
+		ORDER BY p.id DESC LIMIT $3`,
+		fromRecurseId,
+		beforeId,
+		limit)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		postcard := new(SentPostcard)
+		var expectedDeliveryDate sql.NullTime
+		if err := rows.Scan(&postcard.Id, &postcard.FromRecurseId, &postcard.ToRecurseId, &postcard.ToContactId, &postcard.Mode, &postcard.Size, &postcard.LobId, &postcard.BackMessage, &postcard.FrontImageRef, &postcard.CreatedAt, &expectedDeliveryDate, &postcard.Status, &postcard.RecipientName); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		if expectedDeliveryDate.Valid {
+			postcard.ExpectedDeliveryDate = &expectedDeliveryDate.Time
+		}
+		postcards = append(postcards, postcard)
+	}
+
+	return postcards, rows.Err()
+}
+
+// getPostcard returns the postcard with the given local id, or Lob id if id
+// is zero.
+func (*PostgresClient) getPostcard(id int64, lobId string) (*Postcard, error) {
+	postcard := new(Postcard)
+	var expectedDeliveryDate, sendAt sql.NullTime
+	err := db.QueryRow(
+		`SELECT id, from_rc_id, to_rc_id, COALESCE(to_contact_id, 0), mode, size, COALESCE(lob_id, ''), back_message, front_image_ref, COALESCE(credit_transaction_id, 0), created_at, expected_delivery_date, send_at, status
+		FROM postcards WHERE ($1 <> 0 AND id = $1) OR ($1 = 0 AND lob_id = $2)`,
+		id,
+		lobId).Scan(&postcard.Id, &postcard.FromRecurseId, &postcard.ToRecurseId, &postcard.ToContactId, &postcard.Mode, &postcard.Size, &postcard.LobId, &postcard.BackMessage, &postcard.FrontImageRef, &postcard.CreditTransactionId, &postcard.CreatedAt, &expectedDeliveryDate, &sendAt, &postcard.Status)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if expectedDeliveryDate.Valid {
+		postcard.ExpectedDeliveryDate = &expectedDeliveryDate.Time
+	}
+	if sendAt.Valid {
+		postcard.SendAt = &sendAt.Time
+	}
+	return postcard, nil
+}
+
+// processPostcardEvent records a Lob tracking event and moves the postcard's
+// status along, then runs handle in the same transaction. Events Lob
+// redelivers are skipped and reported as already handled, and an event older
+// than one already recorded doesn't roll the status back.
+func (*PostgresClient) processPostcardEvent(eventId, lobPostcardId, eventType, status string, occurredAt time.Time, payload []byte, handle func(tx *sql.Tx) error) (alreadyHandled bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO postcard_events (lob_event_id, lob_postcard_id, type, payload, occurred_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (lob_event_id) DO NOTHING",
+		eventId,
+		lobPostcardId,
+		eventType,
+		string(payload),
+		occurredAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 0 {
+		return true, nil
+	}
+
+	if _, err = tx.Exec(
+		`UPDATE postcards SET status = $2 WHERE lob_id = $1
+		AND NOT EXISTS (SELECT 1 FROM postcard_events WHERE lob_postcard_id = $1 AND occurred_at > $3)`,
+		lobPostcardId,
+		status,
+		occurredAt); err != nil {
+		return false, err
+	}
+
+	if handle != nil {
+		if err = handle(tx); err != nil {
+			return false, err
+		}
+	}
+
+	return false, tx.Commit()
+}
+
+// getPostcardEvents returns the tracking events for a Lob postcard, oldest
+// first.
+func (*PostgresClient) getPostcardEvents(lobPostcardId string) ([]*PostcardEvent, error) {
+	events := []*PostcardEvent{}
+	rows, err := db.Query(
+		"SELECT id, type, occurred_at, received_at FROM postcard_events WHERE lob_postcard_id = $1 ORDER BY occurred_at, id",
+		lobPostcardId)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		event := new(PostcardEvent)
+		if err := rows.Scan(&event.Id, &event.Type, &event.OccurredAt, &event.ReceivedAt); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// handlePostcardReturnedTx deals with a physical postcard Lob reports as
+// returned to sender. Unless the recipient has changed their address since
+// the postcard was sent, the address is marked unverified and physical mail
+// to them is paused until they re-confirm it. The sender's credit is
+// refunded and both are notified.
+func handlePostcardReturnedTx(tx *sql.Tx, lobPostcardId string) error {
+	var postcardId int64
+	var fromRecurseId, toRecurseId int
+	var mode string
+	var creditTransactionId, toContactId sql.NullInt64
+	var createdAt time.Time
+	err := tx.QueryRow(
+		"SELECT id, from_rc_id, to_rc_id, to_contact_id, mode, credit_transaction_id, created_at FROM postcards WHERE lob_id = $1 FOR UPDATE",
+		lobPostcardId).Scan(&postcardId, &fromRecurseId, &toRecurseId, &toContactId, &mode, &creditTransactionId, &createdAt)
+	if err == sql.ErrNoRows {
+		log.Printf("Returned postcard %s is not one of ours\n", lobPostcardId)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if mode != PhysicalSend {
+		return nil
+	}
+
+	// postcards to address book contacts or the organization have no
+	// recipient account to flag
+	var flagged int64
+	if !toContactId.Valid && toRecurseId != 0 {
+		result, err := tx.Exec(
+			`UPDATE user_info SET address_verified = FALSE
+			WHERE recurse_id = $1 AND address_verified AND (address_updated_at IS NULL OR address_updated_at < $2)`,
+			toRecurseId,
+			createdAt)
+		if err != nil {
+			return err
+		}
+		if flagged, err = result.RowsAffected(); err != nil {
+			return err
+		}
+	}
+
+	if creditTransactionId.Valid {
+		if err = refundCreditsTx(tx, creditTransactionId.Int64); err != nil {
+			return err
+		}
+	}
+
+	if err = insertNotificationTx(tx, fromRecurseId, NotificationPostcardReturned,
+		"A postcard you sent was returned to sender, so your credit has been refunded.", postcardId); err != nil {
+		return err
+	}
+	if flagged > 0 {
+		return insertNotificationTx(tx, toRecurseId, NotificationAddressUnverified,
+			"A postcard sent to you was returned to sender. Please re-confirm your address to receive physical mail again.", postcardId)
+	}
+	return nil
+}
+
+func insertNotificationTx(tx *sql.Tx, recurseId int, kind, message string, postcardId int64) error {
+	_, err := tx.Exec(
+		"INSERT INTO notifications (recurse_id, kind, message, postcard_id) VALUES ($1, $2, $3, NULLIF($4, 0))",
+		recurseId,
+		kind,
+		message,
+		postcardId)
+	return err
+}
+
+// getNotifications returns a user's most recent notifications, newest first.
+func (*PostgresClient) getNotifications(recurseId int, unreadOnly bool, limit int) ([]*Notification, error) {
+	notifications := []*Notification{}
+	rows, err := db.Query(
+		`SELECT id, kind, message, COALESCE(postcard_id, 0), created_at, read_at FROM notifications
+		WHERE recurse_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY id DESC LIMIT $3`,
+		recurseId,
+		unreadOnly,
+		limit)
+	if err != nil {
+		log.Printf("Query failed: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		notification := new(Notification)
+		var readAt sql.NullTime
+		if err := rows.Scan(&notification.Id, &notification.Kind, &notification.Message, &notification.PostcardId, &notification.CreatedAt, &readAt); err != nil {
+			log.Printf("Reading row failed: %v\n", err)
+			return nil, err
+		}
+		if readAt.Valid {
+			notification.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, rows.Err()
+}
+
+// markNotificationsRead marks one of a user's notifications as read, or all
+// of them if id is zero.
+func (*PostgresClient) markNotificationsRead(recurseId int, id int64) error {
+	result, err := db.Exec(
+		"UPDATE notifications SET read_at = COALESCE(read_at, now()) WHERE recurse_id = $1 AND ($2 = 0 OR id = $2)",
+		recurseId,
+		id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 && id != 0 {
+		return errNotFound
+	}
 	return nil
 }
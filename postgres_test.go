@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go"
+)
+
+// useTestDatabase points db at a fresh schema in the Postgres database at
+// TEST_DATABASE_URL for the duration of the test, and skips the test if it is
+// not set. `make pg` starts a database that `make test-pg` runs against.
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	databaseUrl := os.Getenv("TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("pgx", databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaName := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("CREATE SCHEMA " + schemaName); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schemaName)
+	u.RawQuery = query.Encode()
+	t.Setenv("PG_DATABASE_URL", u.String())
+
+	previous := db
+	t.Cleanup(func() {
+		if db != nil && db != previous {
+			db.Close()
+		}
+		db = previous
+		if _, err := admin.Exec("DROP SCHEMA " + schemaName + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+	if err = postgresClient.setupPostgresConnection(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// insertTestUser creates a user with numCredits credits.
+func insertTestUser(t *testing.T, recurseId, numCredits int) {
+	t.Helper()
+	if err := postgresClient.insertUser(recurseId, fmt.Sprintf("User %d", recurseId), fmt.Sprintf("user%d@example.com", recurseId), "", numCredits); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertCredits(t *testing.T, recurseId, want int) {
+	t.Helper()
+	got, err := postgresClient.getCredits(recurseId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("user %d has %d credits, want %d", recurseId, got, want)
+	}
+}
+
+// purchaseCredits records a live purchase of numCredits with paymentIntentId.
+func purchaseCredits(t *testing.T, recurseId, numCredits int, paymentIntentId string) {
+	t.Helper()
+	if _, err := postgresClient.processStripeEvent("evt_purchase_"+paymentIntentId, "checkout.session.completed", true, []byte("{}"), func(tx *sql.Tx) error {
+		return addCreditsTx(tx, creditTransaction{
+			RecurseId:             recurseId,
+			Amount:                numCredits,
+			Kind:                  CreditPurchase,
+			StripePaymentIntentId: paymentIntentId,
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// refundCharge handles a charge.refunded event for a 1000 cent charge made
+// with paymentIntentId, of which amountRefunded has been refunded in total.
+func refundCharge(t *testing.T, eventId, paymentIntentId string, amountRefunded int64) (alreadyHandled bool) {
+	t.Helper()
+	charge := stripe.Charge{ID: "ch_" + paymentIntentId, PaymentIntent: paymentIntentId, Amount: 1000, AmountRefunded: amountRefunded}
+	alreadyHandled, err := postgresClient.processStripeEvent(eventId, "charge.refunded", true, []byte("{}"), func(tx *sql.Tx) error {
+		return handleChargeRefunded(tx, eventId, charge)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alreadyHandled
+}
+
+func TestPartialRefundsRevokeRoundedCredits(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 1, 0)
+	purchaseCredits(t, 1, 5, "pi_1")
+
+	// Stripe reports the total refunded so far: 1.5 credits round to 2
+	refundCharge(t, "evt_refund_1", "pi_1", 300)
+	assertCredits(t, 1, 3)
+
+	// 2.5 credits round to 3, of which 2 are already revoked
+	refundCharge(t, "evt_refund_2", "pi_1", 500)
+	assertCredits(t, 1, 2)
+
+	// a redelivered event is not applied twice
+	if !refundCharge(t, "evt_refund_2", "pi_1", 500) {
+		t.Error("expected the redelivered event to be reported as already handled")
+	}
+	assertCredits(t, 1, 2)
+
+	// an event arriving late with a smaller total takes nothing more
+	refundCharge(t, "evt_refund_3", "pi_1", 400)
+	assertCredits(t, 1, 2)
+
+	refundCharge(t, "evt_refund_4", "pi_1", 1000)
+	assertCredits(t, 1, 0)
+}
+
+func TestDisputeRevokesSpentCredits(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 1, 0)
+	purchaseCredits(t, 1, 5, "pi_1")
+
+	transactionId, err := postgresClient.reserveCredits(1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = postgresClient.commitCredits(transactionId, "psc_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = postgresClient.processStripeEvent("evt_dispute_1", "charge.dispute.created", true, []byte("{}"), func(tx *sql.Tx) error {
+		return handleChargeDisputeCreated(tx, "evt_dispute_1", stripe.Dispute{ID: "dp_1", PaymentIntent: &stripe.PaymentIntent{ID: "pi_1"}})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertCredits(t, 1, -4)
+
+	var flagged bool
+	if err = db.QueryRow("SELECT credits_flagged_at IS NOT NULL FROM user_info WHERE recurse_id = 1").Scan(&flagged); err != nil {
+		t.Fatal(err)
+	}
+	if !flagged {
+		t.Error("expected a negative balance to flag the user")
+	}
+
+	var recurseId sql.NullInt64
+	if err = db.QueryRow("SELECT recurse_id FROM stripe_events WHERE id = 'evt_dispute_1'").Scan(&recurseId); err != nil {
+		t.Fatal(err)
+	}
+	if recurseId.Int64 != 1 {
+		t.Errorf("dispute event recorded for user %v, want 1", recurseId)
+	}
+}
+
+func TestConcurrentReservesCantOverdraw(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 1, 3)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := postgresClient.reserveCredits(1, 1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	reserved := 0
+	for err := range errs {
+		if err == nil {
+			reserved++
+		} else if err != errInsufficientCredits {
+			t.Fatal(err)
+		}
+	}
+	if reserved != 3 {
+		t.Errorf("reserved %d credits out of 3", reserved)
+	}
+	assertCredits(t, 1, 0)
+}
+
+func TestRefundCreditsOnce(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 1, 5)
+
+	transactionId, err := postgresClient.reserveCredits(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a send failing while its cancellation refunds it
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := postgresClient.refundCredits(transactionId); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assertCredits(t, 1, 5)
+
+	if err = postgresClient.refundCredits(transactionId); err != nil {
+		t.Fatal(err)
+	}
+	assertCredits(t, 1, 5)
+}
+
+func TestRefundCommittedCredits(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 1, 5)
+
+	transactionId, err := postgresClient.reserveCredits(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = postgresClient.commitCredits(transactionId, "psc_1"); err != nil {
+		t.Fatal(err)
+	}
+	assertCredits(t, 1, 3)
+
+	// a cancelled postcard is refunded after its credit was spent
+	for i := 0; i < 2; i++ {
+		if err = postgresClient.refundCredits(transactionId); err != nil {
+			t.Fatal(err)
+		}
+		assertCredits(t, 1, 5)
+	}
+}
+
+// assertMailingAddress checks where physical mail to recurseId goes and
+// whether it can be sent.
+func assertMailingAddress(t *testing.T, recurseId int, wantLobAddressId string, wantAccepts bool) {
+	t.Helper()
+	lobAddressId, acceptsPhysicalMail, err := postgresClient.getMailingAddress(recurseId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lobAddressId != wantLobAddressId || acceptsPhysicalMail != wantAccepts {
+		t.Errorf("mail goes to %q (accepted: %v), want %q (accepted: %v)", lobAddressId, acceptsPhysicalMail, wantLobAddressId, wantAccepts)
+	}
+}
+
+func TestOnlyANewDefaultAddressResumesReturnedMail(t *testing.T) {
+	useTestDatabase(t)
+	insertTestUser(t, 1, 0)
+
+	if _, err := postgresClient.saveAddress(1, "home", "adr_1", true, true, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := postgresClient.saveAddress(1, "office", "adr_2", true, false, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	assertMailingAddress(t, 1, "adr_1", true)
+
+	returnMail := func() {
+		t.Helper()
+		if _, err := db.Exec("UPDATE user_info SET address_verified = FALSE WHERE recurse_id = 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	returnMail()
+
+	// saving another address or picking the same default again isn't a fix
+	if _, err := postgresClient.saveAddress(1, "summer", "adr_3", true, false, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	assertMailingAddress(t, 1, "adr_1", false)
+	if err := postgresClient.setDefaultAddress(1, "home", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	assertMailingAddress(t, 1, "adr_1", false)
+
+	// switching to another saved address is
+	if err := postgresClient.setDefaultAddress(1, "office", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	assertMailingAddress(t, 1, "adr_2", true)
+
+	// and so is a scheduled switch taking effect
+	returnMail()
+	now := time.Now()
+	if err := postgresClient.setDefaultAddress(1, "summer", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := postgresClient.applyDueAddressChange(now.Add(2 * time.Hour)); err != nil || !applied {
+		t.Fatalf("got %v, %v, want the scheduled change applied", applied, err)
+	}
+	assertMailingAddress(t, 1, "adr_3", true)
+
+	// as is saving a new address over the default
+	returnMail()
+	if _, err := postgresClient.saveAddress(1, "summer", "adr_4", true, false, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	assertMailingAddress(t, 1, "adr_4", true)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+const schedulerInterval = time.Minute
+
+// runPostcardScheduler applies scheduled address changes and sends scheduled
+// postcards to Lob as they fall due. It is safe to run on several instances
+// at once.
+func runPostcardScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// address changes first, so postcards due at the same time go to
+		// the new address
+		for {
+			applied, err := postgresClient.applyDueAddressChange(time.Now())
+			if err != nil {
+				log.Printf("Error applying scheduled address change: %v\n", err)
+			}
+			if !applied || err != nil {
+				break
+			}
+		}
+		for {
+			sent, err := dispatchScheduledPostcard(time.Now())
+			if err != nil {
+				log.Printf("Error sending scheduled postcard: %v\n", err)
+			}
+			if !sent || err != nil {
+				break
+			}
+		}
+		if err := reconcilePendingPostcards(time.Now()); err != nil {
+			log.Printf("Error reconciling pending postcards: %v\n", err)
+		}
+		if err := reconcilePendingLetters(time.Now()); err != nil {
+			log.Printf("Error reconciling pending letters: %v\n", err)
+		}
+		if err := reconcileCancellingPostcards(); err != nil {
+			log.Printf("Error reconciling cancelled postcards: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+// pendingPostcardTimeout is how long a postcard can stay pending before it
+// is assumed that sending it was interrupted.
+const pendingPostcardTimeout = time.Hour
+
+// reconcilePendingPostcards settles postcards left pending because Lob
+// didn't answer when they were sent, by looking them up at Lob by their
+// idempotency key. Those Lob has are recorded as sent, the rest are marked
+// failed and refunded.
+func reconcilePendingPostcards(now time.Time) error {
+	postcards, err := postgresClient.getPendingPostcards(now.Add(-pendingPostcardTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, postcard := range postcards {
+		lobPostcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{Metadata: map[string]string{"idempotency_key": postcard.lobIdempotencyKey()}}, postcard.Mode == PhysicalSend)
+		if err != nil {
+			return err
+		}
+
+		if len(lobPostcards.Data) == 0 {
+			log.Printf("Lob never got pending postcard %d\n", postcard.Id)
+			if err = failPendingPostcard(postcard); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lobPostcard := lobPostcards.Data[0]
+		log.Printf("Recording pending postcard %d as Lob postcard %s\n", postcard.Id, lobPostcard.Id)
+		postcard.LobId = lobPostcard.Id
+		postcard.Status = PostcardCreated
+		if postcard.Mode == DigitalSend {
+			postcard.Status = PostcardDelivered
+		} else {
+			postcard.SendAt = &lobPostcard.SendDate
+		}
+		if expectedDeliveryDate, err := time.Parse("2006-01-02", lobPostcard.ExpectedDeliveryDate); err == nil {
+			postcard.ExpectedDeliveryDate = &expectedDeliveryDate
+		}
+		if err = postgresClient.completePostcard(postcard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcilePendingLetters settles letters left pending the way
+// reconcilePendingPostcards settles postcards.
+func reconcilePendingLetters(now time.Time) error {
+	letters, err := postgresClient.getPendingLetters(now.Add(-pendingPostcardTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, letter := range letters {
+		lobLetters, err := lobClient.GetLetters(lob.GetLettersParams{Metadata: map[string]string{"idempotency_key": letter.lobIdempotencyKey()}}, letter.Mode == PhysicalSend)
+		if err != nil {
+			return err
+		}
+
+		if len(lobLetters.Data) == 0 {
+			log.Printf("Lob never got pending letter %d\n", letter.Id)
+			if err = failPendingLetter(letter); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lobLetter := lobLetters.Data[0]
+		log.Printf("Recording pending letter %d as Lob letter %s\n", letter.Id, lobLetter.Id)
+		letter.LobId = lobLetter.Id
+		letter.Status = PostcardCreated
+		if letter.Mode == DigitalSend {
+			letter.Status = PostcardDelivered
+		}
+		if expectedDeliveryDate, err := time.Parse("2006-01-02", lobLetter.ExpectedDeliveryDate); err == nil {
+			letter.ExpectedDeliveryDate = &expectedDeliveryDate
+		}
+		if err = postgresClient.completeLetter(letter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileCancellingPostcards finishes cancelling postcards whose
+// cancellation was interrupted, either before or after Lob cancelled them.
+func reconcileCancellingPostcards() error {
+	postcards, err := postgresClient.getCancellingPostcards()
+	if err != nil {
+		return err
+	}
+
+	for _, postcard := range postcards {
+		// Lob only refuses once the postcard is in production
+		if err = cancelAtLob(postcard); err == errNotCancellable {
+			log.Printf("Postcard %d was mailed before it could be cancelled\n", postcard.Id)
+		} else if err != nil && err != errCancellationSettled {
+			return err
+		}
+	}
+	return nil
+}
+
+// failPendingPostcard fails and refunds a postcard Lob never got, and lets
+// the sender know.
+func failPendingPostcard(postcard *Postcard) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if pending, err := failPostcardTx(tx, postcard.Id, postcard.CreditTransactionId); err != nil || !pending {
+		return err
+	}
+	message := "A postcard you sent couldn't be sent because Lob didn't respond."
+	if postcard.CreditTransactionId != 0 {
+		message = "A postcard you sent couldn't be sent because Lob didn't respond, so your credit has been refunded."
+	}
+	if err = insertNotificationTx(tx, postcard.FromRecurseId, NotificationPostcardFailed, message, postcard.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failPendingLetter fails and refunds a letter Lob never got, and lets the
+// sender know.
+func failPendingLetter(letter *Letter) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if pending, err := failLetterTx(tx, letter.Id, letter.CreditTransactionId); err != nil || !pending {
+		return err
+	}
+	message := "A letter you sent couldn't be sent because Lob didn't respond."
+	if letter.CreditTransactionId != 0 {
+		message = "A letter you sent couldn't be sent because Lob didn't respond, so your credits have been refunded."
+	}
+	if err = insertNotificationTx(tx, letter.FromRecurseId, NotificationLetterFailed, message, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// maxScheduledPostcardAttempts is how many times sending a scheduled
+// postcard can fail before it is given up on and refunded.
+const maxScheduledPostcardAttempts = 10
+
+// scheduledPostcardBackoff is how long to wait before trying a scheduled
+// postcard again after it failed attempts times: a minute, doubling up to six
+// hours.
+func scheduledPostcardBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < 6*time.Hour; i++ {
+		backoff *= 2
+	}
+	if backoff > 6*time.Hour {
+		backoff = 6 * time.Hour
+	}
+	return backoff
+}
+
+// dispatchScheduledPostcard sends the most overdue scheduled postcard due by
+// now, if there is one. Postcards Lob rejects, or whose recipient no longer
+// accepts physical mail, are marked failed and refunded. On other errors the
+// postcard is tried again later, so that it doesn't hold up the others.
+func dispatchScheduledPostcard(now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	scheduled, err := claimDueScheduledPostcardTx(tx, now)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err = sendScheduledPostcardTx(tx, scheduled); err != nil {
+		nextAttemptAt := now.Add(scheduledPostcardBackoff(scheduled.Attempts + 1))
+		log.Printf("Error sending scheduled postcard %d, trying again at %v: %v\n", scheduled.Id, nextAttemptAt, err)
+		if err = postponeScheduledPostcardTx(tx, scheduled.Id, nextAttemptAt); err != nil {
+			return false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("recording scheduled postcard %d: %w", scheduled.Id, err)
+	}
+	return true, nil
+}
+
+// sendScheduledPostcardTx sends a claimed scheduled postcard to Lob and
+// records the outcome in tx, unless it returns an error.
+func sendScheduledPostcardTx(tx *sql.Tx, scheduled *scheduledPostcard) error {
+	if scheduled.Attempts > 0 {
+		// an earlier attempt may have reached Lob after all
+		lobPostcards, err := lobClient.GetPostcards(lob.GetPostcardsParams{Metadata: map[string]string{"idempotency_key": scheduled.lobIdempotencyKey()}}, true)
+		if err != nil {
+			return err
+		}
+		if len(lobPostcards.Data) > 0 {
+			lobPostcard := lobPostcards.Data[0]
+			return completeScheduledPostcardTx(tx, scheduled.Id, scheduled.CreditTransactionId, lobPostcard.Id, parseExpectedDeliveryDate(lobPostcard.ExpectedDeliveryDate))
+		}
+		if scheduled.Attempts >= maxScheduledPostcardAttempts {
+			log.Printf("Giving up on scheduled postcard %d after %d attempts\n", scheduled.Id, scheduled.Attempts)
+			return failScheduledPostcardTx(tx, scheduled, "Lob couldn't be reached")
+		}
+	}
+
+	_, _, _, senderName, err := postgresClient.getUserInfo(scheduled.FromRecurseId)
+	if err != nil {
+		return err
+	}
+	recipientAddressId, recipientAcceptsPhysicalMail, err := postgresClient.getMailingAddress(scheduled.ToRecurseId)
+	if err != nil {
+		return err
+	}
+
+	if scheduled.ToContactId == 0 && scheduled.ToRecurseId != 0 && !recipientAcceptsPhysicalMail {
+		log.Printf("Recipient %d of scheduled postcard %d no longer accepts physical mail\n", scheduled.ToRecurseId, scheduled.Id)
+		return failScheduledPostcardTx(tx, scheduled, "the recipient no longer accepts physical mail")
+	}
+
+	fromAddress, err := senderReturnAddress(scheduled.FromRecurseId, senderName)
+	if err != nil {
+		return err
+	}
+	toAddress := org.address(org.Name)
+	if scheduled.ToContactId != 0 {
+		contact, err := postgresClient.getAddressBookContact(scheduled.FromRecurseId, scheduled.ToContactId)
+		if err == errNotFound {
+			log.Printf("Contact %d of scheduled postcard %d has been deleted\n", scheduled.ToContactId, scheduled.Id)
+			return failScheduledPostcardTx(tx, scheduled, "the contact was removed from your address book")
+		} else if err != nil {
+			return err
+		}
+		toAddress = lob.LobAddress{AddressId: contact.lobAddressId}
+	} else if scheduled.ToRecurseId != 0 {
+		toAddress = lob.LobAddress{AddressId: recipientAddressId}
+	}
+
+	lobCreatePostcardResponse, lobError := lobClient.CreatePostCard(fromAddress, toAddress, scheduled.FrontImage, scheduled.BackHtml, true, scheduled.FromRecurseId, scheduled.ToRecurseId, PhysicalSend, scheduled.Size, time.Time{}, scheduled.lobIdempotencyKey())
+	if lobError != nil && lobError.Transient() {
+		return lobError
+	} else if lobError != nil {
+		log.Printf("Lob rejected scheduled postcard %d: %v\n", scheduled.Id, lobError)
+		return failScheduledPostcardTx(tx, scheduled, "Lob rejected it")
+	}
+
+	// if this isn't committed the postcard stays scheduled, and sending it
+	// again gets back the postcard Lob already has thanks to the idempotency
+	// key
+	return completeScheduledPostcardTx(tx, scheduled.Id, scheduled.CreditTransactionId, lobCreatePostcardResponse.Id, parseExpectedDeliveryDate(lobCreatePostcardResponse.ExpectedDeliveryDate))
+}
+
+// parseExpectedDeliveryDate parses Lob's expected_delivery_date, or returns
+// nil if it has none.
+func parseExpectedDeliveryDate(s string) *time.Time {
+	date, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil
+	}
+	return &date
+}
+
+func failScheduledPostcardTx(tx *sql.Tx, scheduled *scheduledPostcard, reason string) error {
+	if err := endScheduledPostcardTx(tx, scheduled.Id, scheduled.CreditTransactionId, PostcardFailed); err != nil {
+		return err
+	}
+	return insertNotificationTx(tx, scheduled.FromRecurseId, NotificationPostcardFailed,
+		fmt.Sprintf("A postcard you scheduled couldn't be sent because %s, so your credit has been refunded.", reason), scheduled.Id)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	lob "github.com/rc-postcard/rc-postcard/lob"
+)
+
+func TestScheduledPostcardBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	} {
+		if got := scheduledPostcardBackoff(test.attempts); got != test.want {
+			t.Errorf("after %d attempts: got %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestSchedulerRetriesUnansweredPostcardsLater(t *testing.T) {
+	useTestDatabase(t)
+	server := useLobtest(t)
+	insertTestUser(t, 7, 5)
+
+	now := time.Now()
+	var postcardIds []int64
+	for i := 0; i < 2; i++ {
+		creditTransactionId, err := postgresClient.reserveCredits(7, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendAt := now.Add(time.Duration(i-2) * time.Hour)
+		postcard := &Postcard{FromRecurseId: 7, Mode: PhysicalSend, Size: lob.Size4x6, CreditTransactionId: creditTransactionId, SendAt: &sendAt, Status: PostcardScheduled}
+		if err = postgresClient.insertScheduledPostcard(postcard, frontImage(t, lob.Size4x6), "hello"); err != nil {
+			t.Fatal(err)
+		}
+		postcardIds = append(postcardIds, postcard.Id)
+	}
+
+	// with Lob unreachable, the first postcard doesn't hold up the second
+	server.Close()
+	for i := 0; i < 2; i++ {
+		if sent, err := dispatchScheduledPostcard(now); !sent || err != nil {
+			t.Fatalf("dispatch %d: got %v, %v", i, sent, err)
+		}
+	}
+	if sent, err := dispatchScheduledPostcard(now); sent || err != nil {
+		t.Fatalf("expected both postcards to wait, got %v, %v", sent, err)
+	}
+	var attempts int
+	if err := db.QueryRow("SELECT attempts FROM scheduled_postcards WHERE postcard_id = $1", postcardIds[0]).Scan(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Errorf("recorded %d attempts, want 1", attempts)
+	}
+
+	server = useLobtest(t)
+	for _, postcardId := range postcardIds {
+		if sent, err := dispatchScheduledPostcard(now.Add(scheduledPostcardBackoff(1))); !sent || err != nil {
+			t.Fatalf("postcard %d: got %v, %v", postcardId, sent, err)
+		}
+		postcard, err := postgresClient.getPostcard(postcardId, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if postcard.Status != PostcardCreated || postcard.LobId == "" {
+			t.Errorf("postcard %d: got status %s and Lob id %q", postcardId, postcard.Status, postcard.LobId)
+		}
+	}
+	if len(server.Postcards("live_key")) != 2 {
+		t.Errorf("got %d postcards at Lob, want 2", len(server.Postcards("live_key")))
+	}
+	assertCredits(t, 7, 3)
+}
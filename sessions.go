@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	sessionCookieName = "session_token"
+
+	// sessionAbsoluteTimeout is how long a session lasts after login,
+	// however active it is.
+	sessionAbsoluteTimeout = 30 * 24 * time.Hour
+	// sessionIdleTimeout is how long a session lasts without requests.
+	sessionIdleTimeout = 7 * 24 * time.Hour
+)
+
+var errSessionNotFound = errors.New("Session not found")
+
+// SessionStore stores browser login sessions, keyed by the token in the
+// session_token cookie. Get returns a copy, so changes to a session must be
+// written back with Save.
+type SessionStore interface {
+	Create(session *Session) (token string, err error)
+	// Get returns errSessionNotFound for unknown and expired sessions, and
+	// otherwise marks the session as active.
+	Get(token string) (*Session, error)
+	Save(token string, session *Session) error
+	Delete(token string) error
+}
+
+// sessionStore is replaced by a postgresSessionStore in main.
+var sessionStore SessionStore = newMemorySessionStore()
+
+// sessionExpired reports whether a session created at createdAt and last
+// used at lastSeenAt has expired at now.
+func sessionExpired(createdAt, lastSeenAt, now time.Time) bool {
+	return now.Sub(createdAt) > sessionAbsoluteTimeout || now.Sub(lastSeenAt) > sessionIdleTimeout
+}
+
+type memorySession struct {
+	session    Session
+	createdAt  time.Time
+	lastSeenAt time.Time
+}
+
+// memorySessionStore is a SessionStore for tests.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+	now      func() time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: map[string]*memorySession{},
+		now:      time.Now,
+	}
+}
+
+func (m *memorySessionStore) Create(session *Session) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token := uuid.NewString()
+	now := m.now()
+	m.sessions[token] = &memorySession{session: *session, createdAt: now, lastSeenAt: now}
+	return token, nil
+}
+
+func (m *memorySessionStore) Get(token string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[token]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	now := m.now()
+	if sessionExpired(s.createdAt, s.lastSeenAt, now) {
+		delete(m.sessions, token)
+		return nil, errSessionNotFound
+	}
+	s.lastSeenAt = now
+
+	session := s.session
+	return &session, nil
+}
+
+func (m *memorySessionStore) Save(token string, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[token]
+	if !ok {
+		return errSessionNotFound
+	}
+	s.session = *session
+	return nil
+}
+
+func (m *memorySessionStore) Delete(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, token)
+	return nil
+}
+
+// postgresSessionStore keeps sessions in the sessions table so they survive
+// deploys. Only a hash of each token is stored.
+type postgresSessionStore struct{}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (*postgresSessionStore) Create(session *Session) (string, error) {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	// logins are rare enough to clean up expired sessions here
+	now := time.Now()
+	if _, err = db.Exec(
+		"DELETE FROM sessions WHERE created_at < $1 OR last_seen_at < $2",
+		now.Add(-sessionAbsoluteTimeout),
+		now.Add(-sessionIdleTimeout)); err != nil {
+		return "", err
+	}
+
+	token := uuid.NewString()
+	if _, err = db.Exec(
+		"INSERT INTO sessions (token_hash, session, created_at, last_seen_at) VALUES ($1, $2, $3, $3)",
+		hashSessionToken(token),
+		string(sessionJSON),
+		now); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (*postgresSessionStore) Get(token string) (*Session, error) {
+	now := time.Now()
+	var sessionJSON string
+	err := db.QueryRow(
+		"UPDATE sessions SET last_seen_at = $4 WHERE token_hash = $1 AND created_at >= $2 AND last_seen_at >= $3 RETURNING session",
+		hashSessionToken(token),
+		now.Add(-sessionAbsoluteTimeout),
+		now.Add(-sessionIdleTimeout),
+		now).Scan(&sessionJSON)
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err = json.Unmarshal([]byte(sessionJSON), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (*postgresSessionStore) Save(token string, session *Session) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		"UPDATE sessions SET session = $2 WHERE token_hash = $1",
+		hashSessionToken(token),
+		string(sessionJSON))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+func (*postgresSessionStore) Delete(token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = $1", hashSessionToken(token))
+	return err
+}
+
+// setSessionCookie sets the session_token cookie. An empty token clears it.
+func setSessionCookie(w http.ResponseWriter, token string) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionAbsoluteTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(appBaseUrl(), "https://"),
+		// Lax rather than Strict so the cookie is sent on the redirect back
+		// from the OAuth provider.
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useMemorySessionStore gives the test a fresh session store with a
+// controllable clock.
+func useMemorySessionStore(t *testing.T) (*memorySessionStore, *time.Time) {
+	store := newMemorySessionStore()
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	previous := sessionStore
+	sessionStore = store
+	t.Cleanup(func() { sessionStore = previous })
+	return store, &now
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	store, now := useMemorySessionStore(t)
+
+	token, err := store.Create(&Session{State: "state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// staying active keeps the session alive until the absolute timeout
+	step := 6 * 24 * time.Hour
+	for elapsed := step; elapsed <= sessionAbsoluteTimeout; elapsed += step {
+		*now = now.Add(step)
+		if _, err := store.Get(token); err != nil {
+			t.Fatalf("session expired early after %v: %v", elapsed, err)
+		}
+	}
+	*now = now.Add(step)
+	if _, err := store.Get(token); err != errSessionNotFound {
+		t.Errorf("expected session to hit the absolute timeout, got %v", err)
+	}
+
+	token, _ = store.Create(&Session{})
+	*now = now.Add(sessionIdleTimeout + time.Minute)
+	if _, err := store.Get(token); err != errSessionNotFound {
+		t.Errorf("expected session to hit the idle timeout, got %v", err)
+	}
+}
+
+func TestMemorySessionStoreSaveAndDelete(t *testing.T) {
+	store, _ := useMemorySessionStore(t)
+
+	token, _ := store.Create(&Session{State: "state"})
+	session, err := store.Get(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.User = User{Id: 7}
+	if got, _ := store.Get(token); got.isAuthenticated() {
+		t.Error("changes must not be visible before Save")
+	}
+	if err := store.Save(token, session); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(token); got.Id != 7 {
+		t.Errorf("got user %d after Save, want 7", got.Id)
+	}
+
+	store.Delete(token)
+	if _, err := store.Get(token); err != errSessionNotFound {
+		t.Errorf("expected deleted session to be gone, got %v", err)
+	}
+}
+
+func TestLoginAndLogout(t *testing.T) {
+	store, _ := useMemorySessionStore(t)
+	previousRedirectURL := oauthConf.RedirectURL
+	oauthConf.RedirectURL = "https://postcards.example.com/auth"
+	t.Cleanup(func() { oauthConf.RedirectURL = previousRedirectURL })
+
+	w := httptest.NewRecorder()
+	serveLogin(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("got status %d, want redirect", w.Code)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != sessionCookieName || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("unexpected cookie attributes %+v", cookie)
+	}
+	if _, err := store.Get(cookie.Value); err != nil {
+		t.Fatalf("session not stored: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	serveLogout(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	if _, err := store.Get(cookie.Value); err != errSessionNotFound {
+		t.Errorf("expected session to be destroyed, got %v", err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("expected logout to clear the cookie, got %+v", cookies)
+	}
+}
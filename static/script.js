@@ -7,6 +7,14 @@ window.onload = function () {
     const submitAddress = document.getElementById('submitAddress');
     const addressDiv = document.getElementById('addressDiv')
     const postcardImageInput = document.getElementById("postcardFileInput")
+    const sizeSelector = document.getElementById("sizeSelector")
+    // full bleed dimensions of each postcard size, in inches and in pixels at 300 DPI
+    const sizeInches = { "4x6": [6.25, 4.25], "6x9": [9.25, 6.25], "6x11": [11.25, 6.25] }
+    const sizeMinWidth = { "4x6": 1875, "6x9": 2775, "6x11": 3375 }
+    function sizeAspect() {
+        const [width, height] = sizeInches[sizeSelector.value]
+        return width / height
+    }
     const cropButton = document.getElementById("crop")
     const submitPreviewPhotoButton = document.getElementById('submitPreviewPhoto');
     const submitPostcardButton = document.getElementById('submitPostcard')
@@ -24,16 +32,62 @@ window.onload = function () {
     let credits = 0;
     let address;
 
-    function updateStripeLink(paymentId, recurseId, email) {
-        const queryParams = {
-            client_reference_id: recurseId,
-            prefilled_email: email
-        };
-        
-        const searchParams = new URLSearchParams(queryParams);
-        const stripeLink = document.getElementById("stripeLink");
-        stripeLink.href = "https://buy.stripe.com/" + paymentId + "?" + searchParams;
-    }
+    const creditPackSelector = document.getElementById("creditPackSelector")
+    const buyCreditsButton = document.getElementById("buyCreditsButton")
+    const buyCreditsStatusLabel = document.getElementById("buyCreditsStatusLabel")
+
+    fetch("/credits").then(response =>
+        response.json()
+    ).then(data => {
+        for (let pack of data["packs"] || []) {
+            var opt = document.createElement('option')
+            opt.value = pack
+            opt.innerText = pack === 1 ? "1 credit" : pack + " credits"
+            creditPackSelector.appendChild(opt)
+        }
+    })
+
+    buyCreditsButton.addEventListener('click', function () {
+        let formData = new URLSearchParams()
+        formData.append("pack", creditPackSelector.value)
+        formData.append("quantity", 1)
+        fetch("/credits/checkout", { method: "POST", body: formData }).then(response => {
+            if (!response.ok) {
+                throw new Error(response.statusText)
+            }
+            return response.json()
+        }).then(data => {
+            window.location.href = data["url"]
+        }).catch(function (error) {
+            buyCreditsStatusLabel.innerText = "Error starting checkout."
+            buyCreditsStatusLabel.style = "background-color: red"
+        })
+    })
+
+    const notificationsDiv = document.getElementById("notificationsDiv")
+    const notificationsList = document.getElementById("notificationsList")
+    const dismissNotificationsButton = document.getElementById("dismissNotificationsButton")
+
+    fetch("/notifications?unread=true").then(response =>
+        response.json()
+    ).then(data => {
+        for (let notification of data["notifications"] || []) {
+            var item = document.createElement('li')
+            item.innerText = notification["message"]
+            notificationsList.appendChild(item)
+        }
+        if (notificationsList.children.length > 0) {
+            notificationsDiv.style.display = "block"
+        }
+    })
+
+    dismissNotificationsButton.addEventListener('click', function () {
+        fetch("/notifications", { method: "POST" }).then(response => {
+            if (response.ok) {
+                notificationsDiv.style.display = "none"
+            }
+        })
+    })
 
     fetch("/addresses").then(response =>
         response.json()
@@ -46,8 +100,39 @@ window.onload = function () {
         document.getElementById("state").innerText = data["address_state"]
         document.getElementById("zip").innerText = data["address_zip"]
         document.getElementById("acceptsPhysicalMail").innerText = data["acceptsPhysicalMail"]
+        if (!data["addressVerified"]) {
+            document.getElementById("acceptsPhysicalMail").innerText += " (mail to this address was returned, please re-confirm it)"
+        }
+    })
+
+    const returnAddressSelector = document.getElementById("returnAddressSelector")
+    const returnAddressLabel = document.getElementById("returnAddressLabel")
+    returnAddressSelector.addEventListener('change', function () {
+        returnAddressLabel.style.display = returnAddressSelector.value === "alternate" ? "inline" : "none"
+    })
+
+    fetch("/addresses/return").then(response =>
+        response.json()
+    ).then(data => {
+        returnAddressSelector.value = data["returnAddress"]
+        returnAddressLabel.value = data["label"] || ""
+        returnAddressSelector.dispatchEvent(new Event('change'))
+    })
 
-        updateStripeLink(data["stripePaymentLinkId"], data["recurse_id"], data["email"]);
+    document.getElementById("submitReturnAddress").addEventListener('click', function () {
+        let statusLabel = document.getElementById("submitReturnAddressStatusLabel")
+        let params = new URLSearchParams({ "returnAddress": returnAddressSelector.value, "label": returnAddressLabel.value })
+        fetch("/addresses/return", { method: "POST", body: params }).then(response => {
+            if (response.ok) {
+                statusLabel.style = ""
+                statusLabel.innerText = "Saved!"
+            } else {
+                return response.text().then(text => {
+                    statusLabel.style = "background-color: red"
+                    statusLabel.innerText = text
+                })
+            }
+        })
     })
 
     fetch("/contacts").then(response =>
@@ -155,12 +240,12 @@ window.onload = function () {
             preview.onload = function () {
                 const cropper = document.getElementById("cropper");
                 const previewRect = preview.getBoundingClientRect();
-                if (previewRect.height >= previewRect.width * 4.25 / 6.25) {
+                if (previewRect.height >= previewRect.width / sizeAspect()) {
                     cropper.style.width = "calc(100% - 20px)";
-                    cropper.style.height = `${(previewRect.width - 20) * 4.25 / 6.25}px`;
+                    cropper.style.height = `${(previewRect.width - 20) / sizeAspect()}px`;
                 } else {
                     cropper.style.height = "calc(100% - 20px)";
-                    cropper.style.width = `${(previewRect.height - 20) * 6.25 / 4.25}px`;
+                    cropper.style.width = `${(previewRect.height - 20) * sizeAspect()}px`;
                 }
                 cropper.style.transform = "translate(0px, 0px)";
             }
@@ -206,10 +291,10 @@ window.onload = function () {
         } else {
             let img = new Image();
             img.onload = () => {
-                let minWidth = 1875 * previewRect.width / img.naturalWidth;
+                let minWidth = sizeMinWidth[sizeSelector.value] * previewRect.width / img.naturalWidth;
                 let newWidth = Math.max(event.clientX - cropperRect.left, minWidth + 1)
                 cropper.style.width = `${newWidth}px`;
-                cropper.style.height = `${newWidth * 4.25 / 6.25}px`;
+                cropper.style.height = `${newWidth / sizeAspect()}px`;
                 isRightBottomCornerBeingDragged = false;
             }
             img.src = preview.src;
@@ -263,7 +348,7 @@ window.onload = function () {
         backText = backText.replace(/( (?= ))/gm, '&nbsp;');
         backText = backText.replace(/(\r\n|\n|\r)/gm, '<br />');
         formData.append("back", backText)
-        fetch("/postcards?mode=digital_preview&toRecurseId=0", { method: "POST", body: formData }).then(response =>
+        fetch("/postcards?mode=digital_preview&toRecurseId=0&size=" + sizeSelector.value, { method: "POST", body: formData }).then(response =>
             response.json()
         ).then(data => {
             if (!data["err"] && !data["status_code"]) {
@@ -320,7 +405,7 @@ window.onload = function () {
         let formData = new FormData()
         formData.append("front-postcard-file", photo)
         formData.append("back", backTextArea.value)
-        fetch("/postcards?mode=digital_send&toRecurseId=" + recipientId, { method: "POST", body: formData }).then(response =>
+        fetch("/postcards?mode=digital_send&size=" + sizeSelector.value + "&toRecurseId=" + recipientId, { method: "POST", body: formData }).then(response =>
             response.json()
         ).then(data => {
             if (!data["err"] && !data["status_code"]) {
@@ -333,6 +418,26 @@ window.onload = function () {
         })
     })
 
+    const undoPhysicalPostcardButton = document.getElementById("undoPhysicalPostcardButton")
+    undoPhysicalPostcardButton.addEventListener('click', function () {
+        fetch("/postcards/" + undoPhysicalPostcardButton.dataset.postcardId, { method: "DELETE" }).then(response => {
+            if (!response.ok) {
+                return response.text().then(text => { throw new Error(text) })
+            }
+            return response.json()
+        }).then(data => {
+            credits = data["credits"]
+            submitPostcardStatusLabel.innerText = "Postcard cancelled. Credits remaining: " + credits
+            submitPostcardStatusLabel.style = "background-color: green"
+            submitPhysicalPostcardButton.innerText = "Send Physical Postcard ✉️ (" + credits + " credits remaining)"
+        }).catch(function (error) {
+            submitPostcardStatusLabel.innerText = error.message || "Error cancelling postcard."
+            submitPostcardStatusLabel.style = "background-color: red"
+        }).finally(function () {
+            undoPhysicalPostcardButton.style.display = "none"
+        })
+    })
+
     submitPhysicalPostcardButton.addEventListener('click', function () {
         let recipientId = recipientSelector.value
         let receipientName = recipientSelector.options[recipientSelector.selectedIndex].innerText
@@ -349,7 +454,11 @@ window.onload = function () {
         let formData = new FormData()
         formData.append("front-postcard-file", photo)
         formData.append("back", backTextArea.value)
-        fetch("/postcards?mode=physical_send&toRecurseId=" + recipientId, { method: "POST", body: formData }).then(response =>
+        let sendAt = document.getElementById("sendAtInput").value
+        if (sendAt) {
+            formData.append("sendAt", new Date(sendAt).toISOString())
+        }
+        fetch("/postcards?mode=physical_send&size=" + sizeSelector.value + "&toRecurseId=" + recipientId, { method: "POST", body: formData }).then(response =>
             response.json()
         ).then(data => {
             if (!data["err"] && !data["status_code"]) {
@@ -357,6 +466,10 @@ window.onload = function () {
                 submitPostcardStatusLabel.innerText = "success sending physical mail to " + receipientName + " ✅. Credits remaining: " + credits
                 submitPostcardStatusLabel.style = "background-color: green"
                 submitPhysicalPostcardButton.innerText = "Send Physical Postcard ✉️ (" + credits + " credits remaining)"
+                if (data["postcardId"]) {
+                    undoPhysicalPostcardButton.dataset.postcardId = data["postcardId"]
+                    undoPhysicalPostcardButton.style.display = "inline"
+                }
             } else {
                 submitPostcardStatusLabel.innerText = data["message"]
                 submitPostcardStatusLabel.style = "background-color: red"
@@ -381,6 +494,7 @@ window.onload = function () {
             document.getElementById("editCity").value = address["address_city"]
             document.getElementById("editState").value = address["address_state"]
             document.getElementById("editZip").value = address["address_zip"]
+            document.getElementById("editCountry").value = address["address_country"]
             document.getElementById("editReceivePhysicalMail").checked = address["acceptsPhysicalMail"]
         } else {
             document.getElementById('showAddressDiv').style.display = "block";
@@ -389,6 +503,49 @@ window.onload = function () {
         }
     })
 
+    // suggest addresses as the user types, waiting for a pause to stay under the rate limit
+    let addressSuggestions = []
+    let autocompleteTimeout
+    const editAddress1 = document.getElementById("editAddress1")
+    editAddress1.addEventListener('input', function () {
+        let suggestion = addressSuggestions.find(s =>
+            editAddress1.value === s["address_line1"] + ", " + s["address_city"] + ", " + s["address_state"] + " " + s["address_zip"])
+        if (suggestion) {
+            editAddress1.value = suggestion["address_line1"]
+            document.getElementById("editCity").value = suggestion["address_city"]
+            document.getElementById("editState").value = suggestion["address_state"]
+            document.getElementById("editZip").value = suggestion["address_zip"]
+            return
+        }
+
+        clearTimeout(autocompleteTimeout)
+        // Lob only autocompletes US addresses
+        let country = document.getElementById("editCountry").value.toUpperCase()
+        if (country !== "" && country !== "US") {
+            return
+        }
+        autocompleteTimeout = setTimeout(function () {
+            let params = new URLSearchParams({ "prefix": editAddress1.value })
+            fetch("/addresses/autocomplete?" + params).then(response => {
+                if (!response.ok) {
+                    throw new Error(response.statusText)
+                }
+                return response.json()
+            }).then(data => {
+                addressSuggestions = data["suggestions"]
+                let datalist = document.getElementById("addressSuggestions")
+                datalist.innerHTML = ""
+                for (const s of addressSuggestions) {
+                    let option = document.createElement("option")
+                    option.value = s["address_line1"] + ", " + s["address_city"] + ", " + s["address_state"] + " " + s["address_zip"]
+                    datalist.appendChild(option)
+                }
+            }).catch(function (error) {
+                console.log(error)
+            })
+        }, 300)
+    })
+
     submitAddress.addEventListener('click', function () {
         address = {
             "name": document.getElementById("editName").value,
@@ -397,19 +554,58 @@ window.onload = function () {
             "city": document.getElementById("editCity").value,
             "state": document.getElementById("editState").value,
             "zip": document.getElementById("editZip").value,
+            "country": document.getElementById("editCountry").value,
             "acceptsPhysicalMail": document.getElementById("editReceivePhysicalMail").checked
         }
-        body = new URLSearchParams(address)
 
-        fetch("/addresses", { method: "POST", body: body }).then(response => {
-            if (response.status == 200) {
-                return response.json().then(data => {
-                    window.location.replace(window.location.href);
-                });
-            } else {
+        function saveAddress() {
+            fetch("/addresses", { method: "POST", body: new URLSearchParams(address) }).then(response => {
+                if (response.status == 200) {
+                    return response.json().then(data => {
+                        window.location.replace(window.location.href);
+                    });
+                } else {
+                    submitAddressStatusLabel.style = "background-color: red"
+                    submitAddressStatusLabel.innerText = "Invalid address, please try again!"
+                }
+            })
+        }
+
+        if (!address["acceptsPhysicalMail"]) {
+            saveAddress()
+            return
+        }
+
+        // show the address as USPS knows it before saving
+        fetch("/addresses/verify", { method: "POST", body: new URLSearchParams(address) }).then(response => {
+            if (!response.ok) {
+                throw new Error(response.statusText)
+            }
+            return response.json()
+        }).then(data => {
+            if (!data["deliverable"]) {
+                let reasons = (data["dpvFootnotes"] || []).map(footnote => footnote["description"]).join(" ")
                 submitAddressStatusLabel.style = "background-color: red"
-                submitAddressStatusLabel.innerText = "Invalid address, please try again!"
+                submitAddressStatusLabel.innerText = "This address looks undeliverable. " + reasons
+                return
             }
+            let suggested = data["suggestedAddress"]
+            if (data["changed"] && confirm("Did you mean:\n\n" +
+                [suggested["address_line1"], suggested["address_line2"],
+                 suggested["address_city"] + ", " + suggested["address_state"] + " " + suggested["address_zip"],
+                 suggested["address_country"]]
+                    .filter(line => line).join("\n"))) {
+                address["address1"] = suggested["address_line1"]
+                address["address2"] = suggested["address_line2"]
+                address["city"] = suggested["address_city"]
+                address["state"] = suggested["address_state"]
+                address["zip"] = suggested["address_zip"]
+                address["country"] = suggested["address_country"]
+            }
+            saveAddress()
+        }).catch(function (error) {
+            submitAddressStatusLabel.style = "background-color: red"
+            submitAddressStatusLabel.innerText = "Invalid address, please try again!"
         })
     });
 
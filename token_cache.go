@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPatCacheTTL         = 10 * time.Minute
+	defaultPatCacheNegativeTTL = time.Minute
+	defaultPatCacheMaxEntries  = 1000
+)
+
+type patCacheEntry struct {
+	// user is nil for tokens recurse.com rejected.
+	user      *User
+	expiresAt time.Time
+}
+
+// patCache caches which user a recurse.com personal access token belongs to,
+// and which tokens are invalid, so every API request doesn't have to be
+// checked with recurse.com. Entries expire so revoked tokens stop working,
+// and the cache is bounded. Tokens are only kept hashed.
+type patCache struct {
+	mu          sync.Mutex
+	entries     map[string]*patCacheEntry
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	now         func() time.Time
+}
+
+func newPatCache(ttl, negativeTTL time.Duration, maxEntries int) *patCache {
+	return &patCache{
+		entries:     map[string]*patCacheEntry{},
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		now:         time.Now,
+	}
+}
+
+func hashPat(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cached result for token. If found is true and user is nil,
+// the token is known to be invalid.
+func (c *patCache) get(token string) (user *User, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := hashPat(token)
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.user, true
+}
+
+// set caches the user for token, or that token is invalid if user is nil.
+func (c *patCache) set(token string, user *User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := hashPat(token)
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+
+	ttl := c.ttl
+	if user == nil {
+		ttl = c.negativeTTL
+	}
+	c.entries[key] = &patCacheEntry{user: user, expiresAt: c.now().Add(ttl)}
+}
+
+// evict makes room for one entry, dropping expired entries or else the one
+// closest to expiry. c.mu must be held.
+func (c *patCache) evict() {
+	now := c.now()
+	var oldestKey string
+	var oldest *patCacheEntry
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.expiresAt.Before(oldest.expiresAt) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if len(c.entries) >= c.maxEntries && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// purgeUser drops every cached token belonging to recurseId and returns how
+// many were dropped.
+func (c *patCache) purgeUser(recurseId int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for key, entry := range c.entries {
+		if entry.user != nil && entry.user.Id == recurseId {
+			delete(c.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPatCacheExpiry(t *testing.T) {
+	cache := newPatCache(10*time.Minute, time.Minute, 10)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	cache.set("valid", &User{Id: 7})
+	cache.set("invalid", nil)
+
+	if u, ok := cache.get("valid"); !ok || u.Id != 7 {
+		t.Errorf("got %v, %v for valid token", u, ok)
+	}
+	if u, ok := cache.get("invalid"); !ok || u != nil {
+		t.Errorf("got %v, %v for invalid token", u, ok)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.get("invalid"); ok {
+		t.Error("invalid token should have expired")
+	}
+	if _, ok := cache.get("valid"); !ok {
+		t.Error("valid token expired too early")
+	}
+
+	now = now.Add(10 * time.Minute)
+	if _, ok := cache.get("valid"); ok {
+		t.Error("valid token should have expired")
+	}
+}
+
+func TestPatCacheBounded(t *testing.T) {
+	cache := newPatCache(10*time.Minute, time.Minute, 2)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	cache.set("a", &User{Id: 1})
+	now = now.Add(time.Second)
+	cache.set("b", &User{Id: 2})
+	now = now.Add(time.Second)
+	cache.set("c", &User{Id: 3})
+
+	if len(cache.entries) != 2 {
+		t.Fatalf("cache has %d entries, want 2", len(cache.entries))
+	}
+	if _, ok := cache.get("a"); ok {
+		t.Error("expected the entry closest to expiry to be evicted")
+	}
+}
+
+func TestPatCachePurgeUser(t *testing.T) {
+	cache := newPatCache(10*time.Minute, time.Minute, 10)
+	cache.set("a", &User{Id: 1})
+	cache.set("b", &User{Id: 1})
+	cache.set("c", &User{Id: 2})
+
+	if purged := cache.purgeUser(1); purged != 2 {
+		t.Errorf("purged %d tokens, want 2", purged)
+	}
+	if _, ok := cache.get("a"); ok {
+		t.Error("token a should have been purged")
+	}
+	if _, ok := cache.get("c"); !ok {
+		t.Error("token c belongs to another user and should be kept")
+	}
+}
+
+func TestAuthPersonalAccessTokenCachesRejections(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer good" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id": 7, "name": "Ada"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	previousUrl, previousCache := org.ProfileMeUrl, pacCache
+	org.ProfileMeUrl = server.URL
+	pacCache = newPatCache(time.Minute, time.Minute, 10)
+	t.Cleanup(func() { org.ProfileMeUrl, pacCache = previousUrl, previousCache })
+
+	for _, token := range []string{"Bearer good", "Bearer bad"} {
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/postcards", nil)
+			r.Header.Set("Authorization", token)
+			user, err := authPersonalAccessToken(r)
+			if token == "Bearer good" && (err != nil || user.Id != 7) {
+				t.Errorf("got %v, %v for good token", user, err)
+			}
+			if token == "Bearer bad" && err == nil {
+				t.Error("expected bad token to be rejected")
+			}
+		}
+	}
+
+	if requests != 2 {
+		t.Errorf("recurse.com got %d requests, want 2", requests)
+	}
+}